@@ -17,39 +17,87 @@ package agent
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cmars/orc/control"
 	"github.com/pkg/errors"
 	"golang.org/x/net/proxy"
 
+	"github.com/cmars/ormesh/audit"
 	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/logging"
+	"github.com/cmars/ormesh/secrets"
+	"github.com/cmars/ormesh/socks"
 )
 
+var logger = logging.Component("agent")
+
 type Agent struct {
 	dataDir          string
 	hiddenServiceDir string
 	controlAddr      string
 	conn             *control.Conn
-	cmd              *exec.Cmd
+	controlCookie    []byte
+	controlMu        sync.Mutex
+	newTorCmd        func() *exec.Cmd
+	dialer           proxy.Dialer
+	remotes          []*meshRemote
 	forwarders       []*forwarder
-}
+	udpForwarders    []*udpForwarder
+	policy           *meshPolicy
+	meshSocksAddr    string
+	meshHTTPAddr     string
+	router           *httpRouter
+	routerAddr       string
+	endpoint         *endpoint
+	endpointAddr     string
+	gateway          *gatewayPolicy
+	gatewayAddr      string
+	apiAddr          string
+	apiTokenPath     string
+	apiToken         string
+	bootstrap        *bootstrap
+	hooks            *hookRunner
+	auditPath        string
+	configPath       string
+	secretStore      secrets.Store
+	prefetch         bool
+	metricsAddr      string
+	metrics          agentMetrics
+	descriptors      descriptorStatus
 
-type forwarder struct {
-	remoteAddr string
-	remotePort int
-	localAddr  string
-	localPort  int
-	dialer     proxy.Dialer
-	l          *net.TCPListener
+	mu              sync.Mutex
+	listening       bool
+	endpointEnabled bool
+	gatewayEnabled  bool
+	listeners       []net.Listener
+	prefetchAddrs   []string
+	node            *config.Node
+	cmd             *exec.Cmd
+	torExited       chan struct{}
+	stopping        bool
+	// expiredClients are the clients whose expiry has been applied, and
+	// expiryTimer applies the next.
+	expiredClients map[string]bool
+	expiryTimer    *time.Timer
+	// rotationDir is the previous onion service key while it is published,
+	// and rotationTimer retires it.
+	rotationDir   string
+	rotationTimer *time.Timer
+	// promotedCredentials are the next credentials of clients whose grace
+	// periods have ended, replacing their current credentials, and
+	// graceTimer ends the next grace period.
+	promotedCredentials map[string]bool
+	graceTimer          *time.Timer
 }
 
 func New(cfg *config.Config) (*Agent, error) {
@@ -78,41 +126,22 @@ Log notice stdout
 			return nil, errors.Wrap(err, "failed to create torrc")
 		}
 	}
-	args := []string{
-		"-f", torrcPath,
-		"--Log", "notice stderr",
-		"--SocksPort", cfg.Node.Agent.SocksAddr,
-		"--ControlPort", cfg.Node.Agent.ControlAddr,
-		"--CookieAuthentication", "1",
-		"--DataDirectory", dataDir,
-	}
-	cmd := exec.Command(cfg.Node.Agent.TorBinaryPath, args...)
-	cmd.Dir = dataDir
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	dialer, err := proxy.SOCKS5("tcp", cfg.Node.Agent.SocksAddr, nil, proxy.Direct)
+	args := []string{"-f", torrcPath}
+	for _, opt := range baseTorOptions(&cfg.Node.Agent) {
+		args = append(args, "--"+opt.Key, opt.Value)
+	}
+	a, err := newAgent(cfg)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	var forwarders []*forwarder
-	for _, remote := range cfg.Node.Remotes {
-		for _, import_ := range remote.Imports {
-			forwarders = append(forwarders, &forwarder{
-				dialer:     dialer,
-				remoteAddr: remote.Address,
-				remotePort: import_.RemotePort,
-				localAddr:  import_.LocalAddr,
-				localPort:  import_.LocalPort,
-			})
-		}
+	a.newTorCmd = func() *exec.Cmd {
+		cmd := exec.Command(cfg.Node.Agent.TorBinaryPath, args...)
+		cmd.Dir = dataDir
+		cmd.Stdout = newTorLogWriter()
+		cmd.Stderr = newTorLogWriter()
+		return cmd
 	}
-	return &Agent{
-		dataDir:          dataDir,
-		hiddenServiceDir: hiddenServiceDir,
-		controlAddr:      cfg.Node.Agent.ControlAddr,
-		cmd:              cmd,
-		forwarders:       forwarders,
-	}, nil
+	return a, nil
 }
 
 func newTorBrowserAgent(cfg *config.Config) (*Agent, error) {
@@ -120,49 +149,194 @@ func newTorBrowserAgent(cfg *config.Config) (*Agent, error) {
 	if err := os.MkdirAll(hiddenServiceDir, 0700); err != nil {
 		return nil, errors.Wrapf(err, "failed to create directory %q", hiddenServiceDir)
 	}
-	var forwarders []*forwarder
-	dialer, err := proxy.SOCKS5("tcp", cfg.Node.Agent.SocksAddr, nil, proxy.Direct)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	return newAgent(cfg)
+}
+
+func newAgent(cfg *config.Config) (*Agent, error) {
+	dialer := &socks.Dialer{ProxyAddr: cfg.Node.Agent.SocksAddr}
+	bootstrap := newBootstrap()
+	hooks := newHookRunner()
+	var (
+		remotes       []*meshRemote
+		forwarders    []*forwarder
+		udpForwarders []*udpForwarder
+	)
+	remotesByName := map[string]*meshRemote{}
+	for i := range cfg.Node.Remotes {
+		remote := newMeshRemote(&cfg.Node.Remotes[i], dialer, hooks)
+		remotes = append(remotes, remote)
+		remotesByName[remote.name] = remote
+		for _, import_ := range cfg.Node.Remotes[i].Imports {
+			if import_.IsUDP() {
+				udpForwarders = append(udpForwarders, newUDPForwarder(remote, &import_, bootstrap))
+				continue
+			}
+			forwarders = append(forwarders,
+				newForwarder(remote.name, []*meshRemote{remote}, "", &import_, bootstrap))
+		}
 	}
-	for _, remote := range cfg.Node.Remotes {
-		for _, import_ := range remote.Imports {
-			forwarders = append(forwarders, &forwarder{
-				dialer:     dialer,
-				remoteAddr: remote.Address,
-				remotePort: import_.RemotePort,
-				localAddr:  import_.LocalAddr,
-				localPort:  import_.LocalPort,
-			})
+	for _, group := range cfg.Node.Groups {
+		var groupRemotes []*meshRemote
+		for _, name := range group.Remotes {
+			remote, ok := remotesByName[name]
+			if !ok {
+				return nil, errors.Errorf("group %q: no such remote %q", group.Name, name)
+			}
+			groupRemotes = append(groupRemotes, remote)
+		}
+		if len(groupRemotes) == 0 {
+			continue
+		}
+		for _, import_ := range group.Imports {
+			forwarders = append(forwarders,
+				newForwarder(group.Name, groupRemotes, group.Strategy, &import_, bootstrap))
 		}
 	}
 	return &Agent{
 		dataDir:          cfg.Node.Agent.TorDataDir,
-		hiddenServiceDir: hiddenServiceDir,
+		hiddenServiceDir: cfg.Node.Agent.TorServicesDir,
 		controlAddr:      cfg.Node.Agent.ControlAddr,
+		dialer:           dialer,
+		remotes:          remotes,
 		forwarders:       forwarders,
+		udpForwarders:    udpForwarders,
+		policy:           newMeshPolicy(cfg.Node.Remotes),
+		meshSocksAddr:    cfg.Node.Agent.MeshSocksAddr,
+		meshHTTPAddr:     cfg.Node.Agent.MeshHTTPAddr,
+		router:           newHTTPRouter(cfg.Node.Service.Routes),
+		routerAddr:       cfg.Node.Agent.HTTPRouterAddr,
+		endpoint:         newEndpoint(&cfg.Node.Service, cfg.Node.Agent.HTTPRouterAddr),
+		endpointAddr:     cfg.Node.Agent.EndpointAddr,
+		endpointEnabled:  cfg.Node.Service.EndpointEnabled(),
+		gateway:          newGatewayPolicy(&cfg.Node.Service.Gateway),
+		gatewayAddr:      cfg.Node.Agent.GatewayAddr,
+		apiAddr:          cfg.Node.Agent.APIAddr,
+		apiTokenPath:     APITokenPath(cfg.Dir),
+		bootstrap:        bootstrap,
+		hooks:            hooks,
+		auditPath:        audit.Path(cfg.Dir),
+		configPath:       cfg.Path,
+		prefetch:         cfg.Node.Agent.PrefetchDescriptors,
+		metricsAddr:      cfg.Node.Agent.MetricsAddr,
+		descriptors:      newDescriptorStatus(),
+		gatewayEnabled:   cfg.Node.Service.Gateway.Port != 0,
 	}, nil
 }
 
+// torRestartDelay is how long the agent waits before restarting tor after it
+// exits unexpectedly.
+const torRestartDelay = 5 * time.Second
+
+// SetSecretStore sets the store holding the auth tokens the configuration
+// refers to, so that the agent can delete those it revokes. It must be called
+// before Start.
+func (a *Agent) SetSecretStore(store secrets.Store) {
+	a.secretStore = store
+}
+
 func (a *Agent) Start() error {
-	var (
-		conn *control.Conn
-		err  error
-	)
-	if a.cmd != nil {
-		err = a.cmd.Start()
+	if a.newTorCmd != nil {
+		err := a.startTor()
 		if err != nil {
-			return errors.Wrap(err, "failed to start")
+			return errors.WithStack(err)
 		}
 	}
+	return a.connectControl()
+}
+
+// startTor starts a tor subprocess, which is restarted if it exits before the
+// agent is stopped.
+func (a *Agent) startTor() error {
+	// Starting under the lock ensures Stop kills the process it started.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopping {
+		return errors.New("agent is stopping")
+	}
+	cmd := a.newTorCmd()
+	err := cmd.Start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start")
+	}
+	exited := make(chan struct{})
+	a.cmd, a.torExited = cmd, exited
+	go a.superviseTor(cmd, exited)
+	return nil
+}
+
+func (a *Agent) superviseTor(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	close(exited)
+	a.mu.Lock()
+	stopping := a.stopping
+	a.mu.Unlock()
+	if stopping {
+		return
+	}
+	logger.Errorf("tor exited unexpectedly: %v", err)
+	a.bootstrap.reset()
+	for {
+		time.Sleep(torRestartDelay)
+		a.mu.Lock()
+		stopping := a.stopping
+		a.mu.Unlock()
+		if stopping {
+			return
+		}
+		logger.Infof("restarting tor")
+		err := a.startTor()
+		if err != nil {
+			logger.Errorf("failed to restart tor: %v", err)
+			continue
+		}
+		atomic.AddUint64(&a.metrics.torRestarts, 1)
+		if err := a.restoreControl(); err != nil {
+			// The new process is supervised; killing it retries the restart.
+			logger.Errorf("failed to reconnect to tor: %v", err)
+			a.mu.Lock()
+			a.cmd.Process.Kill()
+			a.mu.Unlock()
+		}
+		return
+	}
+}
+
+// restoreControl reconnects to a restarted tor and reapplies the
+// configuration.
+func (a *Agent) restoreControl() error {
+	err := a.connectControl()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	a.mu.Lock()
+	node := a.node
+	a.mu.Unlock()
+	if node == nil {
+		return nil
+	}
+	err = a.UpdateServices(&node.Service)
+	if err != nil {
+		return errors.Wrap(err, "failed to configure hidden services")
+	}
+	err = a.UpdateRemotes(node)
+	if err != nil {
+		return errors.Wrap(err, "failed to configure remotes")
+	}
+	return nil
+}
+
+func (a *Agent) connectControl() error {
+	var err error
 	// Try to connect for 45 seconds cumulative
 	for s := 1; s < 10; s++ {
-		controlCookie, err := ioutil.ReadFile(
+		var controlCookie []byte
+		controlCookie, err = ioutil.ReadFile(
 			filepath.Join(a.dataDir, "control_auth_cookie"))
 		if err != nil {
 			time.Sleep(time.Duration(s) * time.Second)
 			continue
 		}
+		var conn *control.Conn
 		conn, err = control.Dial(a.controlAddr)
 		if err != nil {
 			time.Sleep(time.Duration(s) * time.Second)
@@ -172,16 +346,109 @@ func (a *Agent) Start() error {
 		if err != nil {
 			return errors.Wrap(err, "control auth failed")
 		}
+		a.controlMu.Lock()
 		a.conn = conn
-		err = a.startForwarding()
+		a.controlCookie = controlCookie
+		a.controlMu.Unlock()
+		err = a.watchEvents(controlCookie)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = a.queryBootstrap()
 		if err != nil {
-			return errors.Wrap(err, "local imports failed to start")
+			return errors.Wrap(err, "failed to query bootstrap status")
 		}
 		return nil
 	}
 	return errors.Wrap(err, "control connect failed")
 }
 
+// Configure applies the node's service and remote configuration to tor. It is
+// called when the agent starts and each time the configuration is reloaded,
+// and again if tor is restarted.
+func (a *Agent) Configure(node *config.Node) error {
+	a.mu.Lock()
+	prev := a.node
+	reload := prev != nil
+	a.node = node
+	a.mu.Unlock()
+	a.hooks.update(node.Hooks)
+	err := a.UpdateServices(&node.Service)
+	if err == nil {
+		err = a.UpdateRemotes(node)
+		if err != nil {
+			err = errors.Wrap(err, "failed to configure remotes")
+		}
+	} else {
+		err = errors.Wrap(err, "failed to configure hidden services")
+	}
+	if reload {
+		if err != nil {
+			atomic.AddUint64(&a.metrics.configReloadFailures, 1)
+		} else {
+			atomic.AddUint64(&a.metrics.configReloads, 1)
+			a.fireClientHooks(prev.Service.Clients, node.Service.Clients)
+			a.hooks.fire(&HookEvent{Event: config.HookConfigReloaded})
+		}
+	}
+	return err
+}
+
+// fireClientHooks runs hooks for clients added or revoked by a configuration
+// change.
+func (a *Agent) fireClientHooks(prev, next []config.Client) {
+	prevNames := map[string]bool{}
+	for _, client := range prev {
+		prevNames[client.Name] = true
+	}
+	for _, client := range next {
+		if !prevNames[client.Name] {
+			a.hooks.fire(&HookEvent{Event: config.HookClientAdded, Client: client.Name})
+		}
+		delete(prevNames, client.Name)
+	}
+	for name := range prevNames {
+		a.hooks.fire(&HookEvent{Event: config.HookClientRevoked, Client: name})
+	}
+}
+
+// StartListeners starts the local listeners operated by the agent: import
+// forwarders, mesh proxies, the HTTP router, the agent API and metrics.
+func (a *Agent) StartListeners() error {
+	err := a.startAPI()
+	if err != nil {
+		return errors.Wrap(err, "api failed to start")
+	}
+	err = a.startMetrics()
+	if err != nil {
+		return errors.Wrap(err, "metrics failed to start")
+	}
+	err = a.startForwarding()
+	if err != nil {
+		return errors.Wrap(err, "local imports failed to start")
+	}
+	err = a.startProxies()
+	if err != nil {
+		return errors.Wrap(err, "mesh proxies failed to start")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listening = true
+	err = a.startRouter()
+	if err != nil {
+		return errors.Wrap(err, "http router failed to start")
+	}
+	err = a.startEndpoint()
+	if err != nil {
+		return errors.Wrap(err, "endpoint failed to start")
+	}
+	err = a.startGateway()
+	if err != nil {
+		return errors.Wrap(err, "gateway failed to start")
+	}
+	return nil
+}
+
 func (a *Agent) startForwarding() error {
 	for i := range a.forwarders {
 		err := a.forwarders[i].start()
@@ -189,123 +456,209 @@ func (a *Agent) startForwarding() error {
 			return errors.WithStack(err)
 		}
 	}
-	return nil
-}
-
-func (f *forwarder) start() error {
-	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", f.localAddr, f.localPort))
-	if err != nil {
-		return errors.WithStack(err)
+	for i := range a.udpForwarders {
+		err := a.udpForwarders[i].start()
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	}
-	f.l = l.(*net.TCPListener)
-	go f.accept()
-	log.Printf("started listener %v", f.l.Addr())
 	return nil
 }
 
-func (f *forwarder) accept() {
-	for {
-		c, err := f.l.Accept()
+func (a *Agent) startProxies() error {
+	if a.meshSocksAddr != "" {
+		l, err := net.Listen("tcp", a.meshSocksAddr)
 		if err != nil {
-			log.Printf("listener exiting on error: %v", err)
-			return
+			return errors.WithStack(err)
+		}
+		a.addListener(l)
+		srv := &socks.Server{
+			Name:   "mesh socks",
+			Policy: a.policy,
+			Dialer: a.dialer,
+			Log:    logger.With("listener", "mesh socks"),
 		}
-		go f.handleConn(c.(*net.TCPConn))
+		go func() {
+			err := srv.Serve(l)
+			logger.Infof("mesh socks listener exiting on error: %v", err)
+		}()
+		logger.Infof("started mesh socks listener %v", l.Addr())
 	}
+	if a.meshHTTPAddr != "" {
+		l, err := net.Listen("tcp", a.meshHTTPAddr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		a.addListener(l)
+		srv := &http.Server{
+			Handler: newHTTPProxy(a.policy, a.dialer),
+		}
+		go func() {
+			err := srv.Serve(l)
+			logger.Infof("mesh http listener exiting on error: %v", err)
+		}()
+		logger.Infof("started mesh http listener %v", l.Addr())
+	}
+	return nil
 }
 
-func (f *forwarder) handleConn(source *net.TCPConn) {
-	log.Printf("connection from %s", source.RemoteAddr())
-	source.SetKeepAlive(true)
-	source.SetKeepAlivePeriod(time.Second * 60)
-	log.Printf("dialing %s:%d", f.remoteAddr, f.remotePort)
-	dest, err := f.dialer.Dial("tcp", fmt.Sprintf("%s:%d", f.remoteAddr, f.remotePort))
+// startRouter starts the HTTP router listener if there are routes to serve
+// and it is not already running. a.mu must be held.
+func (a *Agent) startRouter() error {
+	if !a.listening || a.router.running || !a.router.hasRoutes() {
+		return nil
+	}
+	l, err := net.Listen("tcp", a.routerAddr)
 	if err != nil {
-		log.Println(err)
-		return
+		return errors.WithStack(err)
+	}
+	a.listeners = append(a.listeners, l)
+	a.router.running = true
+	srv := &http.Server{
+		Handler: a.router,
 	}
-	destTCP := dest.(*net.TCPConn)
-	destTCP.SetKeepAlive(true)
-	destTCP.SetKeepAlivePeriod(time.Second * 60)
-	go f.forward(source, destTCP)
-	f.forward(destTCP, source)
+	go func() {
+		err := srv.Serve(l)
+		logger.Infof("http router listener exiting on error: %v", err)
+	}()
+	logger.Infof("started http router listener %v", l.Addr())
+	return nil
 }
 
-func (f *forwarder) forward(dest, source *net.TCPConn) {
-	defer dest.CloseWrite()
-	defer source.CloseRead()
-	n, err := io.Copy(dest, source)
+// startEndpoint starts the ormesh endpoint listener if the endpoint is
+// enabled and it is not already running. a.mu must be held.
+func (a *Agent) startEndpoint() error {
+	if !a.listening || a.endpoint.running || !a.endpointEnabled {
+		return nil
+	}
+	l, err := net.Listen("tcp", a.endpointAddr)
 	if err != nil {
-		log.Println(err)
+		return errors.WithStack(err)
 	}
-	log.Printf("copied %d bytes %v -> %v", n, source.RemoteAddr(), dest.RemoteAddr())
+	a.listeners = append(a.listeners, l)
+	a.endpoint.running = true
+	go func() {
+		err := a.endpoint.serve(l)
+		logger.Infof("endpoint listener exiting on error: %v", err)
+	}()
+	logger.Infof("started endpoint listener %v", l.Addr())
+	return nil
 }
 
-func (a *Agent) Stop() error {
-	if a.cmd == nil {
+// startGateway starts the gateway SOCKS listener if the gateway is enabled
+// and it is not already running. a.mu must be held.
+func (a *Agent) startGateway() error {
+	if !a.listening || a.gateway.running || !a.gatewayEnabled {
 		return nil
 	}
-	err := a.cmd.Process.Kill()
+	l, err := net.Listen("tcp", a.gatewayAddr)
 	if err != nil {
-		return errors.Wrap(err, "failed to kill process")
+		return errors.WithStack(err)
 	}
-	err = a.cmd.Wait()
-	if err != nil {
-		return errors.Wrap(err, "failed to wait for process exit")
+	a.listeners = append(a.listeners, l)
+	a.gateway.running = true
+	srv := &socks.Server{
+		Name:   "gateway",
+		Policy: a.gateway,
+		Dialer: proxy.Direct,
+		Log:    logger.With("listener", "gateway"),
 	}
+	go func() {
+		err := srv.Serve(l)
+		logger.Infof("gateway listener exiting on error: %v", err)
+	}()
+	logger.Infof("started gateway listener %v", l.Addr())
 	return nil
 }
 
-func (a *Agent) UpdateServices(svc *config.Service) error {
-	var setArgs, resetArgs []string
+// send sends a command on the control connection, which may be shared by
+// several goroutines.
+func (a *Agent) send(cmd control.Cmd) (*control.Reply, error) {
+	a.controlMu.Lock()
+	defer a.controlMu.Unlock()
+	return a.conn.Send(cmd)
+}
 
-	if len(svc.Exports) > 0 {
-		setArgs = append(setArgs, fmt.Sprintf(`HiddenServiceDir="%s"`, a.hiddenServiceDir))
-		for _, export := range svc.Exports {
-			setArgs = append(setArgs,
-				fmt.Sprintf(`HiddenServicePort="%d %s"`, export.Port, export.LocalAddr))
-		}
-	} else {
-		resetArgs = append(resetArgs, "HiddenServicePort")
-	}
+func (a *Agent) addListener(l net.Listener) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listeners = append(a.listeners, l)
+}
 
-	var clientNames []string
-	for _, client := range svc.Clients {
-		clientNames = append(clientNames, client.Name)
+func (a *Agent) Stop() error {
+	a.mu.Lock()
+	for _, l := range a.listeners {
+		l.Close()
 	}
-	if len(clientNames) > 0 {
-		setArgs = append(setArgs,
-			fmt.Sprintf(`HiddenServiceAuthorizeClient="stealth %s"`,
-				strings.Join(clientNames, ",")))
-	} else {
-		resetArgs = append(resetArgs, "HiddenServiceAuthorizeClient")
+	a.listeners = nil
+	a.stopping = true
+	if a.expiryTimer != nil {
+		a.expiryTimer.Stop()
+	}
+	if a.rotationTimer != nil {
+		a.rotationTimer.Stop()
+	}
+	if a.graceTimer != nil {
+		a.graceTimer.Stop()
+	}
+	cmd, exited := a.cmd, a.torExited
+	a.mu.Unlock()
+	for _, f := range a.udpForwarders {
+		f.close()
 	}
+	for _, remote := range a.remotes {
+		remote.close()
+	}
+	if cmd == nil {
+		return nil
+	}
+	select {
+	case <-exited:
+		// Tor had exited, and will not be restarted.
+		return nil
+	default:
+	}
+	err := cmd.Process.Kill()
+	if err != nil {
+		return errors.Wrap(err, "failed to kill process")
+	}
+	<-exited
+	return nil
+}
 
-	if len(setArgs) > 0 {
-		_, err := a.conn.Send(control.Cmd{
-			Keyword:   "SETCONF",
-			Arguments: setArgs,
-		})
-		if err != nil {
-			return errors.WithStack(err)
-		}
+func (a *Agent) UpdateServices(svc *config.Service) error {
+	a.router.update(svc.Routes)
+	a.endpoint.update(svc, a.routerAddr)
+	a.mu.Lock()
+	a.endpointEnabled = svc.EndpointEnabled()
+	a.gateway.update(&svc.Gateway)
+	a.gatewayEnabled = svc.Gateway.Port != 0
+	err := a.startRouter()
+	if err == nil {
+		err = a.startEndpoint()
 	}
-	if len(resetArgs) > 0 {
-		_, err := a.conn.Send(control.Cmd{
-			Keyword:   "RESETCONF",
-			Arguments: resetArgs,
-		})
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	if err == nil {
+		err = a.startGateway()
 	}
-	_, err := a.conn.Send(control.Cmd{
-		Keyword:   "SAVECONF",
-		Arguments: []string{},
-	})
+	a.mu.Unlock()
 	if err != nil {
-		return errors.Wrap(err, "failed to save configuration")
+		return errors.Wrap(err, "local services failed to start")
 	}
+
+	now := time.Now()
+	clients, expired, nextExpiry := activeClients(svc.Clients, now)
+	a.updateExpiry(expired, nextExpiry)
+	clientNames, promoted, nextGrace := clientCredentials(clients, now)
+	publishedDir, retiredDir := a.updateRotation(svc.Rotation, now)
+	addrs := localAddrs{router: a.routerAddr, endpoint: a.endpointAddr, gateway: a.gatewayAddr}
+	err = a.applyTorConfig(serviceTorConfig(svc, addrs, a.hiddenServiceDir, publishedDir, clientNames))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if retiredDir != "" {
+		a.retireKey(retiredDir)
+	}
+	a.updateCredentials(promoted, nextGrace)
 	return nil
 }
 
@@ -330,36 +683,71 @@ func (a *Agent) ClientAccess(clientName string) (string, string, error) {
 	return "", "", errors.New("not found")
 }
 
-func (a *Agent) UpdateRemotes(node *config.Node) error {
-	var args []string
-	for _, remote := range node.Remotes {
-		if remote.Auth != "" {
-			args = append(args, fmt.Sprintf(`HidServAuth="%s %s"`, remote.Address, remote.Auth))
+// IssuedCredentials returns the names of the client credentials tor has
+// issued for the onion service in servicesDir, without starting tor. It
+// returns none if the service has not been created yet.
+func IssuedCredentials(servicesDir string) (map[string]bool, error) {
+	hostnamePath := filepath.Join(servicesDir, "hostname")
+	f, err := os.Open(hostnamePath)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", hostnamePath)
+	}
+	defer f.Close()
+	names := map[string]bool{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Split(lines.Text(), " ")
+		if len(fields) >= 5 && fields[2] == "#" && fields[3] == "client:" {
+			names[fields[4]] = true
 		}
 	}
-	if len(args) > 0 {
-		_, err := a.conn.Send(control.Cmd{
-			Keyword:   "SETCONF",
-			Arguments: args,
-		})
+	return names, errors.WithStack(lines.Err())
+}
+
+func (a *Agent) UpdateRemotes(node *config.Node) error {
+	a.policy.update(node.Remotes)
+	defer a.updatePrefetch(node.Remotes)
+	return errors.WithStack(a.applyTorConfig(remotesTorConfig(node.Remotes)))
+}
+
+// applyTorConfig sends the control commands which make a change to tor's
+// configuration.
+func (a *Agent) applyTorConfig(tc *TorConfig) error {
+	for _, cmd := range tc.Commands() {
+		_, err := a.send(cmd)
 		if err != nil {
+			if cmd.Keyword == "SAVECONF" {
+				return errors.Wrap(err, "failed to save configuration")
+			}
 			return errors.WithStack(err)
 		}
-	} else {
-		_, err := a.conn.Send(control.Cmd{
-			Keyword:   "RESETCONF",
-			Arguments: []string{"HidServAuth"},
-		})
-		if err != nil {
-			return errors.WithStack(err)
+	}
+	return nil
+}
+
+// updatePrefetch records the remotes whose descriptors should be fetched
+// once tor has bootstrapped, fetching those newly added if it already has.
+func (a *Agent) updatePrefetch(remotes []config.Remote) {
+	if !a.prefetch {
+		return
+	}
+	a.mu.Lock()
+	known := map[string]bool{}
+	for _, addr := range a.prefetchAddrs {
+		known[addr] = true
+	}
+	var addrs, added []string
+	for _, remote := range remotes {
+		addrs = append(addrs, remote.Address)
+		if !known[remote.Address] {
+			added = append(added, remote.Address)
 		}
 	}
-	_, err := a.conn.Send(control.Cmd{
-		Keyword:   "SAVECONF",
-		Arguments: []string{},
-	})
-	if err != nil {
-		return errors.Wrap(err, "failed to save configuration")
+	a.prefetchAddrs = addrs
+	a.mu.Unlock()
+	if a.bootstrap.isDone() && len(added) > 0 {
+		go a.prefetchDescriptors(added)
 	}
-	return nil
 }
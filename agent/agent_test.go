@@ -0,0 +1,38 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopAfterTorExit(t *testing.T) {
+	a := &Agent{
+		newTorCmd: func() *exec.Cmd { return exec.Command("true") },
+		bootstrap: newBootstrap(),
+	}
+	assert.NoError(t, a.startTor())
+	a.mu.Lock()
+	exited := a.torExited
+	a.mu.Unlock()
+	<-exited
+
+	// Tor is not restarted once the agent is stopped.
+	assert.NoError(t, a.Stop())
+	assert.Error(t, a.startTor())
+}
@@ -0,0 +1,238 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// APITokenPath returns the path of the token required by the agent's API,
+// kept with the configuration in configDir.
+func APITokenPath(configDir string) string {
+	return filepath.Join(configDir, "api_token")
+}
+
+// ReadAPIToken returns the token required by the API of an agent running
+// with the configuration in configDir.
+func ReadAPIToken(configDir string) (string, error) {
+	token, err := ioutil.ReadFile(APITokenPath(configDir))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// writeAPIToken generates a new API token, and writes it where only the
+// agent's user may read it.
+func (a *Agent) writeAPIToken() error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return errors.WithStack(err)
+	}
+	token := hex.EncodeToString(buf)
+	// Replace rather than rewrite the file, so that it is created with
+	// restricted permissions.
+	tmpPath := a.apiTokenPath + ".tmp"
+	os.Remove(tmpPath)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = f.WriteString(token + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmpPath, a.apiTokenPath); err != nil {
+		return errors.WithStack(err)
+	}
+	a.apiToken = token
+	return nil
+}
+
+// requireToken only passes requests bearing the API token to h.
+func (a *Agent) requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(a.apiToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startAPI starts the agent's local HTTP API, used by ormesh commands to
+// query the running agent. Requests must bear the token written to
+// APITokenPath.
+func (a *Agent) startAPI() error {
+	if a.apiAddr == "" {
+		return nil
+	}
+	if err := a.writeAPIToken(); err != nil {
+		return errors.Wrap(err, "failed to write api token")
+	}
+	l, err := net.Listen("tcp", a.apiAddr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	a.addListener(l)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.serveStatus)
+	mux.HandleFunc("/events", a.serveEvents)
+	mux.HandleFunc("/descriptor", a.serveDescriptor)
+	mux.HandleFunc("/check", a.serveCheck)
+	srv := &http.Server{
+		Handler: a.requireToken(mux),
+	}
+	go func() {
+		err := srv.Serve(l)
+		logger.Infof("api listener exiting on error: %v", err)
+	}()
+	logger.Infof("started api listener %v", l.Addr())
+	return nil
+}
+
+func (a *Agent) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.Status()); err != nil {
+		logger.Warnf("api: %v", err)
+	}
+}
+
+// serveEvents streams tor events as JSON objects, one per line. The event
+// types are given by the comma-separated type parameter, defaulting to all
+// EventTypes.
+func (a *Agent) serveEvents(w http.ResponseWriter, r *http.Request) {
+	types := EventTypes
+	if typeParam := r.URL.Query().Get("type"); typeParam != "" {
+		types = strings.Split(strings.ToUpper(typeParam), ",")
+		for _, eventType := range types {
+			if !isEventType(eventType) {
+				http.Error(w, "unsupported event type "+eventType, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	stream, err := a.SubscribeEvents(types)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer stream.Close()
+	go func() {
+		// Unblock Next when the client goes away.
+		<-r.Context().Done()
+		stream.Close()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		ev, err := stream.Next()
+		if err != nil {
+			return
+		}
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func isEventType(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DescriptorFetch is the result of fetching an onion service descriptor.
+type DescriptorFetch struct {
+	Address   string        `json:"address"`
+	FetchTime time.Duration `json:"fetchTime"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// descriptorFetchTimeout bounds descriptor fetches requested through the API.
+const descriptorFetchTimeout = time.Minute
+
+// serveDescriptor fetches the descriptor of the onion address given by the
+// address parameter.
+func (a *Agent) serveDescriptor(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("address")
+	if !strings.HasSuffix(addr, ".onion") {
+		http.Error(w, "invalid onion address "+addr, http.StatusBadRequest)
+		return
+	}
+	result := DescriptorFetch{Address: addr}
+	fetchTime, err := a.FetchDescriptor(addr, descriptorFetchTimeout)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.FetchTime = fetchTime
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		logger.Warnf("api: %v", err)
+	}
+}
+
+// serveCheck checks the imports from the remote or group given by the remote
+// parameter, or all imports if it is not given, within the duration given by
+// the timeout parameter.
+func (a *Agent) serveCheck(w http.ResponseWriter, r *http.Request) {
+	timeout := config.DefaultDialTimeout
+	if timeoutParam := r.URL.Query().Get("timeout"); timeoutParam != "" {
+		var err error
+		timeout, err = time.ParseDuration(timeoutParam)
+		if err != nil {
+			http.Error(w, "invalid timeout "+timeoutParam, http.StatusBadRequest)
+			return
+		}
+	}
+	results := a.CheckImports(r.URL.Query().Get("remote"), timeout)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		logger.Warnf("api: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	a := &Agent{apiTokenPath: APITokenPath(dir)}
+	if err := a.writeAPIToken(); err != nil {
+		t.Fatalf("writeAPIToken: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "api_token"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	token, err := ReadAPIToken(dir)
+	if err != nil {
+		t.Fatalf("ReadAPIToken: %v", err)
+	}
+
+	h := a.requireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for auth, code := range map[string]int{
+		"":                http.StatusUnauthorized,
+		"Bearer ":         http.StatusUnauthorized,
+		"Bearer wrong":    http.StatusUnauthorized,
+		"Basic " + token:  http.StatusUnauthorized,
+		"Bearer " + token: http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/status", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code, auth)
+	}
+}
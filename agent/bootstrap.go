@@ -0,0 +1,104 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// bootstrap tracks tor's progress connecting to the tor network. Connections
+// to remotes cannot succeed until it is done. It is reset if tor restarts.
+type bootstrap struct {
+	mu       sync.Mutex
+	progress int
+	summary  string
+	done     chan struct{}
+}
+
+func newBootstrap() *bootstrap {
+	return &bootstrap{done: make(chan struct{})}
+}
+
+// update records bootstrap progress, returning true if bootstrapping has just
+// completed.
+func (b *bootstrap) update(progress int, summary string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if progress < b.progress {
+		return false
+	}
+	b.progress, b.summary = progress, summary
+	if progress < 100 {
+		return false
+	}
+	select {
+	case <-b.done:
+		return false
+	default:
+		close(b.done)
+		return true
+	}
+}
+
+// reset restarts tracking from zero progress.
+func (b *bootstrap) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.progress, b.summary = 0, ""
+	select {
+	case <-b.done:
+		b.done = make(chan struct{})
+	default:
+	}
+}
+
+// doneChan returns a channel which is closed when bootstrapping completes.
+func (b *bootstrap) doneChan() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done
+}
+
+func (b *bootstrap) isDone() bool {
+	select {
+	case <-b.doneChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for bootstrapping to complete, returning false if it does not
+// within timeout.
+func (b *bootstrap) wait(timeout time.Duration) bool {
+	if b.isDone() {
+		return true
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-b.doneChan():
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (b *bootstrap) state() (int, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.progress, b.summary
+}
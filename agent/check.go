@@ -0,0 +1,168 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// ImportCheck is the result of connecting to the remote port of an import.
+type ImportCheck struct {
+	// Import is the name of the remote or group imported from.
+	Import     string        `json:"import"`
+	Remote     string        `json:"remote"`
+	RemotePort int           `json:"remotePort"`
+	Protocol   string        `json:"protocol"`
+	Latency    time.Duration `json:"latency"`
+	Error      string        `json:"error,omitempty"`
+	Reason     string        `json:"reason,omitempty"`
+}
+
+type importTarget struct {
+	name     string
+	remote   *meshRemote
+	port     int
+	protocol string
+}
+
+// CheckImports connects once to the remote port of each import from the
+// named remote or group, or of every import if name is empty, and to each
+// remote of a group, as currently configured. Connections not made within
+// timeout fail.
+func (a *Agent) CheckImports(name string, timeout time.Duration) []ImportCheck {
+	a.mu.Lock()
+	node := a.node
+	a.mu.Unlock()
+	if node == nil {
+		return nil
+	}
+
+	// Remotes added since the agent started have no forwarders, and are
+	// dialed with a remote made for the check.
+	remotes := map[string]*meshRemote{}
+	for _, remote := range a.remotes {
+		remotes[remote.name] = remote
+	}
+	configured := map[string]*config.Remote{}
+	for i := range node.Remotes {
+		configured[node.Remotes[i].Name] = &node.Remotes[i]
+	}
+	var transient []*meshRemote
+	defer func() {
+		for _, remote := range transient {
+			remote.close()
+		}
+	}()
+	getRemote := func(remoteName string) *meshRemote {
+		cfgRemote, ok := configured[remoteName]
+		if !ok {
+			return nil
+		}
+		if remote, ok := remotes[remoteName]; ok && remote.address == cfgRemote.Address {
+			return remote
+		}
+		remote := newMeshRemote(cfgRemote, a.dialer, nil)
+		remotes[remoteName] = remote
+		transient = append(transient, remote)
+		return remote
+	}
+
+	type targetKey struct {
+		name, remote, protocol string
+		port                   int
+	}
+	seen := map[targetKey]bool{}
+	var targets []importTarget
+	add := func(importName, remoteName string, import_ *config.Import) {
+		if name != "" && name != importName {
+			return
+		}
+		remote := getRemote(remoteName)
+		if remote == nil {
+			return
+		}
+		protocol := config.ProtocolTCP
+		if import_.IsUDP() {
+			protocol = config.ProtocolUDP
+		}
+		k := targetKey{importName, remoteName, protocol, import_.RemotePort}
+		if !seen[k] {
+			seen[k] = true
+			targets = append(targets, importTarget{importName, remote, import_.RemotePort, protocol})
+		}
+	}
+	for _, remote := range node.Remotes {
+		for i := range remote.Imports {
+			add(remote.Name, remote.Name, &remote.Imports[i])
+		}
+	}
+	for _, group := range node.Groups {
+		for i := range group.Imports {
+			for _, remoteName := range group.Remotes {
+				add(group.Name, remoteName, &group.Imports[i])
+			}
+		}
+	}
+
+	start := time.Now()
+	a.bootstrap.wait(timeout)
+	remaining := timeout - time.Since(start)
+	results := make([]ImportCheck, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(t *importTarget, result *ImportCheck) {
+			defer wg.Done()
+			*result = t.check(remaining)
+		}(&targets[i], &results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func (t *importTarget) check(timeout time.Duration) ImportCheck {
+	result := ImportCheck{
+		Import:     t.name,
+		Remote:     t.remote.name,
+		RemotePort: t.port,
+		Protocol:   t.protocol,
+	}
+	if timeout <= 0 {
+		result.Error = "timed out waiting for tor to bootstrap"
+		result.Reason = "timeout"
+		return result
+	}
+	var conn net.Conn
+	var err error
+	start := time.Now()
+	if t.protocol == config.ProtocolUDP {
+		conn, err = t.remote.tunnel.open(endpointProtoUDP, t.port, timeout)
+	} else {
+		conn, err = t.remote.dial(t.port, timeout)
+	}
+	result.Latency = time.Since(start)
+	t.remote.recordDial(err, result.Latency)
+	if err != nil {
+		result.Error = err.Error()
+		result.Reason = dialErrorReason(err)
+		return result
+	}
+	conn.Close()
+	return result
+}
@@ -0,0 +1,69 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestCheckImportsTargets(t *testing.T) {
+	node := &config.Node{
+		Remotes: []config.Remote{{
+			Name:    "alice",
+			Address: "alice.onion",
+			Imports: []config.Import{{LocalPort: 8022, RemotePort: 22}},
+		}, {
+			Name:    "bob",
+			Address: "bob.onion",
+			Imports: []config.Import{{LocalPort: 5353, RemotePort: 53, Protocol: config.ProtocolUDP}},
+		}, {
+			Name:    "carol",
+			Address: "carol.onion",
+		}},
+		Groups: []config.Group{{
+			Name:    "web",
+			Remotes: []string{"alice", "carol"},
+			Imports: []config.Import{{LocalPort: 8080, RemotePort: 80}},
+		}},
+	}
+	// The agent started before bob was added.
+	a := &Agent{
+		node:      node,
+		remotes:   []*meshRemote{newMeshRemote(&node.Remotes[0], nil, nil)},
+		bootstrap: newBootstrap(),
+	}
+	checked := func(name string) []string {
+		var targets []string
+		for _, result := range a.CheckImports(name, 0) {
+			assert.Equal(t, "timeout", result.Reason)
+			targets = append(targets, result.Import+" "+result.Remote+" "+result.Protocol)
+		}
+		return targets
+	}
+	assert.Equal(t, []string{
+		"alice alice tcp",
+		"bob bob udp",
+		"web alice tcp",
+		"web carol tcp",
+	}, checked(""))
+	assert.Equal(t, []string{"bob bob udp"}, checked("bob"))
+	assert.Equal(t, []string{"web alice tcp", "web carol tcp"}, checked("web"))
+	assert.Empty(t, checked("carol"))
+	assert.Empty(t, checked("dave"))
+}
@@ -0,0 +1,131 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/audit"
+	"github.com/cmars/ormesh/config"
+)
+
+// clientCredentials returns the names of the credentials tor should
+// authorize for clients at now. A client's current credential is dropped
+// once the grace period of its next credential has ended; those clients are
+// returned as promoted. next is when the next grace period ends, which is
+// zero if none will.
+//
+// Tor does not report which credential a client connects with, so the
+// current credential is kept for the whole grace period.
+func clientCredentials(clients []config.Client, now time.Time) (names []string, promoted []config.Client, next time.Time) {
+	for _, client := range clients {
+		if client.Next == nil {
+			names = append(names, client.CredentialName())
+			continue
+		}
+		if !now.Before(client.Next.GraceEnds) {
+			promoted = append(promoted, client)
+		} else {
+			names = append(names, client.CredentialName())
+			if next.IsZero() || client.Next.GraceEnds.Before(next) {
+				next = client.Next.GraceEnds
+			}
+		}
+		names = append(names, client.Next.TorName)
+	}
+	return names, promoted, next
+}
+
+// updateCredentials records clients whose next credentials have newly
+// replaced their current ones, and schedules the services to be updated when
+// the next grace period ends. The running agent writes the replacements to
+// the configuration file.
+func (a *Agent) updateCredentials(promoted []config.Client, next time.Time) {
+	a.mu.Lock()
+	var persist []config.Client
+	replaced := map[string]bool{}
+	for _, client := range promoted {
+		replaced[client.Next.TorName] = true
+		if !a.promotedCredentials[client.Next.TorName] {
+			logger.Infof("client %q replaced its credential; revoking the previous one", client.Name)
+			if a.listening {
+				persist = append(persist, client)
+			}
+		}
+	}
+	a.promotedCredentials = replaced
+	if a.graceTimer != nil {
+		a.graceTimer.Stop()
+		a.graceTimer = nil
+	}
+	if !next.IsZero() && !a.stopping {
+		a.graceTimer = time.AfterFunc(time.Until(next), a.refreshServices)
+	}
+	a.mu.Unlock()
+
+	for _, client := range persist {
+		err := a.promoteClient(client.Name, client.Next.TorName, "grace period ended")
+		if err != nil {
+			logger.Errorf("failed to replace the credential of client %q: %v", client.Name, err)
+		}
+	}
+}
+
+// promoteClient replaces a client's current credential with its next one in
+// the configuration file, and deletes the current one from the secrets store.
+func (a *Agent) promoteClient(clientName, torName, reason string) error {
+	if a.configPath == "" {
+		return nil
+	}
+	cfg, err := config.ReadFile(a.configPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	found := false
+	var revokedRef string
+	for i := range cfg.Node.Service.Clients {
+		client := &cfg.Node.Service.Clients[i]
+		if client.Name == clientName && client.Next != nil && client.Next.TorName == torName {
+			revokedRef = client.AuthRef
+			client.PromoteNext()
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	err = config.WriteFile(cfg, a.configPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if revokedRef != "" && a.secretStore != nil {
+		err = a.secretStore.Delete(revokedRef)
+		if err != nil {
+			logger.Warnf("failed to delete revoked secret %q: %v", revokedRef, err)
+		}
+	}
+	err = audit.Append(a.auditPath, &audit.Entry{
+		Source:  audit.SourceAgent,
+		Action:  "client rotate-finish",
+		Subject: clientName,
+		Details: map[string]string{"reason": reason},
+	})
+	if err != nil {
+		logger.Warnf("%v", err)
+	}
+	return nil
+}
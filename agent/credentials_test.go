@@ -0,0 +1,108 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cmars/orc/control"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/secrets"
+)
+
+func TestClientCredentials(t *testing.T) {
+	now := time.Now()
+	clients := []config.Client{
+		{Name: "alice"},
+		{Name: "bob", TorName: "bob-1a2b", Next: &config.Credential{
+			TorName: "bob-3c4d", GraceEnds: now.Add(time.Hour)}},
+		{Name: "carol", Next: &config.Credential{
+			TorName: "carol-5e6f", GraceEnds: now.Add(-time.Minute)}},
+		{Name: "dave", Next: &config.Credential{
+			TorName: "dave-7a8b", GraceEnds: now.Add(2 * time.Hour)}},
+	}
+	names, promoted, next := clientCredentials(clients, now)
+	assert.Equal(t, []string{"alice", "bob-1a2b", "bob-3c4d", "carol-5e6f", "dave", "dave-7a8b"}, names)
+	var promotedNames []string
+	for _, client := range promoted {
+		promotedNames = append(promotedNames, client.Name)
+	}
+	assert.Equal(t, []string{"carol"}, promotedNames)
+	assert.True(t, clients[1].Next.GraceEnds.Equal(next))
+}
+
+func TestRendezvousDoesNotPromote(t *testing.T) {
+	now := time.Now()
+	a := &Agent{node: &config.Node{Service: config.Service{Clients: []config.Client{{
+		Name: "bob", TorName: "bob-1a2b", Next: &config.Credential{
+			TorName: "bob-3c4d", Address: "mqo3ldwxj4xh5yxa.onion", GraceEnds: now.Add(time.Hour)},
+	}}}}}
+	// Tor reports the service's address, not the client's, in REND_QUERY,
+	// so a rendezvous cannot tell which credential a client used.
+	a.handleEvent(&control.Reply{Status: 650, Text: "CIRC 5 BUILT " +
+		"$E8B3A5B1F1D9C4E2B7A6F0D3C9E8B1A2F4D5C6E7~relayA," +
+		"$0F8D3C2B1A0E9F8D7C6B5A4F3E2D1C0B9A8F7E6D~relayB," +
+		"$52C6E8A0B2D4F6E8A0C2E4F6A8B0D2F4E6A8C0E2~relayC " +
+		"BUILD_FLAGS=IS_INTERNAL,NEED_CAPACITY,NEED_UPTIME PURPOSE=HS_SERVICE_REND " +
+		"HS_STATE=HSSR_JOINED REND_QUERY=mqo3ldwxj4xh5yxa TIME_CREATED=2017-10-19T01:02:03.456789"})
+	assert.Empty(t, a.promotedCredentials)
+	names, promoted, _ := clientCredentials(a.node.Service.Clients, now)
+	assert.Equal(t, []string{"bob-1a2b", "bob-3c4d"}, names)
+	assert.Empty(t, promoted)
+}
+
+func TestPromoteClientDeletesSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ormesh-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, err := config.NewFile(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Node.Secrets.Backend = config.SecretsFile
+	cfg.Node.Service.Clients = []config.Client{{
+		Name: "bob", TorName: "bob-1a2b", AuthRef: "client/bob-1a2b",
+		Next: &config.Credential{TorName: "bob-3c4d", AuthRef: "client/bob-3c4d"},
+	}}
+	err = config.WriteFile(cfg, cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := secrets.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.Set("client/bob-1a2b", "old"))
+	assert.NoError(t, store.Set("client/bob-3c4d", "new"))
+
+	a := &Agent{configPath: cfg.Path, auditPath: filepath.Join(dir, "audit.log"), secretStore: store}
+	assert.NoError(t, a.promoteClient("bob", "bob-3c4d", "grace period ended"))
+	_, err = store.Get("client/bob-1a2b")
+	assert.Equal(t, secrets.ErrNotFound, err)
+	value, err := store.Get("client/bob-3c4d")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", value)
+	cfg, err = config.ReadFile(cfg.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, "client/bob-3c4d", cfg.Node.Service.Clients[0].AuthRef)
+}
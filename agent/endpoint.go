@@ -0,0 +1,262 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/mux"
+	"github.com/cmars/ormesh/socks"
+)
+
+// The endpoint protocol. Each stream opened to an ormesh endpoint begins with
+// a request of a protocol byte followed by a big-endian uint16 port, to which
+// the endpoint responds with a single status byte.
+const (
+	endpointProtoTCP = 1
+	endpointProtoUDP = 2
+
+	endpointStatusOK            = 0
+	endpointStatusNotExported   = 1
+	endpointStatusConnectFailed = 2
+	endpointStatusBadRequest    = 3
+)
+
+type endpointError byte
+
+func (e endpointError) Error() string {
+	switch byte(e) {
+	case endpointStatusNotExported:
+		return "endpoint: port not exported"
+	case endpointStatusConnectFailed:
+		return "endpoint: connect failed"
+	case endpointStatusBadRequest:
+		return "endpoint: bad request"
+	}
+	return "endpoint: unknown status " + strconv.Itoa(int(e))
+}
+
+// endpoint accepts multiplexed tunnels from remote ormesh agents, connecting
+// their streams to the services exported by this node.
+type endpoint struct {
+	// running is guarded by the Agent's mutex.
+	running bool
+
+	mu      sync.RWMutex
+	exports map[endpointKey]config.Export
+}
+
+type endpointKey struct {
+	proto byte
+	port  int
+}
+
+func newEndpoint(svc *config.Service, routerAddr string) *endpoint {
+	e := &endpoint{}
+	e.update(svc, routerAddr)
+	return e
+}
+
+func (e *endpoint) update(svc *config.Service, routerAddr string) {
+	exports := map[endpointKey]config.Export{}
+	for _, export := range svc.Exports {
+		proto := byte(endpointProtoTCP)
+		if export.IsUDP() {
+			proto = endpointProtoUDP
+		}
+		exports[endpointKey{proto, export.Port}] = export
+	}
+	if len(svc.Routes) > 0 {
+		exports[endpointKey{endpointProtoTCP, config.HTTPRouterPort}] = config.Export{
+			LocalAddr: routerAddr,
+			Port:      config.HTTPRouterPort,
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.exports = exports
+}
+
+func (e *endpoint) serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		go e.serveConn(c)
+	}
+}
+
+func (e *endpoint) serveConn(c net.Conn) {
+	session := mux.Server(c, nil)
+	defer session.Close()
+	logger.Infof("endpoint: tunnel opened")
+	for {
+		st, err := session.Accept()
+		if err != nil {
+			logger.Infof("endpoint: tunnel closed: %v", err)
+			return
+		}
+		go e.handleStream(st)
+	}
+}
+
+func (e *endpoint) handleStream(st *mux.Stream) {
+	defer st.Close()
+	var req [3]byte
+	st.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(st, req[:]); err != nil {
+		logger.Warnf("endpoint: stream %d: failed to read request: %v", st.ID(), err)
+		return
+	}
+	st.SetReadDeadline(time.Time{})
+	proto, port := req[0], int(binary.BigEndian.Uint16(req[1:]))
+
+	e.mu.RLock()
+	export, ok := e.exports[endpointKey{proto, port}]
+	e.mu.RUnlock()
+	if !ok {
+		logger.Warnf("endpoint: stream %d: port %d not exported", st.ID(), port)
+		st.Write([]byte{endpointStatusNotExported})
+		return
+	}
+	localAddr := export.LocalAddr
+	switch proto {
+	case endpointProtoTCP:
+		dest, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			logger.Warnf("endpoint: stream %d: %v", st.ID(), err)
+			st.Write([]byte{endpointStatusConnectFailed})
+			return
+		}
+		defer dest.Close()
+		if _, err := st.Write([]byte{endpointStatusOK}); err != nil {
+			return
+		}
+		logger.Debugf("endpoint: stream %d connected to %s", st.ID(), localAddr)
+		socks.Pipe(st, dest)
+	case endpointProtoUDP:
+		if _, err := st.Write([]byte{endpointStatusOK}); err != nil {
+			return
+		}
+		logger.Debugf("endpoint: stream %d relaying udp to %s", st.ID(), localAddr)
+		relayUDP(st, &export)
+	default:
+		logger.Warnf("endpoint: stream %d: unsupported protocol %d", st.ID(), proto)
+		st.Write([]byte{endpointStatusBadRequest})
+	}
+}
+
+// tunnel maintains a multiplexed session to a remote's ormesh endpoint,
+// reconnecting as needed.
+type tunnel struct {
+	name   string
+	addr   string
+	dialer proxy.Dialer
+
+	mu      sync.Mutex
+	session *mux.Session
+}
+
+func newTunnel(remote *config.Remote, dialer proxy.Dialer) *tunnel {
+	return &tunnel{
+		name:   remote.Name,
+		addr:   net.JoinHostPort(remote.Address, strconv.Itoa(config.EndpointPort)),
+		dialer: dialer,
+	}
+}
+
+func (t *tunnel) getSession(timeout time.Duration) (*mux.Session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session != nil && !t.session.IsClosed() {
+		return t.session, nil
+	}
+	logger.Infof("tunnel %s: connecting to %s", t.name, t.addr)
+	conn, err := dialTimeout(t.dialer, t.addr, timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect tunnel to %q", t.name)
+	}
+	t.session = mux.Client(conn, nil)
+	return t.session, nil
+}
+
+// open opens a stream to port on the remote over the tunnel, giving up after
+// timeout if it is not zero. If the tunnel has gone away, it is reconnected
+// once.
+func (t *tunnel) open(proto byte, port int, timeout time.Duration) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var session *mux.Session
+		session, err = t.getSession(timeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var st *mux.Stream
+		st, err = t.request(session, proto, port, timeout)
+		if err == nil {
+			return st, nil
+		}
+		if _, ok := errors.Cause(err).(endpointError); ok || !session.IsClosed() {
+			break
+		}
+	}
+	return nil, errors.Wrapf(err, "tunnel %s", t.name)
+}
+
+func (t *tunnel) request(session *mux.Session, proto byte, port int, timeout time.Duration) (*mux.Stream, error) {
+	st, err := session.Open()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if timeout > 0 {
+		st.SetDeadline(time.Now().Add(timeout))
+	}
+	req := []byte{proto, 0, 0}
+	binary.BigEndian.PutUint16(req[1:], uint16(port))
+	if _, err := st.Write(req); err != nil {
+		st.Close()
+		return nil, errors.WithStack(err)
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(st, status[:]); err != nil {
+		st.Close()
+		return nil, errors.WithStack(err)
+	}
+	if status[0] != endpointStatusOK {
+		st.Close()
+		return nil, errors.WithStack(endpointError(status[0]))
+	}
+	st.SetDeadline(time.Time{})
+	return st, nil
+}
+
+func (t *tunnel) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session != nil {
+		t.session.Close()
+		t.session = nil
+	}
+}
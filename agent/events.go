@@ -0,0 +1,283 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cmars/orc/control"
+	"github.com/pkg/errors"
+)
+
+// EventTypes are the tor events which may be streamed from the agent.
+var EventTypes = []string{"CIRC", "HS_DESC", "STREAM", "STATUS_CLIENT"}
+
+// TorEvent is an asynchronous tor event concerning the node's onion service,
+// one of its remotes, or tor itself.
+type TorEvent struct {
+	Time     time.Time         `json:"time"`
+	Type     string            `json:"type"`
+	Args     []string          `json:"args"`
+	Keywords map[string]string `json:"keywords,omitempty"`
+	// Onion is the onion address the event concerns, if any.
+	Onion string `json:"onion,omitempty"`
+	// Subject names the remote or service the onion address belongs to.
+	Subject string `json:"subject,omitempty"`
+}
+
+func (e *TorEvent) arg(i int) string {
+	if i < len(e.Args) {
+		return e.Args[i]
+	}
+	return ""
+}
+
+// String summarizes the event on a single line.
+func (e *TorEvent) String() string {
+	var msg string
+	switch e.Type {
+	case "CIRC":
+		// CIRC <id> <status> [path] PURPOSE=... HS_STATE=... REND_QUERY=...
+		msg = fmt.Sprintf("circuit %s %s", e.arg(0), e.arg(1))
+		if purpose := e.Keywords["PURPOSE"]; purpose != "" {
+			msg += " " + purpose
+		}
+		if state := e.Keywords["HS_STATE"]; state != "" {
+			msg += " " + state
+		}
+	case "STREAM":
+		// STREAM <id> <status> <circuit id> <target> ...
+		msg = fmt.Sprintf("stream %s %s to %s on circuit %s", e.arg(0), e.arg(1), e.arg(3), e.arg(2))
+	case "HS_DESC":
+		// HS_DESC <action> <address> <auth type> <hsdir> ...
+		msg = fmt.Sprintf("descriptor %s %s", e.arg(0), e.arg(1))
+		if hsdir := e.arg(3); hsdir != "" && hsdir != "UNKNOWN" {
+			msg += " at " + hsdir
+		}
+	case "STATUS_CLIENT":
+		// STATUS_CLIENT <severity> <action> ...
+		if e.arg(1) == "BOOTSTRAP" {
+			msg = fmt.Sprintf("bootstrap %s%%: %s", e.Keywords["PROGRESS"], e.Keywords["SUMMARY"])
+		} else {
+			msg = strings.ToLower(e.arg(0)) + " " + e.arg(1)
+		}
+	default:
+		msg = strings.Join(e.Args, " ")
+	}
+	if reason := e.Keywords["REASON"]; reason != "" {
+		msg += " (" + reason + ")"
+	}
+	return msg
+}
+
+// eventOnion returns the onion address, without the .onion suffix, which an
+// event concerns.
+func eventOnion(eventType string, args []string, kw map[string]string) string {
+	switch eventType {
+	case "CIRC":
+		return kw["REND_QUERY"]
+	case "STREAM":
+		if len(args) < 4 {
+			return ""
+		}
+		host, _, err := net.SplitHostPort(args[3])
+		if err != nil || !strings.HasSuffix(host, ".onion") {
+			return ""
+		}
+		return strings.TrimSuffix(host, ".onion")
+	case "HS_DESC":
+		if len(args) < 2 {
+			return ""
+		}
+		return args[1]
+	}
+	return ""
+}
+
+// eventSubjects returns the names of the node's onion addresses, and those
+// of its remotes, keyed by address without the .onion suffix.
+func (a *Agent) eventSubjects() map[string]string {
+	subjects := map[string]string{}
+	a.mu.Lock()
+	if a.node != nil {
+		for _, remote := range a.node.Remotes {
+			subjects[strings.TrimSuffix(remote.Address, ".onion")] = "remote " + remote.Name
+		}
+	}
+	rotationDir := a.rotationDir
+	a.mu.Unlock()
+
+	if rotationDir != "" {
+		addServiceSubjects(subjects, rotationDir, " (previous key)")
+	}
+	addServiceSubjects(subjects, a.hiddenServiceDir, "")
+	return subjects
+}
+
+// addServiceSubjects names the addresses in the hostname file of the onion
+// service key in dir, appending suffix to each name.
+func addServiceSubjects(subjects map[string]string, dir, suffix string) {
+	// With stealth authorization, each client is given its own address, and
+	// the service's own address is not in the hostname file.
+	if onion, err := serviceOnion(dir); err == nil {
+		subjects[onion] = "service" + suffix
+	}
+	f, err := os.Open(filepath.Join(dir, "hostname"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		subject := "service"
+		if i := strings.Index(lines.Text(), "# client: "); i >= 0 {
+			subject = "service client " + lines.Text()[i+len("# client: "):]
+		}
+		subjects[strings.TrimSuffix(fields[0], ".onion")] = subject + suffix
+	}
+}
+
+// serviceOnion returns the onion address, without the .onion suffix, of the
+// onion service key in dir.
+func serviceOnion(dir string) (string, error) {
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, "private_key"))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return "", errors.New("invalid private key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	// The address is the first 80 bits of the digest of the public key.
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	return strings.ToLower(base32.StdEncoding.EncodeToString(digest[:10])), nil
+}
+
+// serviceOnions returns the addresses of the node's onion service, without
+// the .onion suffix.
+func (a *Agent) serviceOnions() map[string]bool {
+	subjects := map[string]string{}
+	a.mu.Lock()
+	rotationDir := a.rotationDir
+	a.mu.Unlock()
+	if rotationDir != "" {
+		addServiceSubjects(subjects, rotationDir, "")
+	}
+	addServiceSubjects(subjects, a.hiddenServiceDir, "")
+	onions := map[string]bool{}
+	for onion := range subjects {
+		onions[onion] = true
+	}
+	return onions
+}
+
+// EventStream is a subscription to tor events relevant to the node.
+type EventStream struct {
+	netConn  net.Conn
+	conn     *control.Conn
+	subjects map[string]string
+}
+
+// SubscribeEvents subscribes to the given tor event types on a new control
+// connection.
+func (a *Agent) SubscribeEvents(types []string) (*EventStream, error) {
+	a.controlMu.Lock()
+	cookie := a.controlCookie
+	a.controlMu.Unlock()
+	if cookie == nil {
+		return nil, errors.New("not connected to tor")
+	}
+	netConn, err := net.Dial("tcp", a.controlAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "control connect failed")
+	}
+	conn := control.Client(netConn)
+	err = conn.AuthCookie(cookie)
+	if err != nil {
+		netConn.Close()
+		return nil, errors.Wrap(err, "control auth failed")
+	}
+	err = conn.SetEvents(types)
+	if err != nil {
+		netConn.Close()
+		return nil, errors.Wrapf(err, "failed to subscribe to %s", strings.Join(types, ","))
+	}
+	return &EventStream{
+		netConn:  netConn,
+		conn:     conn,
+		subjects: a.eventSubjects(),
+	}, nil
+}
+
+// Next returns the next event concerning the node's onion service or its
+// remotes, or tor's status. It returns io.EOF once the stream is closed.
+func (s *EventStream) Next() (*TorEvent, error) {
+	for {
+		r, err := s.conn.Receive()
+		// Receive returns an empty reply rather than an error if the
+		// connection is closed.
+		if err != nil || r.Status == 0 {
+			return nil, io.EOF
+		}
+		if !r.IsAsync() {
+			continue
+		}
+		eventType, text := r.Text, ""
+		if i := strings.IndexByte(r.Text, ' '); i >= 0 {
+			eventType, text = r.Text[:i], r.Text[i+1:]
+		}
+		args, kw := parseEventArgs(text)
+		ev := &TorEvent{
+			Time:     time.Now(),
+			Type:     eventType,
+			Args:     args,
+			Keywords: kw,
+			Onion:    eventOnion(eventType, args, kw),
+		}
+		if eventType != "STATUS_CLIENT" {
+			subject, ok := s.subjects[ev.Onion]
+			if !ok {
+				continue
+			}
+			ev.Subject = subject
+		}
+		return ev, nil
+	}
+}
+
+// Close closes the stream's control connection.
+func (s *EventStream) Close() error {
+	return s.netConn.Close()
+}
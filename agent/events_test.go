@@ -0,0 +1,75 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventOnion(t *testing.T) {
+	for _, tc := range []struct {
+		event string
+		onion string
+	}{{
+		event: "CIRC 12 BUILT $AAAA~a,$BBBB~b BUILD_FLAGS=IS_INTERNAL,NEED_CAPACITY PURPOSE=HS_CLIENT_REND HS_STATE=HSCR_JOINED REND_QUERY=abcdefghijklmnop",
+		onion: "abcdefghijklmnop",
+	}, {
+		event: "CIRC 13 LAUNCHED BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL",
+		onion: "",
+	}, {
+		event: "STREAM 40 SUCCEEDED 12 abcdefghijklmnop.onion:22",
+		onion: "abcdefghijklmnop",
+	}, {
+		event: "STREAM 41 NEW 0 example.com:443 SOURCE_ADDR=127.0.0.1:5000 PURPOSE=USER",
+		onion: "",
+	}, {
+		event: "HS_DESC UPLOADED abcdefghijklmnop STEALTH_AUTH $AAAA~relay",
+		onion: "abcdefghijklmnop",
+	}, {
+		event: "STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY=\"Done\"",
+		onion: "",
+	}} {
+		positional, kw := parseEventArgs(tc.event)
+		assert.Equal(t, tc.onion, eventOnion(positional[0], positional[1:], kw), tc.event)
+	}
+}
+
+func TestTorEventString(t *testing.T) {
+	for _, tc := range []struct {
+		event string
+		s     string
+	}{{
+		event: "CIRC 12 BUILT $AAAA~a,$BBBB~b PURPOSE=HS_CLIENT_REND HS_STATE=HSCR_JOINED REND_QUERY=abcdefghijklmnop",
+		s:     "circuit 12 BUILT HS_CLIENT_REND HSCR_JOINED",
+	}, {
+		event: "STREAM 40 FAILED 12 abcdefghijklmnop.onion:22 REASON=TIMEOUT",
+		s:     "stream 40 FAILED to abcdefghijklmnop.onion:22 on circuit 12 (TIMEOUT)",
+	}, {
+		event: "HS_DESC FAILED abcdefghijklmnop NO_AUTH $AAAA~relay REASON=NOT_FOUND",
+		s:     "descriptor FAILED abcdefghijklmnop at $AAAA~relay (NOT_FOUND)",
+	}, {
+		event: "STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=85 TAG=ap_conn_done SUMMARY=\"Connected\"",
+		s:     "bootstrap 85%: Connected",
+	}, {
+		event: "STATUS_CLIENT WARN DANGEROUS_SOCKS",
+		s:     "warn DANGEROUS_SOCKS",
+	}} {
+		positional, kw := parseEventArgs(tc.event)
+		ev := &TorEvent{Type: positional[0], Args: positional[1:], Keywords: kw}
+		assert.Equal(t, tc.s, ev.String(), tc.event)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/cmars/ormesh/audit"
+	"github.com/cmars/ormesh/config"
+)
+
+// activeClients returns the clients whose authorizations have not expired at
+// now, those which have, and when the next active client expires, which is
+// zero if none will.
+func activeClients(clients []config.Client, now time.Time) (active, expired []config.Client, next time.Time) {
+	for _, client := range clients {
+		if client.IsExpired(now) {
+			expired = append(expired, client)
+			continue
+		}
+		active = append(active, client)
+		if client.Expires != nil && (next.IsZero() || client.Expires.Before(next)) {
+			next = *client.Expires
+		}
+	}
+	return active, expired, next
+}
+
+// updateExpiry logs, audits and runs hooks for clients which have newly
+// expired, and schedules the services to be updated when the next client
+// expires. Only the running agent does so; expired clients are left out of
+// tor's configuration regardless.
+func (a *Agent) updateExpiry(expired []config.Client, next time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.listening {
+		return
+	}
+	revoked := map[string]bool{}
+	for _, client := range expired {
+		revoked[client.Name] = true
+		if !a.expiredClients[client.Name] {
+			logger.Infof("client %q authorization expired at %s; revoking", client.Name, client.Expires.Format(time.RFC3339))
+			a.hooks.fire(&HookEvent{Event: config.HookClientRevoked, Client: client.Name, Reason: "expired"})
+			err := audit.Append(a.auditPath, &audit.Entry{
+				Source:  audit.SourceAgent,
+				Action:  "client revoke",
+				Subject: client.Name,
+				Details: map[string]string{
+					"reason":  "expired",
+					"expires": client.Expires.UTC().Format(time.RFC3339),
+				},
+			})
+			if err != nil {
+				logger.Warnf("%v", err)
+			}
+		}
+	}
+	a.expiredClients = revoked
+	if a.expiryTimer != nil {
+		a.expiryTimer.Stop()
+		a.expiryTimer = nil
+	}
+	if !next.IsZero() && !a.stopping {
+		a.expiryTimer = time.AfterFunc(time.Until(next), a.refreshServices)
+	}
+}
+
+// refreshServices updates the services to revoke clients which have expired,
+// and retire a previous onion service key.
+func (a *Agent) refreshServices() {
+	a.mu.Lock()
+	node := a.node
+	a.mu.Unlock()
+	if node == nil {
+		return
+	}
+	if err := a.UpdateServices(&node.Service); err != nil {
+		logger.Errorf("failed to update services: %v", err)
+	}
+}
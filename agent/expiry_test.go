@@ -0,0 +1,79 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestActiveClients(t *testing.T) {
+	now := time.Now()
+	past, soon, later := now.Add(-time.Hour), now.Add(time.Hour), now.Add(2*time.Hour)
+	clients := []config.Client{
+		{Name: "later", Expires: &later},
+		{Name: "permanent"},
+		{Name: "expired", Expires: &past},
+		{Name: "soon", Expires: &soon},
+	}
+	active, expired, next := activeClients(clients, now)
+	var activeNames []string
+	for _, client := range active {
+		activeNames = append(activeNames, client.Name)
+	}
+	assert.Equal(t, []string{"later", "permanent", "soon"}, activeNames)
+	if assert.Len(t, expired, 1) {
+		assert.Equal(t, "expired", expired[0].Name)
+	}
+	assert.True(t, soon.Equal(next))
+
+	_, _, next = activeClients(clients[1:2], now)
+	assert.True(t, next.IsZero())
+}
+
+func TestUpdateExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ormesh-expiry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	past, soon := now.Add(-time.Hour), now.Add(time.Hour)
+	expired := []config.Client{{Name: "expired", Expires: &past}}
+
+	// An agent which is not running, as a command uses to configure tor,
+	// neither records revocations nor schedules updates.
+	a := &Agent{hooks: newHookRunner(), auditPath: filepath.Join(dir, "audit.log")}
+	a.updateExpiry(expired, soon)
+	assert.Nil(t, a.expiryTimer)
+	assert.Empty(t, a.expiredClients)
+	_, err = os.Stat(a.auditPath)
+	assert.True(t, os.IsNotExist(err))
+
+	a.listening = true
+	defer a.Stop()
+	a.updateExpiry(expired, soon)
+	assert.NotNil(t, a.expiryTimer)
+	assert.Equal(t, map[string]bool{"expired": true}, a.expiredClients)
+	_, err = os.Stat(a.auditPath)
+	assert.NoError(t, err)
+}
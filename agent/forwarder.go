@@ -0,0 +1,304 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/logging"
+	"github.com/cmars/ormesh/socks"
+)
+
+// nextConnID numbers forwarded connections, to identify them in log
+// messages.
+var nextConnID uint64
+
+// maxRetryBackoff limits the wait between retries of a failed connection.
+const maxRetryBackoff = 30 * time.Second
+
+// forwarder listens on a local port and forwards connections to a port on
+// one of its remotes. A forwarder for a group import has several remotes,
+// which are tried in an order determined by the group's strategy.
+type forwarder struct {
+	name         string
+	remotes      []*meshRemote
+	dialOrder    dialOrder
+	remotePort   int
+	localAddr    string
+	localPort    int
+	dialTimeout  time.Duration
+	dialRetries  int
+	retryBackoff time.Duration
+	ready        *bootstrap
+	conns        chan struct{}
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+	readLimit    *tokenBucket
+	writeLimit   *tokenBucket
+	log          *logging.Logger
+	l            *net.TCPListener
+
+	stats forwarderStats
+}
+
+func newForwarder(name string, remotes []*meshRemote, strategy string, import_ *config.Import, ready *bootstrap) *forwarder {
+	var conns chan struct{}
+	if import_.MaxConns > 0 {
+		conns = make(chan struct{}, import_.MaxConns)
+	}
+	return &forwarder{
+		name:         name,
+		remotes:      remotes,
+		dialOrder:    dialOrder{strategy: strategy},
+		remotePort:   import_.RemotePort,
+		localAddr:    import_.LocalAddr,
+		localPort:    import_.LocalPort,
+		dialTimeout:  import_.DialTimeout.Or(config.DefaultDialTimeout),
+		dialRetries:  import_.Retries(),
+		retryBackoff: import_.RetryBackoff.Or(config.DefaultRetryBackoff),
+		ready:        ready,
+		conns:        conns,
+		idleTimeout:  import_.IdleTimeout.Duration,
+		maxLifetime:  import_.MaxLifetime.Duration,
+		readLimit:    newTokenBucket(import_.ReadRate),
+		writeLimit:   newTokenBucket(import_.WriteRate),
+		log:          logger.With("import", fmt.Sprintf("%s:%d", name, import_.RemotePort)),
+		stats:        forwarderStats{dialErrors: map[string]uint64{}},
+	}
+}
+
+func (f *forwarder) start() error {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", f.localAddr, f.localPort))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f.l = l.(*net.TCPListener)
+	go f.accept()
+	f.log.Infof("started listener %v", f.l.Addr())
+	return nil
+}
+
+func (f *forwarder) accept() {
+	for {
+		c, err := f.l.Accept()
+		if err != nil {
+			f.log.Infof("listener exiting on error: %v", err)
+			return
+		}
+		go f.handleConn(c.(*net.TCPConn), f.log.With("conn", atomic.AddUint64(&nextConnID, 1)))
+	}
+}
+
+// handleConn forwards a local connection to the remote, logging its progress
+// with connLog, which identifies the connection.
+func (f *forwarder) handleConn(source *net.TCPConn, connLog *logging.Logger) {
+	connLog.Infof("connection from %s", source.RemoteAddr())
+	f.stats.accept()
+	if f.conns != nil {
+		select {
+		case f.conns <- struct{}{}:
+			defer func() { <-f.conns }()
+		default:
+			connLog.Warnf("rejecting connection: %d connections open", cap(f.conns))
+			f.stats.reject()
+			source.Close()
+			return
+		}
+	}
+	source.SetKeepAlive(true)
+	source.SetKeepAlivePeriod(time.Second * 60)
+	if !f.ready.isDone() {
+		connLog.Infof("holding connection until tor has bootstrapped")
+		if !f.ready.wait(f.dialTimeout) {
+			connLog.Warnf("dropping connection: tor has not bootstrapped")
+			f.stats.fail()
+			source.Close()
+			return
+		}
+	}
+	dest, err := f.dial(connLog)
+	if err != nil {
+		connLog.Warnf("dropping connection: %v", err)
+		f.stats.fail()
+		source.Close()
+		return
+	}
+	f.stats.connect()
+	defer f.stats.disconnect()
+	if destTCP, ok := dest.(*net.TCPConn); ok {
+		destTCP.SetKeepAlive(true)
+		destTCP.SetKeepAlivePeriod(time.Second * 60)
+	}
+	defer dest.Close()
+	defer source.Close()
+
+	start := time.Now().UnixNano()
+	lastActive := start
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	var expireOnce sync.Once
+	go watchConn(watchDone, &lastActive, f.idleTimeout, f.maxLifetime, func(reason string) {
+		expireOnce.Do(func() {
+			connLog.Infof("closing connection: %s timeout", reason)
+			f.stats.expire(reason)
+			source.Close()
+			dest.Close()
+		})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		n := f.forward(source, dest, &connReader{r: dest, bucket: f.writeLimit, lastActive: &lastActive}, connLog)
+		f.stats.received(n)
+		close(done)
+	}()
+	n := f.forward(dest, source, &connReader{r: source, bucket: f.readLimit, lastActive: &lastActive}, connLog)
+	f.stats.sent(n)
+	<-done
+	connLog.Infof("connection closed after %v", time.Since(time.Unix(0, start)))
+}
+
+// dial connects to the remote port, retrying with exponential backoff while
+// the failure might be temporary.
+func (f *forwarder) dial(connLog *logging.Logger) (net.Conn, error) {
+	backoff := f.retryBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := f.dialOnce(connLog)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= f.dialRetries || !isTemporary(err) {
+			return nil, errors.Wrapf(err, "failed to connect to %s:%d", f.name, f.remotePort)
+		}
+		connLog.Infof("retrying %s:%d in %v", f.name, f.remotePort, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// dialOnce connects to the remote port on the first remote which accepts the
+// connection, recording the result in each remote's health.
+func (f *forwarder) dialOnce(connLog *logging.Logger) (net.Conn, error) {
+	var lastErr error
+	for _, remote := range f.dialOrder.order(f.remotes) {
+		connLog.Debugf("dialing %s:%d", remote.name, f.remotePort)
+		start := time.Now()
+		conn, err := remote.dial(f.remotePort, f.dialTimeout)
+		latency := time.Since(start)
+		remote.recordDial(err, latency)
+		if err == nil {
+			remote.dialLatency.observe(latency)
+			connLog.Infof("connected to %s:%d in %v", remote.name, f.remotePort, latency)
+			return conn, nil
+		}
+		reason := dialErrorReason(err)
+		f.stats.dialError(reason)
+		if hint, ok := dialErrorHints[reason]; ok {
+			connLog.Warnf("failed to connect to %s:%d: %v (%s)", remote.name, f.remotePort, err, hint)
+		} else {
+			connLog.Warnf("failed to connect to %s:%d: %v", remote.name, f.remotePort, err)
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+var dialErrorHints = map[string]string{
+	"descriptor-not-found": "the remote may be offline, or has not yet published its onion service",
+	"descriptor-invalid":   "the remote's onion service descriptor could not be decoded",
+	"intro-failed":         "the remote may have restarted; retrying usually succeeds",
+	"intro-timed-out":      "the remote may be offline or overloaded",
+	"rendezvous-failed":    "retrying usually succeeds",
+	"missing-client-auth":  "the client token for this remote is missing; check 'ormesh remote show'",
+	"bad-client-auth":      "the remote did not accept this client token; it may have been revoked",
+	"bad-address":          "the remote's onion address is invalid",
+	"not-exported":         "the remote does not export this port",
+}
+
+// dialErrorReason returns a short identifier for why a connection to a
+// remote failed.
+func dialErrorReason(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case *socks.ReplyError:
+		return cause.Reason()
+	case endpointError:
+		switch byte(cause) {
+		case endpointStatusNotExported:
+			return "not-exported"
+		case endpointStatusConnectFailed:
+			return "connect-failed"
+		}
+		return "bad-request"
+	case net.Error:
+		if cause.Timeout() {
+			return "timeout"
+		}
+	}
+	return "other"
+}
+
+// isTemporary returns whether a failed connection to a remote might succeed
+// if retried.
+func isTemporary(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case *socks.ReplyError:
+		return cause.Temporary()
+	case endpointError:
+		return byte(cause) == endpointStatusConnectFailed
+	}
+	return true
+}
+
+type closeReader interface {
+	CloseRead() error
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// forward copies from r, reading from source, to dest until EOF, returning
+// the number of bytes copied.
+func (f *forwarder) forward(dest, source net.Conn, r io.Reader, connLog *logging.Logger) int64 {
+	defer func() {
+		if cw, ok := dest.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dest.Close()
+		}
+	}()
+	defer func() {
+		if cr, ok := source.(closeReader); ok {
+			cr.CloseRead()
+		}
+	}()
+	n, err := io.Copy(dest, r)
+	if err != nil {
+		connLog.Debugf("copy %v -> %v: %v", source.RemoteAddr(), dest.RemoteAddr(), err)
+	}
+	connLog.Debugf("copied %d bytes %v -> %v", n, source.RemoteAddr(), dest.RemoteAddr())
+	return n
+}
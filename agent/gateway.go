@@ -0,0 +1,94 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/socks"
+)
+
+// gatewayPolicy permits gateway connections to hosts on the allowed networks
+// and ports.
+type gatewayPolicy struct {
+	// running is guarded by the Agent's mutex.
+	running bool
+
+	mu    sync.RWMutex
+	nets  []*net.IPNet
+	ports []int
+}
+
+func newGatewayPolicy(gw *config.Gateway) *gatewayPolicy {
+	p := &gatewayPolicy{}
+	p.update(gw)
+	return p
+}
+
+func (p *gatewayPolicy) update(gw *config.Gateway) {
+	nets, err := gw.Networks()
+	if err != nil {
+		// Invalid networks are rejected when configured; deny all rather
+		// than allow a partial list.
+		nets = nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nets = nets
+	p.ports = append([]int(nil), gw.AllowPorts...)
+}
+
+// Resolve implements socks.Policy. Host names are resolved locally, and the
+// first permitted address is dialed, so that the address checked is the one
+// connected to.
+func (p *gatewayPolicy) Resolve(host string, port int) (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.ports) > 0 {
+		allowed := false
+		for _, allowPort := range p.ports {
+			if allowPort == port {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", errors.Wrapf(socks.ErrNotAllowed, "port %d", port)
+		}
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to resolve %q", host)
+		}
+	}
+	for _, ip := range ips {
+		for _, ipNet := range p.nets {
+			if ipNet.Contains(ip) {
+				return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+			}
+		}
+	}
+	return "", errors.Wrapf(socks.ErrNotAllowed, "host %q", host)
+}
@@ -0,0 +1,175 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// HookEvent describes an event to hooks, in ORMESH_* environment variables
+// to commands, and as a JSON object posted to webhooks.
+type HookEvent struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote,omitempty"`
+	Client string    `json:"client,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// subject identifies what the event is about, such as "remote web" for
+// remote-up and remote-down events about the remote named web. Events about
+// the same subject are debounced together.
+func (ev *HookEvent) subject() string {
+	kind := ev.Event
+	if i := strings.IndexByte(kind, '-'); i >= 0 {
+		kind = kind[:i]
+	}
+	switch {
+	case ev.Remote != "":
+		return kind + " " + ev.Remote
+	case ev.Client != "":
+		return kind + " " + ev.Client
+	}
+	return kind
+}
+
+func (ev *HookEvent) env() []string {
+	return []string{
+		"ORMESH_EVENT=" + ev.Event,
+		"ORMESH_EVENT_TIME=" + ev.Time.Format(time.RFC3339),
+		"ORMESH_REMOTE=" + ev.Remote,
+		"ORMESH_CLIENT=" + ev.Client,
+		"ORMESH_REASON=" + ev.Reason,
+	}
+}
+
+// hookRunner runs the configured hooks when events occur.
+type hookRunner struct {
+	mu      sync.Mutex
+	hooks   []config.Hook
+	pending map[string]*HookEvent
+
+	// run runs a hook. It is replaced in tests.
+	run func(hook *config.Hook, ev *HookEvent)
+}
+
+func newHookRunner() *hookRunner {
+	return &hookRunner{
+		pending: map[string]*HookEvent{},
+		run:     runHook,
+	}
+}
+
+func (h *hookRunner) update(hooks []config.Hook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append([]config.Hook(nil), hooks...)
+}
+
+// fire schedules the hooks subscribed to ev to run once their debounce
+// interval has passed. If a later event about the same subject occurs in the
+// meantime, the hook is run once, with the later event.
+func (h *hookRunner) fire(ev *HookEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.hooks {
+		hook := h.hooks[i]
+		if !hookHasEvent(&hook, ev.Event) {
+			continue
+		}
+		key := hook.Name + "/" + ev.subject()
+		if _, ok := h.pending[key]; ok {
+			h.pending[key] = ev
+			continue
+		}
+		h.pending[key] = ev
+		time.AfterFunc(hook.Debounce.Or(config.DefaultHookDebounce), func() {
+			h.mu.Lock()
+			ev := h.pending[key]
+			delete(h.pending, key)
+			h.mu.Unlock()
+			h.run(&hook, ev)
+		})
+	}
+}
+
+func hookHasEvent(hook *config.Hook, event string) bool {
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func runHook(hook *config.Hook, ev *HookEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout.Or(config.DefaultHookTimeout))
+	defer cancel()
+	hookLog := logger.With("hook", hook.Name).With("event", ev.Event)
+	if len(hook.Command) > 0 {
+		cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+		cmd.Env = append(os.Environ(), ev.env()...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			hookLog.Warnf("hook command failed: %v: %q", err, bytes.TrimSpace(out))
+		} else {
+			hookLog.Infof("ran hook command")
+		}
+	}
+	if hook.URL != "" {
+		err := postHook(ctx, hook.URL, ev)
+		if err != nil {
+			hookLog.Warnf("webhook failed: %v", err)
+		} else {
+			hookLog.Infof("posted webhook")
+		}
+	}
+}
+
+func postHook(ctx context.Context, url string, ev *HookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestHookDebounce(t *testing.T) {
+	var mu sync.Mutex
+	var ran []string
+	h := newHookRunner()
+	h.run = func(hook *config.Hook, ev *HookEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, hook.Name+" "+ev.Event+" "+ev.Remote)
+	}
+	debounce := config.Duration{Duration: 50 * time.Millisecond}
+	h.update([]config.Hook{{
+		Name:     "page",
+		Events:   []string{config.HookRemoteDown},
+		Debounce: debounce,
+	}, {
+		Name:     "restart",
+		Events:   []string{config.HookRemoteUp, config.HookRemoteDown},
+		Debounce: debounce,
+	}})
+
+	h.fire(&HookEvent{Event: config.HookRemoteDown, Remote: "web"})
+	h.fire(&HookEvent{Event: config.HookRemoteDown, Remote: "db"})
+	h.fire(&HookEvent{Event: config.HookRemoteUp, Remote: "web"})
+	h.fire(&HookEvent{Event: config.HookAgentReady})
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(ran)
+	assert.Equal(t, []string{
+		"page remote-down db",
+		"page remote-down web",
+		"restart remote-down db",
+		"restart remote-up web",
+	}, ran)
+}
+
+func TestHookEventSubject(t *testing.T) {
+	assert.Equal(t, "remote web", (&HookEvent{Event: config.HookRemoteDown, Remote: "web"}).subject())
+	assert.Equal(t, "client alice", (&HookEvent{Event: config.HookClientRevoked, Client: "alice"}).subject())
+	assert.Equal(t, "descriptor", (&HookEvent{Event: config.HookDescriptorFailed}).subject())
+}
@@ -0,0 +1,130 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+
+	"github.com/cmars/ormesh/socks"
+)
+
+// httpProxy is an HTTP forward proxy supporting CONNECT and plain HTTP
+// requests, restricted to destinations permitted by its policy.
+type httpProxy struct {
+	policy  socks.Policy
+	dialer  proxy.Dialer
+	forward *httputil.ReverseProxy
+}
+
+func newHTTPProxy(policy socks.Policy, dialer proxy.Dialer) *httpProxy {
+	p := &httpProxy{
+		policy: policy,
+		dialer: dialer,
+	}
+	p.forward = &httputil.ReverseProxy{
+		// Requests to a forward proxy already carry an absolute URL.
+		Director: func(req *http.Request) {},
+		Transport: &http.Transport{
+			Dial: p.dial,
+		},
+	}
+	return p
+}
+
+// resolve applies the policy to a host:port destination, using defaultPort if
+// hostport does not specify one.
+func (p *httpProxy) resolve(hostport string, defaultPort int) (string, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, portStr = hostport, strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", errors.Errorf("invalid port %q", portStr)
+	}
+	return p.policy.Resolve(host, port)
+}
+
+func (p *httpProxy) dial(network, addr string) (net.Conn, error) {
+	resolved, err := p.resolve(addr, 80)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return p.dialer.Dial(network, resolved)
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Debugf("mesh http: %s %s %s", r.RemoteAddr, r.Method, r.RequestURI)
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "only absolute http:// URLs may be proxied", http.StatusBadRequest)
+		return
+	}
+	if _, err := p.resolve(r.URL.Host, 80); err != nil {
+		logger.Warnf("mesh http: %s rejected %s: %v", r.RemoteAddr, r.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	p.forward.ServeHTTP(w, r)
+}
+
+func (p *httpProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	addr, err := p.resolve(r.Host, 443)
+	if err != nil {
+		logger.Warnf("mesh http: %s rejected %s: %v", r.RemoteAddr, r.Host, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	dest, err := p.dialer.Dial("tcp", addr)
+	if err != nil {
+		logger.Warnf("mesh http: %s failed to connect to %s: %v", r.RemoteAddr, addr, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer dest.Close()
+	source, rw, err := hj.Hijack()
+	if err != nil {
+		logger.Warnf("mesh http: %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer source.Close()
+	_, err = source.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		logger.Warnf("mesh http: %s: %v", r.RemoteAddr, err)
+		return
+	}
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		if _, err := dest.Write(buffered); err != nil {
+			logger.Warnf("mesh http: %s: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+	socks.Pipe(source, dest)
+}
@@ -0,0 +1,135 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// onionDialer dials local listeners in place of onion addresses.
+type onionDialer map[string]string
+
+func (d onionDialer) Dial(network, addr string) (net.Conn, error) {
+	if local, ok := d[addr]; ok {
+		addr = local
+	}
+	return net.Dial(network, addr)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	var backendHeader http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHeader = r.Header
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer backend.Close()
+	sshBackend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshBackend.Close()
+	go func() {
+		for {
+			c, err := sshBackend.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("SSH-2.0-test\r\n"))
+			c.Close()
+		}
+	}()
+
+	policy := newMeshPolicy([]config.Remote{
+		{Name: "server", Address: "abcdefghijklmnop.onion", AllowPorts: []int{22, 80}},
+	})
+	dialer := onionDialer{
+		"abcdefghijklmnop.onion:80": backend.Listener.Addr().String(),
+		"abcdefghijklmnop.onion:22": sshBackend.Addr().String(),
+	}
+	srv := httptest.NewServer(newHTTPProxy(policy, dialer))
+	defer srv.Close()
+	proxyURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// A plain request is forwarded, without hop-by-hop headers.
+	req, err := http.NewRequest("GET", "http://server/index.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-End", "1")
+	resp, err := client.Do(req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello /index.html", string(body))
+		assert.Equal(t, "", backendHeader.Get("Proxy-Authorization"))
+		assert.Equal(t, "", backendHeader.Get("X-Hop"))
+		assert.Equal(t, "1", backendHeader.Get("X-End"))
+	}
+
+	// Destinations the policy does not allow are forbidden.
+	for _, u := range []string{"http://elsewhere/", "http://server:8080/"} {
+		resp, err = client.Get(u)
+		if assert.NoError(t, err, u) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, u)
+		}
+	}
+
+	// CONNECT tunnels to an allowed remote port.
+	for _, test := range []struct {
+		target string
+		status int
+	}{
+		{"server:22", http.StatusOK},
+		{"server:443", http.StatusForbidden},
+		{"elsewhere:22", http.StatusForbidden},
+	} {
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Write([]byte("CONNECT " + test.target + " HTTP/1.1\r\nHost: " + test.target + "\r\n\r\n"))
+		assert.NoError(t, err)
+		r := bufio.NewReader(c)
+		resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+		if assert.NoError(t, err, test.target) {
+			assert.Equal(t, test.status, resp.StatusCode, test.target)
+			if test.status == http.StatusOK {
+				banner, err := ioutil.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, "SSH-2.0-test\r\n", string(banner))
+			}
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLimitedRead bounds each read through a rate limit, so that bursts stay
+// close to the configured rate.
+const maxLimitedRead = 16 * 1024
+
+// tokenBucket limits a byte rate, allowing bursts of up to one second's
+// worth of bytes.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket limiting to rate bytes per second, or nil
+// if rate is not positive.
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens from the bucket, waiting until they are available.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// maxRead returns the most that should be read at once through the bucket.
+func (b *tokenBucket) maxRead() int {
+	if int(b.rate) < maxLimitedRead {
+		return int(b.rate)
+	}
+	return maxLimitedRead
+}
+
+// connReader reads from a forwarded connection, recording activity and
+// limiting its rate if bucket is not nil.
+type connReader struct {
+	r          io.Reader
+	bucket     *tokenBucket
+	lastActive *int64
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	if r.bucket != nil && len(p) > r.bucket.maxRead() {
+		p = p[:r.bucket.maxRead()]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if r.bucket != nil {
+			r.bucket.take(n)
+		}
+		// Waiting for the rate limit does not count as idle.
+		atomic.StoreInt64(r.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// watchConn calls expire with a reason if a connection is idle for longer
+// than idleTimeout, or open for longer than maxLifetime, until done is
+// closed. Zero durations are not enforced.
+func watchConn(done <-chan struct{}, lastActive *int64, idleTimeout, maxLifetime time.Duration, expire func(reason string)) {
+	if idleTimeout <= 0 && maxLifetime <= 0 {
+		return
+	}
+	var lifetime <-chan time.Time
+	if maxLifetime > 0 {
+		t := time.NewTimer(maxLifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+	var idle <-chan time.Time
+	if idleTimeout > 0 {
+		interval := idleTimeout / 4
+		if interval < 100*time.Millisecond {
+			interval = 100 * time.Millisecond
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		idle = t.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-lifetime:
+			expire("lifetime")
+			return
+		case <-idle:
+			last := time.Unix(0, atomic.LoadInt64(lastActive))
+			if time.Since(last) > idleTimeout {
+				expire("idle")
+				return
+			}
+		}
+	}
+}
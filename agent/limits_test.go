@@ -0,0 +1,64 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	assert.Nil(t, newTokenBucket(0))
+
+	b := newTokenBucket(10000)
+	start := time.Now()
+	// The initial burst is not delayed.
+	b.take(10000)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	// The next half second's worth is.
+	b.take(5000)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 450*time.Millisecond, "%v", elapsed)
+	assert.True(t, elapsed < time.Second, "%v", elapsed)
+}
+
+func TestWatchConn(t *testing.T) {
+	lastActive := time.Now().UnixNano()
+	reasons := make(chan string, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go watchConn(done, &lastActive, 200*time.Millisecond, 0, func(reason string) {
+		reasons <- reason
+	})
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, "idle", reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection did not expire")
+	}
+
+	lastActive = time.Now().UnixNano()
+	go watchConn(done, &lastActive, time.Hour, 100*time.Millisecond, func(reason string) {
+		reasons <- reason
+	})
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, "lifetime", reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection did not expire")
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// agentMetrics counts agent-wide events. Fields are updated atomically.
+type agentMetrics struct {
+	torRestarts          uint64
+	configReloads        uint64
+	configReloadFailures uint64
+}
+
+// descriptorStatus tracks uploads of this node's onion service descriptors,
+// reported by HS_DESC events.
+type descriptorStatus struct {
+	mu sync.Mutex
+	// uploading maps each HSDir this node is uploading a descriptor to, and
+	// the descriptor's address, to the descriptor's ID. Fetches of remotes'
+	// descriptors are not in it.
+	uploading map[hsDirUpload]string
+	// pending tracks each descriptor being uploaded, by ID.
+	pending           map[string]*descriptorUpload
+	uploads           uint64
+	failures          uint64
+	lastUpload        time.Time
+	lastFailure       time.Time
+	lastFailureReason string
+}
+
+type hsDirUpload struct {
+	addr  string
+	hsDir string
+}
+
+// descriptorUpload is a descriptor being uploaded to several HSDirs. It is
+// published once any of them accepts it, and fails if none does.
+type descriptorUpload struct {
+	started   time.Time
+	hsDirs    int
+	published bool
+	reason    string
+}
+
+// dialLatencyBuckets are the upper bounds, in seconds, of the dial latency
+// histogram buckets. Onion service connections commonly take several
+// seconds.
+var dialLatencyBuckets = [...]float64{0.25, 0.5, 1, 2, 5, 10, 30, 60, 120}
+
+// histogram is a Prometheus histogram of dial latencies.
+type histogram struct {
+	mu     sync.Mutex
+	counts [len(dialLatencyBuckets)]uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range dialLatencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// startMetrics starts serving metrics in the Prometheus text format, if
+// configured.
+func (a *Agent) startMetrics() error {
+	if a.metricsAddr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", a.metricsAddr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	a.addListener(l)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a.serveMetrics)
+	srv := &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		err := srv.Serve(l)
+		logger.Infof("metrics listener exiting on error: %v", err)
+	}()
+	logger.Infof("started metrics listener %v", l.Addr())
+	return nil
+}
+
+func (a *Agent) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	a.writeMetrics(bw)
+	if err := bw.Flush(); err != nil {
+		logger.Warnf("metrics: %v", err)
+	}
+}
+
+func (a *Agent) writeMetrics(w io.Writer) {
+	m := &metricsWriter{w: w}
+	st := a.Status()
+
+	importLabels := func(imp *ImportStatus) []string {
+		return []string{"remote", imp.Remote, "remote_port", strconv.Itoa(imp.RemotePort)}
+	}
+	counters := []struct {
+		name, help string
+		value      func(*ImportStatus) uint64
+	}{
+		{"ormesh_import_connections_accepted_total", "Local connections accepted by an import.",
+			func(imp *ImportStatus) uint64 { return imp.Accepted }},
+		{"ormesh_import_connections_connected_total", "Connections forwarded to the remote.",
+			func(imp *ImportStatus) uint64 { return imp.Connected }},
+		{"ormesh_import_connections_failed_total", "Connections dropped because the remote could not be reached.",
+			func(imp *ImportStatus) uint64 { return imp.Failed }},
+		{"ormesh_import_connections_rejected_total", "Connections rejected by the import's connection limit.",
+			func(imp *ImportStatus) uint64 { return imp.Rejected }},
+		{"ormesh_import_sent_bytes_total", "Bytes forwarded to the remote.",
+			func(imp *ImportStatus) uint64 { return imp.BytesSent }},
+		{"ormesh_import_received_bytes_total", "Bytes forwarded from the remote.",
+			func(imp *ImportStatus) uint64 { return imp.BytesReceived }},
+	}
+	for _, c := range counters {
+		m.family(c.name, "counter", c.help)
+		for i := range st.Imports {
+			m.sample(c.name, importLabels(&st.Imports[i]), float64(c.value(&st.Imports[i])))
+		}
+	}
+	m.family("ormesh_import_connections_active", "gauge", "Connections currently forwarded by an import.")
+	for i := range st.Imports {
+		m.sample("ormesh_import_connections_active", importLabels(&st.Imports[i]), float64(st.Imports[i].Active))
+	}
+	m.family("ormesh_import_timeouts_total", "counter", "Connections closed for being idle or open too long.")
+	for i := range st.Imports {
+		imp := &st.Imports[i]
+		m.sample("ormesh_import_timeouts_total", append(importLabels(imp), "reason", "idle"), float64(imp.IdleTimeouts))
+		m.sample("ormesh_import_timeouts_total", append(importLabels(imp), "reason", "lifetime"), float64(imp.LifetimeTimeouts))
+	}
+	m.family("ormesh_import_dial_errors_total", "counter", "Failed attempts to connect to a remote, by reason.")
+	for i := range st.Imports {
+		imp := &st.Imports[i]
+		var reasons []string
+		for reason := range imp.DialErrors {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			m.sample("ormesh_import_dial_errors_total", append(importLabels(imp), "reason", reason),
+				float64(imp.DialErrors[reason]))
+		}
+	}
+
+	m.family("ormesh_remote_dial_duration_seconds", "histogram", "Time taken to connect to a remote.")
+	for _, remote := range a.remotes {
+		h := &remote.dialLatency
+		h.mu.Lock()
+		labels := []string{"remote", remote.name}
+		for i, bound := range dialLatencyBuckets {
+			m.sample("ormesh_remote_dial_duration_seconds_bucket",
+				append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(h.counts[i]))
+		}
+		m.sample("ormesh_remote_dial_duration_seconds_bucket", append(labels, "le", "+Inf"), float64(h.count))
+		m.sample("ormesh_remote_dial_duration_seconds_sum", labels, h.sum)
+		m.sample("ormesh_remote_dial_duration_seconds_count", labels, float64(h.count))
+		h.mu.Unlock()
+	}
+
+	m.family("ormesh_tor_bootstrap_progress", "gauge", "Tor's progress connecting to the tor network, in percent.")
+	m.sample("ormesh_tor_bootstrap_progress", nil, float64(st.Bootstrap.Progress))
+	m.family("ormesh_tor_restarts_total", "counter", "Times tor was restarted after exiting unexpectedly.")
+	m.sample("ormesh_tor_restarts_total", nil, float64(atomic.LoadUint64(&a.metrics.torRestarts)))
+
+	m.family("ormesh_descriptor_uploads_total", "counter", "Onion service descriptor uploads, by result.")
+	m.sample("ormesh_descriptor_uploads_total", []string{"result", "uploaded"}, float64(st.Descriptor.Uploads))
+	m.sample("ormesh_descriptor_uploads_total", []string{"result", "failed"}, float64(st.Descriptor.Failures))
+	m.family("ormesh_descriptor_last_upload_timestamp_seconds", "gauge",
+		"When an onion service descriptor was last uploaded, in seconds since the epoch.")
+	var lastUpload float64
+	if !st.Descriptor.LastUpload.IsZero() {
+		lastUpload = float64(st.Descriptor.LastUpload.Unix())
+	}
+	m.sample("ormesh_descriptor_last_upload_timestamp_seconds", nil, lastUpload)
+
+	m.family("ormesh_config_reloads_total", "counter", "Configuration reloads, by result.")
+	m.sample("ormesh_config_reloads_total", []string{"result", "success"},
+		float64(atomic.LoadUint64(&a.metrics.configReloads)))
+	m.sample("ormesh_config_reloads_total", []string{"result", "failure"},
+		float64(atomic.LoadUint64(&a.metrics.configReloadFailures)))
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample, with labels given as alternating names and values.
+func (m *metricsWriter) sample(name string, labels []string, value float64) {
+	fmt.Fprint(m.w, name)
+	if len(labels) > 0 {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabelValue(labels[i+1])))
+		}
+		fmt.Fprintf(m.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(m.w, " %s\n", strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
@@ -0,0 +1,72 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/socks"
+)
+
+// meshPolicy restricts proxied connections to the configured remotes,
+// translating remote names into their onion addresses.
+type meshPolicy struct {
+	mu      sync.RWMutex
+	remotes []config.Remote
+}
+
+func newMeshPolicy(remotes []config.Remote) *meshPolicy {
+	p := &meshPolicy{}
+	p.update(remotes)
+	return p
+}
+
+func (p *meshPolicy) update(remotes []config.Remote) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remotes = append([]config.Remote(nil), remotes...)
+}
+
+// Resolve implements socks.Policy. host may be a remote name or a configured
+// onion address, optionally prefixed by subdomains which are passed through
+// to tor.
+func (p *meshPolicy) Resolve(host string, port int) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, remote := range p.remotes {
+		onion := strings.ToLower(remote.Address)
+		var sub string
+		switch {
+		case host == onion || host == strings.ToLower(remote.Name):
+		case strings.HasSuffix(host, "."+onion):
+			sub = strings.TrimSuffix(host, onion)
+		case strings.HasSuffix(host, "."+strings.ToLower(remote.Name)):
+			sub = strings.TrimSuffix(host, strings.ToLower(remote.Name))
+		default:
+			continue
+		}
+		if !remote.AllowsPort(port) {
+			return "", errors.Wrapf(socks.ErrNotAllowed, "port %d on remote %q", port, remote.Name)
+		}
+		return fmt.Sprintf("%s%s:%d", sub, onion, port), nil
+	}
+	return "", errors.Wrapf(socks.ErrNotAllowed, "no such remote %q", host)
+}
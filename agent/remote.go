@@ -0,0 +1,96 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// meshRemote dials ports on a remote node, either with a new tor stream for
+// each connection, or over a multiplexed tunnel to the remote's ormesh
+// endpoint. The tunnel is only connected when first used.
+type meshRemote struct {
+	name      string
+	address   string
+	dialer    proxy.Dialer
+	useTunnel bool
+	tunnel    *tunnel
+	health    remoteHealth
+	hooks     *hookRunner
+
+	dialLatency histogram
+}
+
+func newMeshRemote(remote *config.Remote, dialer proxy.Dialer, hooks *hookRunner) *meshRemote {
+	return &meshRemote{
+		name:      remote.Name,
+		address:   remote.Address,
+		dialer:    dialer,
+		useTunnel: remote.Tunnel,
+		tunnel:    newTunnel(remote, dialer),
+		hooks:     hooks,
+	}
+}
+
+// recordDial records the result of dialing the remote, running hooks if it
+// has become reachable or unreachable.
+func (r *meshRemote) recordDial(err error, latency time.Duration) {
+	if !r.health.record(err, latency) || r.hooks == nil {
+		return
+	}
+	if err == nil {
+		r.hooks.fire(&HookEvent{Event: config.HookRemoteUp, Remote: r.name})
+	} else {
+		r.hooks.fire(&HookEvent{Event: config.HookRemoteDown, Remote: r.name, Reason: dialErrorReason(err)})
+	}
+}
+
+// dial connects to port on the remote, giving up after timeout if it is not
+// zero.
+func (r *meshRemote) dial(port int, timeout time.Duration) (net.Conn, error) {
+	if r.useTunnel {
+		return r.tunnel.open(endpointProtoTCP, port, timeout)
+	}
+	return dialTimeout(r.dialer, fmt.Sprintf("%s:%d", r.address, port), timeout)
+}
+
+// openUDP opens a stream carrying framed datagrams to a UDP export on the
+// remote. UDP is always tunneled, since tor only carries TCP.
+func (r *meshRemote) openUDP(port int) (net.Conn, error) {
+	return r.tunnel.open(endpointProtoUDP, port, config.DefaultDialTimeout)
+}
+
+func (r *meshRemote) close() {
+	r.tunnel.close()
+}
+
+// timeoutDialer is a proxy.Dialer which can bound the time taken to connect,
+// such as socks.Dialer.
+type timeoutDialer interface {
+	DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error)
+}
+
+func dialTimeout(dialer proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	if td, ok := dialer.(timeoutDialer); ok && timeout > 0 {
+		return td.DialTimeout("tcp", addr, timeout)
+	}
+	return dialer.Dial("tcp", addr)
+}
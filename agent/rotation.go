@@ -0,0 +1,113 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/audit"
+	"github.com/cmars/ormesh/config"
+)
+
+// updateRotation returns the directory of the previous onion service key if
+// it is still published at now, or if it has been retired, the directory to
+// delete once it is no longer published. The running agent schedules the
+// services to be updated when a published key is retired.
+func (a *Agent) updateRotation(rotation *config.Rotation, now time.Time) (published, retired string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rotationTimer != nil {
+		a.rotationTimer.Stop()
+		a.rotationTimer = nil
+	}
+	a.rotationDir = ""
+	if rotation == nil || rotation.Dir == "" {
+		return "", ""
+	}
+	if rotation.IsRetired(now) {
+		if _, err := os.Stat(rotation.Dir); err != nil {
+			return "", ""
+		}
+		return "", rotation.Dir
+	}
+	a.rotationDir = rotation.Dir
+	if a.listening && !a.stopping {
+		a.rotationTimer = time.AfterFunc(rotation.Ends.Sub(now), a.refreshServices)
+	}
+	return rotation.Dir, ""
+}
+
+// retireKey deletes the directory of a previous onion service key which is
+// no longer published. Only the running agent deletes it; a command which
+// configures tor leaves it to the agent.
+func (a *Agent) retireKey(dir string) {
+	a.mu.Lock()
+	listening := a.listening
+	a.mu.Unlock()
+	if !listening {
+		return
+	}
+	err := ShredDir(dir)
+	if err != nil {
+		logger.Errorf("failed to delete retired onion service key: %v", err)
+		return
+	}
+	logger.Infof("retired previous onion service key %q", dir)
+	err = audit.Append(a.auditPath, &audit.Entry{
+		Source:  audit.SourceAgent,
+		Action:  "service retire",
+		Details: map[string]string{"dir": dir},
+	})
+	if err != nil {
+		logger.Warnf("%v", err)
+	}
+}
+
+// ShredDir overwrites the files in dir with random data before removing
+// it, so that keys in it cannot be recovered from unused blocks on simpler
+// filesystems.
+func ShredDir(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return shredFile(path, info.Size())
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to overwrite %q", dir)
+	}
+	return errors.Wrapf(os.RemoveAll(dir), "failed to remove %q", dir)
+}
+
+func shredFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, rand.Reader, size); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Sync())
+}
@@ -0,0 +1,85 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestUpdateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ormesh-rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevDir := filepath.Join(dir, "services-20261019T000000")
+	err = os.MkdirAll(prevDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(prevDir, "private_key"), []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	rotation := &config.Rotation{Dir: prevDir, Started: now.Add(-time.Hour), Ends: now.Add(time.Hour)}
+
+	// An agent which is not running, as a command uses to configure tor,
+	// neither schedules updates nor deletes the previous key.
+	a := &Agent{}
+	published, retired := a.updateRotation(rotation, now)
+	assert.Equal(t, prevDir, published)
+	assert.Nil(t, a.rotationTimer)
+	_, retired = a.updateRotation(rotation, rotation.Ends)
+	a.retireKey(retired)
+	_, err = os.Stat(prevDir)
+	assert.NoError(t, err)
+
+	a = &Agent{listening: true, auditPath: filepath.Join(dir, "audit.log")}
+	defer a.Stop()
+
+	published, retired = a.updateRotation(nil, now)
+	assert.Equal(t, "", published)
+	assert.Equal(t, "", retired)
+
+	published, retired = a.updateRotation(rotation, now)
+	assert.Equal(t, prevDir, published)
+	assert.Equal(t, "", retired)
+	assert.NotNil(t, a.rotationTimer)
+	assert.Equal(t, prevDir, a.rotationDir)
+
+	published, retired = a.updateRotation(rotation, rotation.Ends)
+	assert.Equal(t, "", published)
+	assert.Equal(t, prevDir, retired)
+	assert.Nil(t, a.rotationTimer)
+	assert.Equal(t, "", a.rotationDir)
+
+	a.retireKey(retired)
+	_, err = os.Stat(prevDir)
+	assert.True(t, os.IsNotExist(err))
+
+	published, retired = a.updateRotation(rotation, rotation.Ends)
+	assert.Equal(t, "", published)
+	assert.Equal(t, "", retired)
+}
@@ -0,0 +1,164 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// httpRouter is a reverse proxy which routes requests arriving on the
+// node's onion service to local backends by Host header and path prefix.
+type httpRouter struct {
+	// running is guarded by the Agent's mutex.
+	running bool
+
+	mu      sync.RWMutex
+	routes  []config.Route
+	proxies map[string]*httputil.ReverseProxy
+}
+
+func newHTTPRouter(routes []config.Route) *httpRouter {
+	r := &httpRouter{}
+	r.update(routes)
+	return r
+}
+
+func (r *httpRouter) update(routes []config.Route) {
+	proxies := map[string]*httputil.ReverseProxy{}
+	for _, route := range routes {
+		if _, ok := proxies[route.Backend]; !ok {
+			proxies[route.Backend] = httputil.NewSingleHostReverseProxy(&url.URL{
+				Scheme: "http",
+				Host:   route.Backend,
+			})
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append([]config.Route(nil), routes...)
+	r.proxies = proxies
+}
+
+func (r *httpRouter) hasRoutes() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.routes) > 0
+}
+
+// match returns the most specific route matching req. Routes matching by
+// host are preferred over those that do not, then longer path prefixes over
+// shorter ones.
+func (r *httpRouter) match(req *http.Request) (*config.Route, *httputil.ReverseProxy) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var best *config.Route
+	bestScore := -1
+	for i := range r.routes {
+		route := &r.routes[i]
+		score := len(route.PathPrefix)
+		if route.Host != "" {
+			routeHost := strings.ToLower(route.Host)
+			if host != routeHost && !strings.HasPrefix(host, routeHost+".") {
+				continue
+			}
+			score += 1 << 16
+		}
+		if !strings.HasPrefix(req.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if score > bestScore {
+			best, bestScore = route, score
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best, r.proxies[best.Backend]
+}
+
+func (r *httpRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	lw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		logger.Infof("http router: %s %s %s %s %d %d %v",
+			req.RemoteAddr, req.Method, req.Host, req.RequestURI,
+			lw.status, lw.size, time.Since(start))
+	}()
+
+	route, proxy := r.match(req)
+	if route == nil {
+		http.NotFound(lw, req)
+		return
+	}
+	if route.StripPrefix && route.PathPrefix != "" {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, route.PathPrefix)
+		if !strings.HasPrefix(req.URL.Path, "/") {
+			req.URL.Path = "/" + req.URL.Path
+		}
+		req.URL.RawPath = ""
+	}
+	proxy.ServeHTTP(lw, req)
+}
+
+// accessLogWriter records the status and size of a response for access
+// logging.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += n
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
@@ -0,0 +1,97 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestRouterMatch(t *testing.T) {
+	r := newHTTPRouter([]config.Route{
+		{PathPrefix: "/", Backend: "default"},
+		{PathPrefix: "/api", Backend: "api"},
+		{PathPrefix: "/api/v2", Backend: "api-v2"},
+		{Host: "wiki", PathPrefix: "/", Backend: "wiki"},
+		{Host: "wiki", PathPrefix: "/static", Backend: "wiki-static"},
+		{Host: "Docs", PathPrefix: "/", Backend: "docs"},
+	})
+	for _, test := range []struct {
+		host, path, backend string
+	}{
+		{"abcdefghijklmnop.onion", "/", "default"},
+		{"abcdefghijklmnop.onion", "/index.html", "default"},
+		{"abcdefghijklmnop.onion", "/api", "api"},
+		{"abcdefghijklmnop.onion", "/api/v1/users", "api"},
+		{"abcdefghijklmnop.onion", "/api/v2/users", "api-v2"},
+		// Routes matching by host are preferred over longer path prefixes.
+		{"wiki", "/api/v2", "wiki"},
+		{"wiki:80", "/static/logo.png", "wiki-static"},
+		{"wiki.abcdefghijklmnop.onion", "/", "wiki"},
+		{"WIKI.abcdefghijklmnop.onion.", "/static/", "wiki-static"},
+		{"docs", "/", "docs"},
+		{"wikipedia.org", "/", "default"},
+	} {
+		req := httptest.NewRequest("GET", "http://"+test.host+test.path, nil)
+		route, proxy := r.match(req)
+		if assert.NotNil(t, route, test.host+test.path) {
+			assert.Equal(t, test.backend, route.Backend, test.host+test.path)
+			assert.NotNil(t, proxy)
+		}
+	}
+
+	r.update([]config.Route{{Host: "wiki", PathPrefix: "/", Backend: "wiki"}})
+	route, _ := r.match(httptest.NewRequest("GET", "http://other/", nil))
+	assert.Nil(t, route)
+}
+
+func TestRouterServeHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+	r := newHTTPRouter([]config.Route{
+		{PathPrefix: "/app", Backend: addr, StripPrefix: true},
+		{PathPrefix: "/keep", Backend: addr},
+	})
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/app/users", http.StatusAccepted, "/users"},
+		{"/app", http.StatusAccepted, "/"},
+		{"/keep/users", http.StatusAccepted, "/keep/users"},
+		{"/other", http.StatusNotFound, "404 page not found\n"},
+	} {
+		w := httptest.NewRecorder()
+		lw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		r.ServeHTTP(lw, httptest.NewRequest("GET", "http://abcdefghijklmnop.onion"+test.path, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		assert.Equal(t, test.status, w.Code, test.path)
+		assert.Equal(t, test.body, string(body), test.path)
+		// The access log records what the client was sent.
+		assert.Equal(t, test.status, lw.status, test.path)
+		assert.Equal(t, len(test.body), lw.size, test.path)
+	}
+}
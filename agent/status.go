@@ -0,0 +1,198 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of the agent's activity, served by its API.
+type Status struct {
+	Bootstrap   BootstrapStatus  `json:"bootstrap"`
+	TorRestarts uint64           `json:"tor_restarts"`
+	Descriptor  DescriptorStatus `json:"descriptor"`
+	Imports     []ImportStatus   `json:"imports"`
+}
+
+// DescriptorStatus reports uploads of this node's onion service descriptors
+// to the tor network.
+type DescriptorStatus struct {
+	Uploads           uint64    `json:"uploads"`
+	Failures          uint64    `json:"failures"`
+	LastUpload        time.Time `json:"last_upload,omitempty"`
+	LastFailure       time.Time `json:"last_failure,omitempty"`
+	LastFailureReason string    `json:"last_failure_reason,omitempty"`
+}
+
+// BootstrapStatus is tor's progress connecting to the tor network. Import
+// connections are held until it is done.
+type BootstrapStatus struct {
+	Progress int    `json:"progress"`
+	Summary  string `json:"summary"`
+}
+
+// ImportStatus counts connections forwarded by an import.
+type ImportStatus struct {
+	// Remote is the name of the remote or group being imported from.
+	Remote     string `json:"remote"`
+	RemotePort int    `json:"remote_port"`
+	LocalAddr  string `json:"local_addr"`
+	// Accepted counts local connections accepted.
+	Accepted uint64 `json:"accepted"`
+	// Connected counts connections forwarded to the remote.
+	Connected uint64 `json:"connected"`
+	// Failed counts connections dropped because the remote could not be
+	// reached.
+	Failed uint64 `json:"failed"`
+	// Rejected counts local connections rejected because too many were
+	// open.
+	Rejected uint64 `json:"rejected"`
+	// Active is the number of connections currently being forwarded.
+	Active int64 `json:"active"`
+	// BytesSent and BytesReceived count bytes forwarded to and from the
+	// remote.
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+	// IdleTimeouts and LifetimeTimeouts count connections closed for being
+	// idle or open too long.
+	IdleTimeouts     uint64 `json:"idle_timeouts"`
+	LifetimeTimeouts uint64 `json:"lifetime_timeouts"`
+	// DialErrors counts failed attempts to connect to the remote by reason.
+	DialErrors map[string]uint64 `json:"dial_errors,omitempty"`
+}
+
+type forwarderStats struct {
+	mu               sync.Mutex
+	accepted         uint64
+	connected        uint64
+	failed           uint64
+	rejected         uint64
+	active           int64
+	bytesSent        uint64
+	bytesReceived    uint64
+	idleTimeouts     uint64
+	lifetimeTimeouts uint64
+	dialErrors       map[string]uint64
+}
+
+func (s *forwarderStats) accept() {
+	s.mu.Lock()
+	s.accepted++
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) connect() {
+	s.mu.Lock()
+	s.connected++
+	s.active++
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) disconnect() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) fail() {
+	s.mu.Lock()
+	s.failed++
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) reject() {
+	s.mu.Lock()
+	s.rejected++
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) sent(n int64) {
+	s.mu.Lock()
+	s.bytesSent += uint64(n)
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) received(n int64) {
+	s.mu.Lock()
+	s.bytesReceived += uint64(n)
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) expire(reason string) {
+	s.mu.Lock()
+	if reason == "idle" {
+		s.idleTimeouts++
+	} else {
+		s.lifetimeTimeouts++
+	}
+	s.mu.Unlock()
+}
+
+func (s *forwarderStats) dialError(reason string) {
+	s.mu.Lock()
+	s.dialErrors[reason]++
+	s.mu.Unlock()
+}
+
+func (f *forwarder) status() ImportStatus {
+	f.stats.mu.Lock()
+	defer f.stats.mu.Unlock()
+	st := ImportStatus{
+		Remote:     f.name,
+		RemotePort: f.remotePort,
+		LocalAddr:  net.JoinHostPort(f.localAddr, strconv.Itoa(f.localPort)),
+		Accepted:   f.stats.accepted,
+		Connected:  f.stats.connected,
+		Failed:     f.stats.failed,
+		Rejected:   f.stats.rejected,
+		Active:     f.stats.active,
+
+		BytesSent:        f.stats.bytesSent,
+		BytesReceived:    f.stats.bytesReceived,
+		IdleTimeouts:     f.stats.idleTimeouts,
+		LifetimeTimeouts: f.stats.lifetimeTimeouts,
+	}
+	if len(f.stats.dialErrors) > 0 {
+		st.DialErrors = map[string]uint64{}
+		for reason, n := range f.stats.dialErrors {
+			st.DialErrors[reason] = n
+		}
+	}
+	return st
+}
+
+// Status returns a snapshot of the agent's activity.
+func (a *Agent) Status() *Status {
+	st := &Status{}
+	st.Bootstrap.Progress, st.Bootstrap.Summary = a.bootstrap.state()
+	st.TorRestarts = atomic.LoadUint64(&a.metrics.torRestarts)
+	a.descriptors.mu.Lock()
+	st.Descriptor = DescriptorStatus{
+		Uploads:           a.descriptors.uploads,
+		Failures:          a.descriptors.failures,
+		LastUpload:        a.descriptors.lastUpload,
+		LastFailure:       a.descriptors.lastFailure,
+		LastFailureReason: a.descriptors.lastFailureReason,
+	}
+	a.descriptors.mu.Unlock()
+	for _, f := range a.forwarders {
+		st.Imports = append(st.Imports, f.status())
+	}
+	return st
+}
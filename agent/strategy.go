@@ -0,0 +1,106 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// downInterval is how long a remote is considered down after a failed dial,
+// during which it is only tried after healthier remotes.
+const downInterval = 30 * time.Second
+
+// remoteHealth tracks recent dial results for a remote.
+type remoteHealth struct {
+	mu          sync.Mutex
+	failures    int
+	lastFailure time.Time
+	latency     time.Duration
+	// dialed is set once the remote has been dialed, and reachable is
+	// whether the last dial succeeded.
+	dialed    bool
+	reachable bool
+}
+
+// record records the result of dialing the remote, returning whether it has
+// become reachable after being unreachable, or unreachable after being
+// reachable. The first dial changes nothing.
+func (h *remoteHealth) record(err error, latency time.Duration) (changed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed = h.dialed && h.reachable != (err == nil)
+	h.dialed, h.reachable = true, err == nil
+	if err != nil {
+		h.failures++
+		h.lastFailure = time.Now()
+		return changed
+	}
+	h.failures = 0
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		// Exponentially weighted moving average.
+		h.latency = (h.latency*7 + latency) / 8
+	}
+	return changed
+}
+
+func (h *remoteHealth) isDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures > 0 && time.Since(h.lastFailure) < downInterval
+}
+
+func (h *remoteHealth) avgLatency() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.latency
+}
+
+// dialOrder decides the order in which a forwarder's remotes are tried.
+type dialOrder struct {
+	strategy string
+	next     uint32
+}
+
+// order returns remotes in the order they should be dialed. Remotes which
+// are down are always tried last.
+func (o *dialOrder) order(remotes []*meshRemote) []*meshRemote {
+	ordered := make([]*meshRemote, len(remotes))
+	switch o.strategy {
+	case config.StrategyRoundRobin:
+		start := int(atomic.AddUint32(&o.next, 1)-1) % len(remotes)
+		for i := range remotes {
+			ordered[i] = remotes[(start+i)%len(remotes)]
+		}
+	case config.StrategyLatency:
+		copy(ordered, remotes)
+		// Remotes without a measured latency sort first, so they get one.
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].health.avgLatency() < ordered[j].health.avgLatency()
+		})
+	default:
+		copy(ordered, remotes)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !ordered[i].health.isDown() && ordered[j].health.isDown()
+	})
+	return ordered
+}
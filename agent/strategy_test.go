@@ -0,0 +1,84 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func testRemotes(names ...string) []*meshRemote {
+	var remotes []*meshRemote
+	for _, name := range names {
+		remotes = append(remotes, &meshRemote{name: name})
+	}
+	return remotes
+}
+
+func remoteNames(remotes []*meshRemote) []string {
+	var names []string
+	for _, remote := range remotes {
+		names = append(names, remote.name)
+	}
+	return names
+}
+
+func TestFailoverOrder(t *testing.T) {
+	remotes := testRemotes("a", "b", "c")
+	o := &dialOrder{strategy: config.StrategyFailover}
+	assert.Equal(t, []string{"a", "b", "c"}, remoteNames(o.order(remotes)))
+	remotes[0].health.record(errors.New("fail"), 0)
+	assert.Equal(t, []string{"b", "c", "a"}, remoteNames(o.order(remotes)))
+	remotes[0].health.record(nil, time.Second)
+	assert.Equal(t, []string{"a", "b", "c"}, remoteNames(o.order(remotes)))
+}
+
+func TestRoundRobinOrder(t *testing.T) {
+	remotes := testRemotes("a", "b", "c")
+	o := &dialOrder{strategy: config.StrategyRoundRobin}
+	assert.Equal(t, []string{"a", "b", "c"}, remoteNames(o.order(remotes)))
+	assert.Equal(t, []string{"b", "c", "a"}, remoteNames(o.order(remotes)))
+	remotes[2].health.record(errors.New("fail"), 0)
+	assert.Equal(t, []string{"a", "b", "c"}, remoteNames(o.order(remotes)))
+	assert.Equal(t, []string{"a", "b", "c"}, remoteNames(o.order(remotes)))
+	assert.Equal(t, []string{"b", "a", "c"}, remoteNames(o.order(remotes)))
+}
+
+func TestLatencyOrder(t *testing.T) {
+	remotes := testRemotes("a", "b", "c")
+	remotes[0].health.record(nil, 3*time.Second)
+	remotes[1].health.record(nil, time.Second)
+	remotes[2].health.record(nil, 2*time.Second)
+	o := &dialOrder{strategy: config.StrategyLatency}
+	assert.Equal(t, []string{"b", "c", "a"}, remoteNames(o.order(remotes)))
+}
+
+func TestHealthTransitions(t *testing.T) {
+	var h remoteHealth
+	assert.False(t, h.record(nil, time.Second))
+	assert.False(t, h.record(nil, time.Second))
+	assert.True(t, h.record(errors.New("fail"), 0))
+	assert.False(t, h.record(errors.New("fail"), 0))
+	assert.True(t, h.record(nil, time.Second))
+
+	var down remoteHealth
+	assert.False(t, down.record(errors.New("fail"), 0))
+	assert.True(t, down.record(nil, time.Second))
+}
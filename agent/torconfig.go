@@ -0,0 +1,240 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cmars/orc/control"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// TorOption is a tor configuration option.
+type TorOption struct {
+	Key   string
+	Value string
+}
+
+var torValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", `\r`, "\n", `\n`)
+
+// Arg formats the option as an argument to SETCONF, quoting the value as a
+// control protocol QuotedString.
+func (o TorOption) Arg() string {
+	return fmt.Sprintf(`%s="%s"`, o.Key, torValueEscaper.Replace(o.Value))
+}
+
+// String formats the option as a torrc line. Values which tor would not
+// read back verbatim, such as those containing a comment or a line break,
+// are quoted.
+func (o TorOption) String() string {
+	if strings.ContainsAny(o.Value, "\"\\#\r\n") || strings.TrimSpace(o.Value) != o.Value {
+		return fmt.Sprintf(`%s "%s"`, o.Key, torValueEscaper.Replace(o.Value))
+	}
+	return o.Key + " " + o.Value
+}
+
+// Redacted returns the option with any client authorization cookie
+// replaced, for display.
+func (o TorOption) Redacted() TorOption {
+	if o.Key != "HidServAuth" {
+		return o
+	}
+	fields := strings.SplitN(o.Value, " ", 2)
+	if len(fields) < 2 {
+		return o
+	}
+	return TorOption{o.Key, fields[0] + " " + redacted}
+}
+
+const redacted = "<redacted>"
+
+// TorConfig is a change to tor's configuration, which sets some options and
+// resets others to their defaults.
+type TorConfig struct {
+	Set   []TorOption
+	Reset []string
+}
+
+// Redacted returns the change with client authorization cookies replaced,
+// for display.
+func (c *TorConfig) Redacted() *TorConfig {
+	rc := &TorConfig{Reset: c.Reset}
+	for _, opt := range c.Set {
+		rc.Set = append(rc.Set, opt.Redacted())
+	}
+	return rc
+}
+
+// Commands returns the control commands which make the change, and save it
+// to tor's torrc.
+func (c *TorConfig) Commands() []control.Cmd {
+	var cmds []control.Cmd
+	if len(c.Set) > 0 {
+		var args []string
+		for _, opt := range c.Set {
+			args = append(args, opt.Arg())
+		}
+		cmds = append(cmds, control.Cmd{Keyword: "SETCONF", Arguments: args})
+	}
+	if len(c.Reset) > 0 {
+		cmds = append(cmds, control.Cmd{Keyword: "RESETCONF", Arguments: c.Reset})
+	}
+	return append(cmds, control.Cmd{Keyword: "SAVECONF", Arguments: []string{}})
+}
+
+// FormatCmd formats a control command as it is sent to tor.
+func FormatCmd(cmd control.Cmd) string {
+	return strings.Join(append([]string{cmd.Keyword}, cmd.Arguments...), " ")
+}
+
+// localAddrs are the addresses of the agent's own services which are
+// published on the node's onion service.
+type localAddrs struct {
+	router, endpoint, gateway string
+}
+
+// baseTorOptions returns the options with which the agent starts tor.
+func baseTorOptions(agentCfg *config.Agent) []TorOption {
+	return []TorOption{
+		{"Log", torLogLevel() + " stderr"},
+		// ExtendedErrors reports onion service failures with distinct
+		// SOCKS5 reply codes.
+		{"SocksPort", agentCfg.SocksAddr + " ExtendedErrors"},
+		{"ControlPort", agentCfg.ControlAddr},
+		{"CookieAuthentication", "1"},
+		{"DataDirectory", agentCfg.TorDataDir},
+	}
+}
+
+// serviceTorConfig returns the configuration publishing svc from the key in
+// dir, and during a key rotation, also from the previous key in previousDir,
+// authorizing the client credentials clientNames.
+func serviceTorConfig(svc *config.Service, addrs localAddrs, dir, previousDir string, clientNames []string) *TorConfig {
+	var tc TorConfig
+
+	var ports []TorOption
+	for _, export := range svc.Exports {
+		if export.IsUDP() {
+			// Tor only carries TCP; UDP exports are relayed by the endpoint.
+			continue
+		}
+		ports = append(ports, TorOption{"HiddenServicePort",
+			fmt.Sprintf("%d %s", export.Port, export.LocalAddr)})
+	}
+	if len(svc.Routes) > 0 {
+		ports = append(ports, TorOption{"HiddenServicePort",
+			fmt.Sprintf("%d %s", config.HTTPRouterPort, addrs.router)})
+	}
+	if svc.EndpointEnabled() {
+		ports = append(ports, TorOption{"HiddenServicePort",
+			fmt.Sprintf("%d %s", config.EndpointPort, addrs.endpoint)})
+	}
+	if svc.Gateway.Port != 0 {
+		ports = append(ports, TorOption{"HiddenServicePort",
+			fmt.Sprintf("%d %s", svc.Gateway.Port, addrs.gateway)})
+	}
+
+	var auth []TorOption
+	if len(clientNames) > 0 {
+		auth = append(auth, TorOption{"HiddenServiceAuthorizeClient",
+			"stealth " + strings.Join(clientNames, ",")})
+	} else {
+		tc.Reset = append(tc.Reset, "HiddenServiceAuthorizeClient")
+	}
+
+	// During a key rotation the previous key is published as a second
+	// service, with the same ports and clients.
+	if len(ports) > 0 {
+		tc.Set = append(tc.Set, TorOption{"HiddenServiceDir", dir})
+		tc.Set = append(tc.Set, ports...)
+		tc.Set = append(tc.Set, auth...)
+		if previousDir != "" {
+			tc.Set = append(tc.Set, TorOption{"HiddenServiceDir", previousDir})
+			tc.Set = append(tc.Set, ports...)
+			tc.Set = append(tc.Set, auth...)
+		}
+	} else {
+		tc.Reset = append(tc.Reset, "HiddenServicePort")
+		tc.Set = append(tc.Set, auth...)
+	}
+	return &tc
+}
+
+// remotesTorConfig returns the configuration authorizing the node to connect
+// to remotes.
+func remotesTorConfig(remotes []config.Remote) *TorConfig {
+	var tc TorConfig
+	for _, remote := range remotes {
+		if remote.Auth != "" {
+			tc.Set = append(tc.Set, TorOption{"HidServAuth", remote.Address + " " + remote.Auth})
+		}
+	}
+	if len(tc.Set) == 0 {
+		tc.Reset = append(tc.Reset, "HidServAuth")
+	}
+	return &tc
+}
+
+// ServiceTorConfig returns the configuration the agent applies to tor for
+// the node's onion service at now. Auth tokens must have been resolved from
+// the secrets store.
+func ServiceTorConfig(cfg *config.Config, now time.Time) *TorConfig {
+	svc := &cfg.Node.Service
+	clients, _, _ := activeClients(svc.Clients, now)
+	clientNames, _, _ := clientCredentials(clients, now)
+	var previousDir string
+	if svc.Rotation != nil && svc.Rotation.Dir != "" && !svc.Rotation.IsRetired(now) {
+		previousDir = svc.Rotation.Dir
+	}
+	addrs := localAddrs{
+		router:   cfg.Node.Agent.HTTPRouterAddr,
+		endpoint: cfg.Node.Agent.EndpointAddr,
+		gateway:  cfg.Node.Agent.GatewayAddr,
+	}
+	return serviceTorConfig(svc, addrs, cfg.Node.Agent.TorServicesDir, previousDir, clientNames)
+}
+
+// RemotesTorConfig returns the configuration the agent applies to tor for
+// the node's remotes.
+func RemotesTorConfig(cfg *config.Config) *TorConfig {
+	return remotesTorConfig(cfg.Node.Remotes)
+}
+
+// TorOptions returns the options in effect in tor once the agent has started
+// it and configured it for cfg at now.
+func TorOptions(cfg *config.Config, now time.Time) []TorOption {
+	opts := baseTorOptions(&cfg.Node.Agent)
+	opts = append(opts, ServiceTorConfig(cfg, now).Set...)
+	return append(opts, RemotesTorConfig(cfg).Set...)
+}
+
+// WriteTorrc writes a complete torrc for running tor for cfg under separate
+// supervision, with the options the agent would give it.
+func WriteTorrc(w io.Writer, cfg *config.Config, now time.Time) error {
+	_, err := fmt.Fprintf(w, "# tor configuration for the ormesh node configured by %s\n", cfg.Path)
+	if err != nil {
+		return err
+	}
+	for _, opt := range TorOptions(cfg, now) {
+		if _, err := fmt.Fprintln(w, opt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func formatCmds(tc *TorConfig) []string {
+	var cmds []string
+	for _, cmd := range tc.Commands() {
+		cmds = append(cmds, FormatCmd(cmd))
+	}
+	return cmds
+}
+
+func TestServiceTorConfig(t *testing.T) {
+	svc := &config.Service{
+		Exports: []config.Export{
+			{LocalAddr: "127.0.0.1:22", Port: 22},
+			{LocalAddr: "127.0.0.1:53", Port: 53, Protocol: config.ProtocolUDP},
+		},
+		Routes: []config.Route{{Host: "grafana", Backend: "127.0.0.1:3000"}},
+	}
+	addrs := localAddrs{router: "127.0.0.1:9252", endpoint: "127.0.0.1:9253", gateway: "127.0.0.1:9254"}
+	assert.Equal(t, []string{
+		`SETCONF HiddenServiceDir="/services" HiddenServicePort="22 127.0.0.1:22" ` +
+			`HiddenServicePort="80 127.0.0.1:9252" HiddenServicePort="9253 127.0.0.1:9253" ` +
+			`HiddenServiceAuthorizeClient="stealth alice,bob"`,
+		`SAVECONF`,
+	}, formatCmds(serviceTorConfig(svc, addrs, "/services", "", []string{"alice", "bob"})))
+
+	assert.Equal(t, []string{
+		`SETCONF HiddenServiceDir="/services" HiddenServicePort="22 127.0.0.1:22" ` +
+			`HiddenServicePort="80 127.0.0.1:9252" HiddenServicePort="9253 127.0.0.1:9253" ` +
+			`HiddenServiceDir="/previous" HiddenServicePort="22 127.0.0.1:22" ` +
+			`HiddenServicePort="80 127.0.0.1:9252" HiddenServicePort="9253 127.0.0.1:9253"`,
+		`RESETCONF HiddenServiceAuthorizeClient`,
+		`SAVECONF`,
+	}, formatCmds(serviceTorConfig(svc, addrs, "/services", "/previous", nil)))
+
+	assert.Equal(t, []string{
+		`RESETCONF HiddenServiceAuthorizeClient HiddenServicePort`,
+		`SAVECONF`,
+	}, formatCmds(serviceTorConfig(&config.Service{}, addrs, "/services", "", nil)))
+}
+
+func TestRemotesTorConfig(t *testing.T) {
+	assert.Equal(t, []string{`RESETCONF HidServAuth`, `SAVECONF`}, formatCmds(remotesTorConfig(nil)))
+	assert.Equal(t, []string{`SETCONF HidServAuth="abc.onion token"`, `SAVECONF`},
+		formatCmds(remotesTorConfig([]config.Remote{
+			{Name: "a", Address: "abc.onion", Auth: "token"},
+			{Name: "b", Address: "def.onion"},
+		})))
+}
+
+func TestTorOptionArg(t *testing.T) {
+	opt := TorOption{Key: "HiddenServiceDir", Value: `/srv/"tor"\data`}
+	assert.Equal(t, `HiddenServiceDir="/srv/\"tor\"\\data"`, opt.Arg())
+	opt = TorOption{Key: "HidServAuth", Value: "a.onion b\nSIGNAL SHUTDOWN"}
+	assert.Equal(t, `HidServAuth="a.onion b\nSIGNAL SHUTDOWN"`, opt.Arg())
+}
+
+func TestTorOptionString(t *testing.T) {
+	opt := TorOption{Key: "HiddenServicePort", Value: "22 127.0.0.1:22"}
+	assert.Equal(t, `HiddenServicePort 22 127.0.0.1:22`, opt.String())
+	opt = TorOption{Key: "HiddenServiceDir", Value: `/srv/tor#1`}
+	assert.Equal(t, `HiddenServiceDir "/srv/tor#1"`, opt.String())
+	opt = TorOption{Key: "HidServAuth", Value: "a.onion b\nControlPort 9051"}
+	assert.Equal(t, `HidServAuth "a.onion b\nControlPort 9051"`, opt.String())
+}
+
+func TestRedacted(t *testing.T) {
+	tc := &TorConfig{Set: []TorOption{
+		{"HiddenServiceAuthorizeClient", "stealth alice"},
+		{"HidServAuth", "abc.onion cookie"},
+	}}
+	assert.Equal(t, []string{
+		`SETCONF HiddenServiceAuthorizeClient="stealth alice" HidServAuth="abc.onion <redacted>"`,
+		`SAVECONF`,
+	}, formatCmds(tc.Redacted()))
+	assert.Equal(t, "abc.onion cookie", tc.Set[1].Value)
+}
@@ -0,0 +1,364 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cmars/orc/control"
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// torEventTypes are the asynchronous events the agent subscribes to.
+var torEventTypes = []string{"STATUS_CLIENT", "HS_DESC"}
+
+// watchEvents subscribes to tor events on a dedicated control connection,
+// since a control.Conn cannot wait for events while it is used to send
+// commands. The connection is closed when tor exits.
+func (a *Agent) watchEvents(cookie []byte) error {
+	conn, err := control.Dial(a.controlAddr)
+	if err != nil {
+		return errors.Wrap(err, "control connect failed")
+	}
+	err = conn.AuthCookie(cookie)
+	if err != nil {
+		return errors.Wrap(err, "control auth failed")
+	}
+	err = conn.SetEvents(torEventTypes)
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to events")
+	}
+	go func() {
+		for {
+			r, err := conn.Receive()
+			// Receive returns an empty reply rather than an error if the
+			// connection is closed.
+			if err != nil || r.Status == 0 {
+				logger.Warnf("tor event connection closed: %v", err)
+				return
+			}
+			if r.IsAsync() {
+				a.handleEvent(r)
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) handleEvent(r *control.Reply) {
+	eventType, args := r.Text, ""
+	if i := strings.IndexByte(r.Text, ' '); i >= 0 {
+		eventType, args = r.Text[:i], r.Text[i+1:]
+	}
+	switch eventType {
+	case "STATUS_CLIENT":
+		a.handleStatusClient(args)
+	case "HS_DESC":
+		a.handleHSDesc(args)
+	}
+}
+
+// descriptorUploadTimeout is how long an upload is tracked without tor
+// reporting its result.
+const descriptorUploadTimeout = 10 * time.Minute
+
+func newDescriptorStatus() descriptorStatus {
+	return descriptorStatus{
+		uploading: map[hsDirUpload]string{},
+		pending:   map[string]*descriptorUpload{},
+	}
+}
+
+// handleHSDesc handles HS_DESC events, tracking uploads of this node's
+// descriptors, such as
+//
+//	UPLOAD abcdefghijklmnop STEALTH_AUTH $AAAA...~relay 2ab3...
+//	UPLOADED abcdefghijklmnop STEALTH_AUTH $AAAA...~relay
+//	FAILED abcdefghijklmnop STEALTH_AUTH $AAAA...~relay REASON=UPLOAD_REJECTED
+//
+// Each descriptor is uploaded to several HSDirs. It is counted as published
+// once, when the first HSDir accepts it, and as failed if none does.
+func (a *Agent) handleHSDesc(args string) {
+	positional, kw := parseEventArgs(args)
+	if len(positional) < 4 {
+		return
+	}
+	action := positional[0]
+	key := hsDirUpload{addr: positional[1], hsDir: hsDirID(positional[3])}
+	var descID string
+	var onions map[string]bool
+	if action == "UPLOAD" {
+		if len(positional) < 5 {
+			return
+		}
+		descID = positional[4]
+		onions = a.serviceOnions()
+	}
+	if event := a.descriptors.update(action, key, descID, kw["REASON"], onions, time.Now()); event != nil {
+		a.hooks.fire(event)
+	}
+}
+
+// update records an HS_DESC event, returning the hook event it causes, if
+// any. Uploads are only tracked for the addresses in onions.
+func (d *descriptorStatus) update(action string, key hsDirUpload, descID, reason string,
+	onions map[string]bool, now time.Time) *HookEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch action {
+	case "UPLOAD":
+		if !onions[key.addr] {
+			return nil
+		}
+		d.expire(now)
+		desc := d.pending[descID]
+		if desc == nil {
+			desc = &descriptorUpload{started: now}
+			d.pending[descID] = desc
+		}
+		if _, ok := d.uploading[key]; !ok {
+			desc.hsDirs++
+		}
+		d.uploading[key] = descID
+	case "UPLOADED", "FAILED":
+		var ok bool
+		descID, ok = d.uploading[key]
+		if !ok {
+			// Not an upload of this node's descriptor, such as a failure to
+			// fetch a remote's.
+			return nil
+		}
+		delete(d.uploading, key)
+		desc := d.pending[descID]
+		if desc == nil {
+			return nil
+		}
+		desc.hsDirs--
+		if desc.hsDirs <= 0 {
+			delete(d.pending, descID)
+		}
+		if action == "UPLOADED" {
+			if desc.published {
+				return nil
+			}
+			desc.published = true
+			d.uploads++
+			d.lastUpload = now
+			return &HookEvent{Event: config.HookDescriptorPublished}
+		}
+		desc.reason = reason
+		logger.Debugf("failed to upload descriptor %s to %s: %s", descID, key.hsDir, reason)
+		if desc.hsDirs > 0 || desc.published {
+			return nil
+		}
+		d.failures++
+		d.lastFailure = now
+		d.lastFailureReason = desc.reason
+		logger.Warnf("failed to upload descriptor %s: %s", descID, desc.reason)
+		return &HookEvent{Event: config.HookDescriptorFailed, Reason: desc.reason}
+	}
+	return nil
+}
+
+// expire forgets uploads tor has not reported the results of.
+func (d *descriptorStatus) expire(now time.Time) {
+	for descID, desc := range d.pending {
+		if now.Sub(desc.started) > descriptorUploadTimeout {
+			delete(d.pending, descID)
+		}
+	}
+	for key, descID := range d.uploading {
+		if _, ok := d.pending[descID]; !ok {
+			delete(d.uploading, key)
+		}
+	}
+}
+
+// hsDirID returns the identity digest of an HSDir given as a long name, such
+// as "$AAAA...~relay".
+func hsDirID(longName string) string {
+	if i := strings.IndexAny(longName, "~="); i >= 0 {
+		return longName[:i]
+	}
+	return longName
+}
+
+// handleStatusClient handles STATUS_CLIENT events, such as
+//
+//	NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"
+func (a *Agent) handleStatusClient(args string) {
+	positional, kw := parseEventArgs(args)
+	if len(positional) < 2 || positional[1] != "BOOTSTRAP" {
+		return
+	}
+	a.updateBootstrap(kw)
+}
+
+func (a *Agent) updateBootstrap(kw map[string]string) {
+	progress, err := strconv.Atoi(kw["PROGRESS"])
+	if err != nil {
+		return
+	}
+	logger.Infof("tor bootstrap %d%%: %s", progress, kw["SUMMARY"])
+	if a.bootstrap.update(progress, kw["SUMMARY"]) {
+		logger.Infof("tor bootstrap complete")
+		a.hooks.fire(&HookEvent{Event: config.HookAgentReady})
+		a.mu.Lock()
+		prefetch := a.prefetchAddrs
+		a.mu.Unlock()
+		go a.prefetchDescriptors(prefetch)
+	}
+}
+
+// queryBootstrap reads tor's current bootstrap progress, which events only
+// report as it changes.
+func (a *Agent) queryBootstrap() error {
+	reply, err := a.send(control.Cmd{
+		Keyword:   "GETINFO",
+		Arguments: []string{"status/bootstrap-phase"},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, line := range reply.Lines {
+		if strings.HasPrefix(line.Text, "status/bootstrap-phase=") {
+			_, kw := parseEventArgs(strings.TrimPrefix(line.Text, "status/bootstrap-phase="))
+			a.updateBootstrap(kw)
+			return nil
+		}
+	}
+	return errors.Errorf("unexpected reply %q", reply.Text)
+}
+
+// prefetchDescriptors asks tor to fetch the onion service descriptors of
+// remotes, so that the first connection to each is faster.
+func (a *Agent) prefetchDescriptors(addrs []string) {
+	for _, addr := range addrs {
+		reply, err := a.send(control.Cmd{
+			Keyword:   "HSFETCH",
+			Arguments: []string{strings.TrimSuffix(addr, ".onion")},
+		})
+		if err != nil {
+			logger.Warnf("failed to prefetch descriptor for %s: %v", addr, err)
+		} else if reply.Status != control.StatusOK {
+			logger.Warnf("failed to prefetch descriptor for %s: %s", addr, reply.Text)
+		} else {
+			logger.Infof("prefetching descriptor for %s", addr)
+		}
+	}
+}
+
+// FetchDescriptor fetches the onion service descriptor for addr, returning
+// how long it took. If the fetch does not succeed within timeout, the reason
+// the last attempt failed is returned, if known.
+func (a *Agent) FetchDescriptor(addr string, timeout time.Duration) (time.Duration, error) {
+	onion := strings.TrimSuffix(addr, ".onion")
+	stream, err := a.SubscribeEvents([]string{"HS_DESC"})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer stream.Close()
+	timer := time.AfterFunc(timeout, func() { stream.Close() })
+	defer timer.Stop()
+
+	start := time.Now()
+	reply, err := a.send(control.Cmd{
+		Keyword:   "HSFETCH",
+		Arguments: []string{onion},
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if reply.Status != control.StatusOK {
+		return 0, errors.Errorf("HSFETCH failed: %s", reply.Text)
+	}
+	var reason string
+	for {
+		ev, err := stream.Next()
+		if err != nil {
+			if reason != "" {
+				return 0, errors.Errorf("descriptor fetch failed: %s", reason)
+			}
+			return 0, errors.Errorf("descriptor fetch timed out after %v", timeout)
+		}
+		if ev.Onion != onion {
+			continue
+		}
+		switch ev.arg(0) {
+		case "RECEIVED":
+			return time.Since(start), nil
+		case "FAILED":
+			reason = ev.Keywords["REASON"]
+		}
+	}
+}
+
+// parseEventArgs splits the arguments of a tor event into positional
+// arguments and keyword arguments, unquoting quoted keyword values.
+func parseEventArgs(s string) ([]string, map[string]string) {
+	var positional []string
+	kw := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, " ") {
+		var token string
+		eq := strings.IndexByte(s, '=')
+		sp := strings.IndexByte(s, ' ')
+		if eq >= 0 && (sp < 0 || eq < sp) {
+			key := s[:eq]
+			s = s[eq+1:]
+			if strings.HasPrefix(s, `"`) {
+				value, rest := unquoteEventValue(s)
+				kw[key], s = value, rest
+				continue
+			}
+			if sp = strings.IndexByte(s, ' '); sp < 0 {
+				kw[key], s = s, ""
+			} else {
+				kw[key], s = s[:sp], s[sp:]
+			}
+			continue
+		}
+		if sp < 0 {
+			token, s = s, ""
+		} else {
+			token, s = s[:sp], s[sp:]
+		}
+		positional = append(positional, token)
+	}
+	return positional, kw
+}
+
+// unquoteEventValue unquotes a quoted string at the start of s, returning it
+// and the remainder of s.
+func unquoteEventValue(s string) (string, string) {
+	var value []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value = append(value, s[i])
+			}
+		case '"':
+			return string(value), s[i+1:]
+		default:
+			value = append(value, s[i])
+		}
+	}
+	return string(value), ""
+}
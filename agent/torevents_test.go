@@ -0,0 +1,89 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestParseEventArgs(t *testing.T) {
+	positional, kw := parseEventArgs(
+		`NOTICE BOOTSTRAP PROGRESS=85 TAG=ap_conn_done SUMMARY="Connected to a relay to build \"circuits\"" WARNING=x`)
+	assert.Equal(t, []string{"NOTICE", "BOOTSTRAP"}, positional)
+	assert.Equal(t, map[string]string{
+		"PROGRESS": "85",
+		"TAG":      "ap_conn_done",
+		"SUMMARY":  `Connected to a relay to build "circuits"`,
+		"WARNING":  "x",
+	}, kw)
+
+	positional, kw = parseEventArgs("RECEIVED abcdefghijklmnop NO_AUTH")
+	assert.Equal(t, []string{"RECEIVED", "abcdefghijklmnop", "NO_AUTH"}, positional)
+	assert.Empty(t, kw)
+}
+
+func TestDescriptorUploads(t *testing.T) {
+	d := newDescriptorStatus()
+	onions := map[string]bool{"abcdefghijklmnop": true}
+	now := time.Now()
+	update := func(line string) *HookEvent {
+		positional, kw := parseEventArgs(line)
+		var descID string
+		if len(positional) > 4 {
+			descID = positional[4]
+		}
+		key := hsDirUpload{addr: positional[1], hsDir: hsDirID(positional[3])}
+		return d.update(positional[0], key, descID, kw["REASON"], onions, now)
+	}
+
+	// Uploaded to three HSDirs, two of which accept it.
+	assert.Nil(t, update("UPLOAD abcdefghijklmnop UNKNOWN $AAAA~a desc1"))
+	assert.Nil(t, update("UPLOAD abcdefghijklmnop UNKNOWN $BBBB~b desc1"))
+	assert.Nil(t, update("UPLOAD abcdefghijklmnop UNKNOWN $CCCC~c desc1"))
+	ev := update("UPLOADED abcdefghijklmnop UNKNOWN $AAAA~a")
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, config.HookDescriptorPublished, ev.Event)
+	}
+	assert.Nil(t, update("FAILED abcdefghijklmnop UNKNOWN $BBBB~b REASON=UPLOAD_REJECTED"))
+	assert.Nil(t, update("UPLOADED abcdefghijklmnop UNKNOWN $CCCC~c"))
+	assert.Equal(t, uint64(1), d.uploads)
+	assert.Equal(t, uint64(0), d.failures)
+
+	// Rejected by every HSDir.
+	assert.Nil(t, update("UPLOAD abcdefghijklmnop UNKNOWN $AAAA~a desc2"))
+	assert.Nil(t, update("UPLOAD abcdefghijklmnop UNKNOWN $BBBB~b desc2"))
+	assert.Nil(t, update("FAILED abcdefghijklmnop UNKNOWN $AAAA~a REASON=UPLOAD_REJECTED"))
+	ev = update("FAILED abcdefghijklmnop UNKNOWN $BBBB~b REASON=UPLOAD_REJECTED")
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, config.HookDescriptorFailed, ev.Event)
+		assert.Equal(t, "UPLOAD_REJECTED", ev.Reason)
+	}
+	assert.Equal(t, uint64(1), d.uploads)
+	assert.Equal(t, uint64(1), d.failures)
+
+	// Other services' descriptors are ignored.
+	assert.Nil(t, update("UPLOAD qrstuvwxyzabcdef UNKNOWN $AAAA~a desc3"))
+	assert.Nil(t, update("UPLOADED qrstuvwxyzabcdef UNKNOWN $AAAA~a"))
+	assert.Nil(t, update("FAILED qrstuvwxyzabcdef NO_AUTH $AAAA~a REASON=NOT_FOUND"))
+	assert.Equal(t, uint64(1), d.uploads)
+	assert.Equal(t, uint64(1), d.failures)
+	assert.Empty(t, d.uploading)
+	assert.Empty(t, d.pending)
+}
@@ -0,0 +1,69 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"io"
+	"regexp"
+
+	"github.com/cmars/ormesh/logging"
+)
+
+var torLogger = logging.Component("tor")
+
+// torLogLineRE matches tor's log line format, for example:
+//
+//	Oct 19 00:15:54.000 [notice] Bootstrapped 100% (done): Done
+var torLogLineRE = regexp.MustCompile(`^[A-Z][a-z]{2} +\d{1,2} [0-9:.]+ \[(\w+)\] (.*)$`)
+
+var torLogLevels = map[string]logging.Level{
+	"debug":  logging.Debug,
+	"info":   logging.Debug,
+	"notice": logging.Info,
+	"warn":   logging.Warn,
+	"err":    logging.Error,
+}
+
+// parseTorLogLine returns the level and message of a line logged by tor.
+// Lines not in tor's log format are passed through at info level.
+func parseTorLogLine(line string) (logging.Level, string) {
+	m := torLogLineRE.FindStringSubmatch(line)
+	if m == nil {
+		return logging.Info, line
+	}
+	level, ok := torLogLevels[m[1]]
+	if !ok {
+		level = logging.Info
+	}
+	return level, m[2]
+}
+
+// newTorLogWriter returns a writer which relays tor's log output through the
+// agent's logger at the corresponding level.
+func newTorLogWriter() io.Writer {
+	return &logging.LineWriter{Log: func(line string) {
+		level, msg := parseTorLogLine(line)
+		torLogger.Logf(level, "%s", msg)
+	}}
+}
+
+// torLogLevel returns the severity tor should log at, so that tor's info
+// messages are only collected when the agent is logging debug messages.
+func torLogLevel() string {
+	if torLogger.Enabled(logging.Debug) {
+		return "info"
+	}
+	return "notice"
+}
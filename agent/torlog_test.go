@@ -0,0 +1,55 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/logging"
+)
+
+func TestParseTorLogLine(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		level logging.Level
+		msg   string
+	}{{
+		line:  "Oct 19 00:15:54.000 [notice] Bootstrapped 100% (done): Done",
+		level: logging.Info,
+		msg:   "Bootstrapped 100% (done): Done",
+	}, {
+		line:  "Oct  9 00:15:54.123 [warn] Problem bootstrapping.",
+		level: logging.Warn,
+		msg:   "Problem bootstrapping.",
+	}, {
+		line:  "Jan 01 12:00:00.000 [err] Reading config failed",
+		level: logging.Error,
+		msg:   "Reading config failed",
+	}, {
+		line:  "Jan 01 12:00:00.000 [info] circuit_build_times_set_timeout()",
+		level: logging.Debug,
+		msg:   "circuit_build_times_set_timeout()",
+	}, {
+		line:  "Tor can't help you if you use it wrong!",
+		level: logging.Info,
+		msg:   "Tor can't help you if you use it wrong!",
+	}} {
+		level, msg := parseTorLogLine(tc.line)
+		assert.Equal(t, tc.level, level, tc.line)
+		assert.Equal(t, tc.msg, msg, tc.line)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// UDP datagrams are carried over an endpoint stream in frames of a type
+// byte, a big-endian uint32 flow ID and a big-endian uint16 payload length.
+// Each flow corresponds to a source address on the importing side.
+const (
+	udpFrameData  = 0
+	udpFrameClose = 1
+
+	udpFrameHeaderSize = 7
+	maxDatagramSize    = 65535
+)
+
+// udpFrameWriter serializes frames written to a stream.
+type udpFrameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (fw *udpFrameWriter) write(typ byte, flow uint32, payload []byte) error {
+	buf := make([]byte, udpFrameHeaderSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], flow)
+	binary.BigEndian.PutUint16(buf[5:7], uint16(len(payload)))
+	copy(buf[udpFrameHeaderSize:], payload)
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	_, err := fw.w.Write(buf)
+	return errors.WithStack(err)
+}
+
+func readUDPFrame(r io.Reader, buf []byte) (byte, uint32, []byte, error) {
+	var hdr [udpFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, nil, errors.WithStack(err)
+	}
+	n := binary.BigEndian.Uint16(hdr[5:7])
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, 0, nil, errors.WithStack(err)
+	}
+	return hdr[0], binary.BigEndian.Uint32(hdr[1:5]), buf[:n], nil
+}
+
+// udpForwarder listens for datagrams on a local UDP port, and forwards them
+// over a tunnel to a UDP export on a remote, returning replies to the
+// original sender.
+type udpForwarder struct {
+	remote     *meshRemote
+	remotePort int
+	localAddr  string
+	localPort  int
+	timeout    time.Duration
+	maxFlows   int
+	ready      *bootstrap
+	conn       *net.UDPConn
+	done       chan struct{}
+
+	mu        sync.Mutex
+	closed    bool
+	stream    net.Conn
+	writer    *udpFrameWriter
+	nextID    uint32
+	flows     map[string]*udpFlow
+	flowsByID map[uint32]*udpFlow
+}
+
+type udpFlow struct {
+	id         uint32
+	addr       *net.UDPAddr
+	lastActive time.Time
+}
+
+func newUDPForwarder(remote *meshRemote, import_ *config.Import, ready *bootstrap) *udpForwarder {
+	maxFlows := import_.MaxFlows
+	if maxFlows <= 0 {
+		maxFlows = config.DefaultMaxFlows
+	}
+	return &udpForwarder{
+		remote:     remote,
+		remotePort: import_.RemotePort,
+		localAddr:  import_.LocalAddr,
+		localPort:  import_.LocalPort,
+		timeout:    import_.SessionTimeout.Or(config.DefaultSessionTimeout),
+		maxFlows:   maxFlows,
+		ready:      ready,
+		done:       make(chan struct{}),
+		flows:      map[string]*udpFlow{},
+		flowsByID:  map[uint32]*udpFlow{},
+	}
+}
+
+func (f *udpForwarder) start() error {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", f.localAddr, f.localPort))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	go f.readLoop()
+	go f.expireLoop()
+	logger.Infof("started udp listener %v", f.conn.LocalAddr())
+	return nil
+}
+
+func (f *udpForwarder) readLoop() {
+	if !f.ready.isDone() {
+		// Datagrams queue in the socket until tor can carry them.
+		logger.Infof("udp listener %v waiting for tor to bootstrap", f.conn.LocalAddr())
+		select {
+		case <-f.ready.doneChan():
+		case <-f.done:
+			return
+		}
+	}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Infof("udp listener exiting on error: %v", err)
+			return
+		}
+		if err := f.send(addr, buf[:n]); err != nil {
+			logger.Warnf("udp %s -> %s:%d: %v", addr, f.remote.name, f.remotePort, err)
+		}
+	}
+}
+
+func (f *udpForwarder) send(addr *net.UDPAddr, payload []byte) error {
+	f.mu.Lock()
+	flow, ok := f.flows[addr.String()]
+	if !ok {
+		if len(f.flows) >= f.maxFlows {
+			f.mu.Unlock()
+			return errors.Errorf("too many flows (%d), dropping datagram", f.maxFlows)
+		}
+		f.nextID++
+		flow = &udpFlow{id: f.nextID, addr: addr}
+		f.flows[addr.String()] = flow
+		f.flowsByID[flow.id] = flow
+		logger.Debugf("udp flow %d from %s", flow.id, addr)
+	}
+	flow.lastActive = time.Now()
+	stream, writer := f.stream, f.writer
+	f.mu.Unlock()
+
+	if stream == nil {
+		var err error
+		stream, writer, err = f.openStream()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		f.mu.Lock()
+		// The flow may have expired while the remote was dialed.
+		if _, ok := f.flowsByID[flow.id]; !ok {
+			f.flows[addr.String()] = flow
+			f.flowsByID[flow.id] = flow
+		}
+		flow.lastActive = time.Now()
+		f.mu.Unlock()
+	}
+	if err := writer.write(udpFrameData, flow.id, payload); err != nil {
+		f.resetStream(stream)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// openStream opens a stream to the remote's UDP export. The remote is dialed
+// without holding the lock, so that replies and expiry are not held up.
+func (f *udpForwarder) openStream() (net.Conn, *udpFrameWriter, error) {
+	stream, err := f.remote.openUDP(f.remotePort)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		stream.Close()
+		return nil, nil, errors.New("udp forwarder closed")
+	}
+	if f.stream != nil {
+		// Another stream was opened meanwhile.
+		stream.Close()
+		return f.stream, f.writer, nil
+	}
+	f.stream, f.writer = stream, &udpFrameWriter{w: stream}
+	go f.recvLoop(stream)
+	return f.stream, f.writer, nil
+}
+
+// close stops the forwarder, closing its listener and stream.
+func (f *udpForwarder) close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	stream := f.stream
+	f.stream, f.writer = nil, nil
+	f.mu.Unlock()
+	close(f.done)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	if stream != nil {
+		stream.Close()
+	}
+}
+
+func (f *udpForwarder) resetStream(stream net.Conn) {
+	stream.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stream == stream {
+		f.stream, f.writer = nil, nil
+	}
+}
+
+func (f *udpForwarder) recvLoop(stream net.Conn) {
+	defer f.resetStream(stream)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		typ, id, payload, err := readUDPFrame(stream, buf)
+		if err != nil {
+			logger.Infof("udp tunnel to %s:%d closed: %v", f.remote.name, f.remotePort, err)
+			return
+		}
+		f.mu.Lock()
+		flow, ok := f.flowsByID[id]
+		if ok {
+			flow.lastActive = time.Now()
+			if typ == udpFrameClose {
+				delete(f.flows, flow.addr.String())
+				delete(f.flowsByID, id)
+			}
+		}
+		f.mu.Unlock()
+		if ok && typ == udpFrameData {
+			f.conn.WriteToUDP(payload, flow.addr)
+		}
+	}
+}
+
+func (f *udpForwarder) expireLoop() {
+	ticker := time.NewTicker(f.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+		var expired []uint32
+		f.mu.Lock()
+		for id, flow := range f.flowsByID {
+			if time.Since(flow.lastActive) > f.timeout {
+				delete(f.flows, flow.addr.String())
+				delete(f.flowsByID, id)
+				expired = append(expired, id)
+			}
+		}
+		writer := f.writer
+		f.mu.Unlock()
+		for _, id := range expired {
+			logger.Debugf("udp flow %d expired", id)
+			if writer != nil {
+				writer.write(udpFrameClose, id, nil)
+			}
+		}
+	}
+}
+
+// relayUDP relays datagrams framed on stream to a local UDP export, and
+// replies back, with a separate local socket for each flow.
+func relayUDP(stream net.Conn, export *config.Export) {
+	timeout := export.SessionTimeout.Or(config.DefaultSessionTimeout)
+	maxFlows := export.MaxFlows
+	if maxFlows <= 0 {
+		maxFlows = config.DefaultMaxFlows
+	}
+	raddr, err := net.ResolveUDPAddr("udp", export.LocalAddr)
+	if err != nil {
+		logger.Warnf("endpoint: udp export %q: %v", export.LocalAddr, err)
+		return
+	}
+	writer := &udpFrameWriter{w: stream}
+	type relayFlow struct {
+		conn       *net.UDPConn
+		lastActive time.Time
+	}
+	var mu sync.Mutex
+	flows := map[uint32]*relayFlow{}
+	closeFlow := func(id uint32) {
+		mu.Lock()
+		flow, ok := flows[id]
+		delete(flows, id)
+		mu.Unlock()
+		if ok {
+			flow.conn.Close()
+		}
+	}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		mu.Lock()
+		for _, flow := range flows {
+			flow.conn.Close()
+		}
+		mu.Unlock()
+	}()
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			var expired []uint32
+			mu.Lock()
+			for id, flow := range flows {
+				if time.Since(flow.lastActive) > timeout {
+					expired = append(expired, id)
+				}
+			}
+			mu.Unlock()
+			for _, id := range expired {
+				closeFlow(id)
+				writer.write(udpFrameClose, id, nil)
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		typ, id, payload, err := readUDPFrame(stream, buf)
+		if err != nil {
+			return
+		}
+		if typ == udpFrameClose {
+			closeFlow(id)
+			continue
+		}
+		mu.Lock()
+		flow, ok := flows[id]
+		if !ok {
+			if len(flows) >= maxFlows {
+				mu.Unlock()
+				logger.Warnf("endpoint: udp %s: too many flows (%d), dropping datagram", export.LocalAddr, maxFlows)
+				continue
+			}
+			conn, err := net.DialUDP("udp", nil, raddr)
+			if err != nil {
+				mu.Unlock()
+				logger.Warnf("endpoint: udp %s: %v", export.LocalAddr, err)
+				continue
+			}
+			flow = &relayFlow{conn: conn}
+			flows[id] = flow
+			go func(id uint32, flow *relayFlow) {
+				replyBuf := make([]byte, maxDatagramSize)
+				for {
+					n, err := flow.conn.Read(replyBuf)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					flow.lastActive = time.Now()
+					mu.Unlock()
+					if err := writer.write(udpFrameData, id, replyBuf[:n]); err != nil {
+						return
+					}
+				}
+			}(id, flow)
+		}
+		flow.lastActive = time.Now()
+		mu.Unlock()
+		flow.conn.Write(payload)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// blockingDialer blocks dialing until released, and then fails.
+type blockingDialer struct {
+	dialing, release chan struct{}
+}
+
+func (d blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.dialing <- struct{}{}
+	<-d.release
+	return nil, errors.New("unreachable")
+}
+
+func TestUDPForwarderDial(t *testing.T) {
+	dialer := blockingDialer{dialing: make(chan struct{}), release: make(chan struct{})}
+	remote := newMeshRemote(&config.Remote{Name: "server", Address: "abcdefghijklmnop.onion"}, dialer, nil)
+	f := newUDPForwarder(remote, &config.Import{
+		LocalAddr: "127.0.0.1", RemotePort: 53, Protocol: config.ProtocolUDP,
+	}, newBootstrap())
+	assert.NoError(t, f.start())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- f.send(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, []byte("query"))
+	}()
+	<-dialer.dialing
+
+	// Other flows, replies and expiry are not held up while the remote is
+	// dialed.
+	unlocked := make(chan struct{})
+	go func() {
+		f.mu.Lock()
+		f.mu.Unlock()
+		close(unlocked)
+	}()
+	select {
+	case <-unlocked:
+	case <-time.After(time.Second):
+		t.Fatal("forwarder locked while dialing")
+	}
+	close(dialer.release)
+	assert.Error(t, <-errs)
+
+	f.close()
+	f.close()
+	select {
+	case <-f.done:
+	default:
+		t.Fatal("forwarder not stopped")
+	}
+}
@@ -0,0 +1,570 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apply reconciles a node's configuration with a declarative
+// description of what it should export, import and authorize.
+package apply
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// Spec is the desired state of a node. Clients, remotes, groups and hooks are
+// identified by name, and each one in the spec fully describes it. Exports
+// are identified by port and protocol, and routes by host and path prefix.
+type Spec struct {
+	Exports []config.Export
+	Routes  []config.Route
+	Clients []Client
+	Remotes []config.Remote
+	Groups  []config.Group
+	Hooks   []config.Hook
+}
+
+// Client is the desired state of a client. Its credentials are issued by tor,
+// so they are not part of the spec.
+type Client struct {
+	Name    string
+	Expires *time.Time
+	Notes   string
+	Labels  map[string]string
+}
+
+// ReadFile reads a spec from a TOML file.
+func ReadFile(fpath string) (*Spec, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", fpath)
+	}
+	spec, err := Parse(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", fpath)
+	}
+	return spec, nil
+}
+
+// Parse parses a spec. Unknown keys are an error, so that a misspelled one is
+// not silently ignored.
+func Parse(data []byte) (*Spec, error) {
+	var spec Spec
+	md, err := toml.Decode(string(data), &spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse spec")
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return nil, errors.Errorf("unknown keys in spec: %s", strings.Join(keys, ", "))
+	}
+	return &spec, nil
+}
+
+// Action is what a change does.
+type Action string
+
+// Actions, formatted as in a diff.
+const (
+	Add    Action = "+"
+	Update Action = "~"
+	Delete Action = "-"
+)
+
+// Change is a change made to reconcile a node with a spec.
+type Change struct {
+	Action Action
+	// Kind is "export", "route", "client", "remote", "group" or "hook".
+	Kind string
+	Name string
+	// Fields are the names of the fields which an update changes.
+	Fields []string
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+	if len(c.Fields) > 0 {
+		s += " (" + strings.Join(c.Fields, ", ") + ")"
+	}
+	return s
+}
+
+// Options control how a node is reconciled.
+type Options struct {
+	// Prune deletes what is not in the spec. Otherwise, it is kept.
+	Prune bool
+	// Now is the time recorded in the metadata of new clients and remotes.
+	Now time.Time
+	// Actor is the user recorded in the metadata of new clients and remotes.
+	Actor string
+	// Issued returns whether tor holds the client credential with the given
+	// name. The credentials of clients for which it returns false are
+	// cleared, to be issued again. Credentials are not checked if it is
+	// nil.
+	Issued func(torName string) bool
+}
+
+// Reconcile changes node to match spec, and returns the changes made, in
+// the order of the spec's sections. Clients added, or whose credentials are
+// cleared, have no Address; their credentials must be issued by tor.
+func Reconcile(node *config.Node, spec *Spec, opts Options) []Change {
+	var changes []Change
+	changes = append(changes, reconcileExports(&node.Service, spec.Exports, opts)...)
+	changes = append(changes, reconcileRoutes(&node.Service, spec.Routes, opts)...)
+	changes = append(changes, reconcileClients(&node.Service, spec.Clients, opts)...)
+	changes = append(changes, reconcileRemotes(node, spec.Remotes, opts)...)
+	changes = append(changes, reconcileGroups(node, spec.Groups, opts)...)
+	changes = append(changes, reconcileHooks(node, spec.Hooks, opts)...)
+	return changes
+}
+
+// Check returns an error if a reconciled node is inconsistent, such as a
+// group referring to a remote which has been deleted.
+func Check(node *config.Node) error {
+	remotes := map[string]bool{}
+	for _, remote := range node.Remotes {
+		if remotes[remote.Name] {
+			return errors.Errorf("remote %q is defined more than once", remote.Name)
+		}
+		remotes[remote.Name] = true
+	}
+	groups := map[string]bool{}
+	for _, group := range node.Groups {
+		if remotes[group.Name] {
+			return errors.Errorf("group %q has the same name as a remote", group.Name)
+		}
+		if groups[group.Name] {
+			return errors.Errorf("group %q is defined more than once", group.Name)
+		}
+		groups[group.Name] = true
+		for _, remoteName := range group.Remotes {
+			if !remotes[remoteName] {
+				return errors.Errorf("group %q refers to no such remote %q", group.Name, remoteName)
+			}
+		}
+	}
+	clients := map[string]bool{}
+	for _, client := range node.Service.Clients {
+		if clients[client.Name] {
+			return errors.Errorf("client %q is defined more than once", client.Name)
+		}
+		clients[client.Name] = true
+	}
+	hooks := map[string]bool{}
+	for _, hook := range node.Hooks {
+		if hooks[hook.Name] {
+			return errors.Errorf("hook %q is defined more than once", hook.Name)
+		}
+		hooks[hook.Name] = true
+	}
+	return errors.WithStack(node.Service.CheckPorts())
+}
+
+func exportName(export *config.Export) string {
+	name := fmt.Sprintf("%d -> %s", export.Port, export.LocalAddr)
+	if export.IsUDP() {
+		name += " udp"
+	}
+	return name
+}
+
+func reconcileExports(service *config.Service, want []config.Export, opts Options) []Change {
+	var changes []Change
+	var exports []config.Export
+	for _, export := range service.Exports {
+		i := indexExport(want, &export)
+		if i < 0 {
+			if opts.Prune {
+				changes = append(changes, Change{Action: Delete, Kind: "export", Name: exportName(&export)})
+				continue
+			}
+		} else {
+			var fields []string
+			if export.LocalAddr != want[i].LocalAddr {
+				fields = append(fields, "local-addr")
+			}
+			if export.SessionTimeout != want[i].SessionTimeout {
+				fields = append(fields, "session-timeout")
+			}
+			if export.MaxFlows != want[i].MaxFlows {
+				fields = append(fields, "max-flows")
+			}
+			if len(fields) > 0 {
+				export = want[i]
+				changes = append(changes, Change{Action: Update, Kind: "export", Name: exportName(&export), Fields: fields})
+			}
+		}
+		exports = append(exports, export)
+	}
+	for i := range want {
+		if indexExport(exports, &want[i]) < 0 {
+			exports = append(exports, want[i])
+			changes = append(changes, Change{Action: Add, Kind: "export", Name: exportName(&want[i])})
+		}
+	}
+	service.Exports = exports
+	return changes
+}
+
+func indexExport(exports []config.Export, export *config.Export) int {
+	for i := range exports {
+		if exports[i].Port == export.Port && exports[i].IsUDP() == export.IsUDP() {
+			return i
+		}
+	}
+	return -1
+}
+
+func routeName(route *config.Route) string {
+	return route.Host + route.PathPrefix
+}
+
+func reconcileRoutes(service *config.Service, want []config.Route, opts Options) []Change {
+	var changes []Change
+	var routes []config.Route
+	for _, route := range service.Routes {
+		i := indexRoute(want, &route)
+		if i < 0 {
+			if opts.Prune {
+				changes = append(changes, Change{Action: Delete, Kind: "route", Name: routeName(&route)})
+				continue
+			}
+		} else {
+			var fields []string
+			if route.Backend != want[i].Backend {
+				fields = append(fields, "backend")
+			}
+			if route.StripPrefix != want[i].StripPrefix {
+				fields = append(fields, "strip-prefix")
+			}
+			if len(fields) > 0 {
+				route = want[i]
+				changes = append(changes, Change{Action: Update, Kind: "route", Name: routeName(&route), Fields: fields})
+			}
+		}
+		routes = append(routes, route)
+	}
+	for i := range want {
+		if indexRoute(routes, &want[i]) < 0 {
+			routes = append(routes, want[i])
+			changes = append(changes, Change{Action: Add, Kind: "route", Name: routeName(&want[i])})
+		}
+	}
+	service.Routes = routes
+	return changes
+}
+
+func indexRoute(routes []config.Route, route *config.Route) int {
+	for i := range routes {
+		if routes[i].Host == route.Host && routes[i].PathPrefix == route.PathPrefix {
+			return i
+		}
+	}
+	return -1
+}
+
+func reconcileClients(service *config.Service, want []Client, opts Options) []Change {
+	var changes []Change
+	var clients []config.Client
+	for _, client := range service.Clients {
+		i := indexClient(want, client.Name)
+		if i < 0 {
+			if opts.Prune {
+				changes = append(changes, Change{Action: Delete, Kind: "client", Name: client.Name})
+				continue
+			}
+			clients = append(clients, client)
+			continue
+		}
+		var fields []string
+		if !timesEqual(client.Expires, want[i].Expires) {
+			client.Expires = want[i].Expires
+			fields = append(fields, "expires")
+		}
+		fields = updateMetadata(&client.Metadata, want[i].Notes, want[i].Labels, fields)
+		if opts.Issued != nil && client.Address != "" && !opts.Issued(client.CredentialName()) {
+			client.Address, client.Auth, client.AuthRef = "", "", ""
+		}
+		if client.Address == "" && !client.IsExpired(opts.Now) {
+			fields = append(fields, "credentials")
+		}
+		if len(fields) > 0 {
+			changes = append(changes, Change{Action: Update, Kind: "client", Name: client.Name, Fields: fields})
+		}
+		clients = append(clients, client)
+	}
+	for _, c := range want {
+		if indexConfigClient(clients, c.Name) >= 0 {
+			continue
+		}
+		clients = append(clients, config.Client{
+			Name:     c.Name,
+			Expires:  c.Expires,
+			Metadata: newMetadata(c.Notes, c.Labels, opts),
+		})
+		changes = append(changes, Change{Action: Add, Kind: "client", Name: c.Name})
+	}
+	service.Clients = clients
+	return changes
+}
+
+func indexClient(clients []Client, name string) int {
+	for i := range clients {
+		if clients[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func indexConfigClient(clients []config.Client, name string) int {
+	for i := range clients {
+		if clients[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func reconcileRemotes(node *config.Node, want []config.Remote, opts Options) []Change {
+	var changes []Change
+	var remotes []config.Remote
+	for _, remote := range node.Remotes {
+		i := indexRemote(want, remote.Name)
+		if i < 0 {
+			if opts.Prune {
+				changes = append(changes, Change{Action: Delete, Kind: "remote", Name: remote.Name})
+				continue
+			}
+			remotes = append(remotes, remote)
+			continue
+		}
+		w := &want[i]
+		var fields []string
+		if remote.Address != w.Address {
+			remote.Address = w.Address
+			fields = append(fields, "address")
+		}
+		if remote.Auth != w.Auth {
+			remote.Auth = w.Auth
+			fields = append(fields, "auth")
+		}
+		if !equal(remote.Imports, w.Imports) {
+			remote.Imports = w.Imports
+			fields = append(fields, "imports")
+		}
+		if !equal(remote.AllowPorts, w.AllowPorts) {
+			remote.AllowPorts = w.AllowPorts
+			fields = append(fields, "allow-ports")
+		}
+		if remote.Tunnel != w.Tunnel {
+			remote.Tunnel = w.Tunnel
+			fields = append(fields, "tunnel")
+		}
+		fields = updateMetadata(&remote.Metadata, w.Notes, w.Labels, fields)
+		if len(fields) > 0 {
+			changes = append(changes, Change{Action: Update, Kind: "remote", Name: remote.Name, Fields: fields})
+		}
+		remotes = append(remotes, remote)
+	}
+	for _, w := range want {
+		if indexRemote(remotes, w.Name) >= 0 {
+			continue
+		}
+		remote := w
+		remote.AuthRef = ""
+		remote.Metadata = newMetadata(w.Notes, w.Labels, opts)
+		remotes = append(remotes, remote)
+		changes = append(changes, Change{Action: Add, Kind: "remote", Name: w.Name})
+	}
+	node.Remotes = remotes
+	return changes
+}
+
+func indexRemote(remotes []config.Remote, name string) int {
+	for i := range remotes {
+		if remotes[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func reconcileGroups(node *config.Node, want []config.Group, opts Options) []Change {
+	var changes []Change
+	var groups []config.Group
+	for _, group := range node.Groups {
+		i := indexGroup(want, group.Name)
+		if i < 0 {
+			if opts.Prune {
+				changes = append(changes, Change{Action: Delete, Kind: "group", Name: group.Name})
+				continue
+			}
+			groups = append(groups, group)
+			continue
+		}
+		var fields []string
+		if !equal(group.Remotes, want[i].Remotes) {
+			fields = append(fields, "remotes")
+		}
+		if group.Strategy != want[i].Strategy {
+			fields = append(fields, "strategy")
+		}
+		if !equal(group.Imports, want[i].Imports) {
+			fields = append(fields, "imports")
+		}
+		if len(fields) > 0 {
+			group = want[i]
+			changes = append(changes, Change{Action: Update, Kind: "group", Name: group.Name, Fields: fields})
+		}
+		groups = append(groups, group)
+	}
+	for _, w := range want {
+		if indexGroup(groups, w.Name) < 0 {
+			groups = append(groups, w)
+			changes = append(changes, Change{Action: Add, Kind: "group", Name: w.Name})
+		}
+	}
+	node.Groups = groups
+	return changes
+}
+
+func indexGroup(groups []config.Group, name string) int {
+	for i := range groups {
+		if groups[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func reconcileHooks(node *config.Node, want []config.Hook, opts Options) []Change {
+	var changes []Change
+	var hooks []config.Hook
+	for _, hook := range node.Hooks {
+		i := indexHook(want, hook.Name)
+		if i < 0 {
+			if opts.Prune {
+				changes = append(changes, Change{Action: Delete, Kind: "hook", Name: hook.Name})
+				continue
+			}
+			hooks = append(hooks, hook)
+			continue
+		}
+		var fields []string
+		if !equal(hook.Events, want[i].Events) {
+			fields = append(fields, "events")
+		}
+		if !equal(hook.Command, want[i].Command) {
+			fields = append(fields, "command")
+		}
+		if hook.URL != want[i].URL {
+			fields = append(fields, "url")
+		}
+		if hook.Timeout != want[i].Timeout {
+			fields = append(fields, "timeout")
+		}
+		if hook.Debounce != want[i].Debounce {
+			fields = append(fields, "debounce")
+		}
+		if len(fields) > 0 {
+			hook = want[i]
+			changes = append(changes, Change{Action: Update, Kind: "hook", Name: hook.Name, Fields: fields})
+		}
+		hooks = append(hooks, hook)
+	}
+	for _, w := range want {
+		if indexHook(hooks, w.Name) < 0 {
+			hooks = append(hooks, w)
+			changes = append(changes, Change{Action: Add, Kind: "hook", Name: w.Name})
+		}
+	}
+	node.Hooks = hooks
+	return changes
+}
+
+func indexHook(hooks []config.Hook, name string) int {
+	for i := range hooks {
+		if hooks[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// newMetadata returns the metadata of a client or remote added by
+// reconciliation.
+func newMetadata(notes string, labels map[string]string, opts Options) config.Metadata {
+	m := config.Metadata{
+		CreatedBy: opts.Actor,
+		Notes:     notes,
+		Labels:    labels,
+	}
+	if !opts.Now.IsZero() {
+		now := opts.Now.UTC().Round(time.Second)
+		m.CreatedAt = &now
+	}
+	return m
+}
+
+// updateMetadata sets the notes and labels of m, appending the names of those
+// which changed to fields. When and by whom it was created are kept.
+func updateMetadata(m *config.Metadata, notes string, labels map[string]string, fields []string) []string {
+	if m.Notes != notes {
+		m.Notes = notes
+		fields = append(fields, "notes")
+	}
+	if !equal(m.Labels, labels) {
+		m.Labels = labels
+		fields = append(fields, "labels")
+	}
+	return fields
+}
+
+func timesEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// equal returns whether two slices or two maps are equal, treating nil and
+// empty as the same.
+func equal(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Len() == 0 && vb.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Summary counts changes by action, such as "2 to add, 1 to update, 0 to
+// delete".
+func Summary(changes []Change) string {
+	counts := map[Action]int{}
+	for _, c := range changes {
+		counts[c.Action]++
+	}
+	return fmt.Sprintf("%d to add, %d to update, %d to delete",
+		counts[Add], counts[Update], counts[Delete])
+}
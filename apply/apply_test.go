@@ -0,0 +1,149 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apply
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+const testSpec = `
+[[Exports]]
+LocalAddr = "127.0.0.1:22"
+Port = 22
+
+[[Clients]]
+Name = "laptop"
+Notes = "Alice's laptop"
+
+[[Clients]]
+Name = "phone"
+
+[[Remotes]]
+Name = "server"
+Address = "abcdefghijklmnop.onion"
+Auth = "token"
+  [[Remotes.Imports]]
+  LocalAddr = "127.0.0.1"
+  LocalPort = 8022
+  RemotePort = 22
+`
+
+func TestParse(t *testing.T) {
+	spec, err := Parse([]byte(testSpec))
+	assert.NoError(t, err)
+	assert.Len(t, spec.Exports, 1)
+	assert.Len(t, spec.Clients, 2)
+	assert.Equal(t, 8022, spec.Remotes[0].Imports[0].LocalPort)
+
+	_, err = Parse([]byte("[[Remotes]]\nName = \"server\"\nAdress = \"x.onion\"\n"))
+	assert.Error(t, err)
+}
+
+func TestReconcile(t *testing.T) {
+	spec, err := Parse([]byte(testSpec))
+	assert.NoError(t, err)
+	node := config.Node{
+		Service: config.Service{
+			Exports: []config.Export{{LocalAddr: "127.0.0.1:80", Port: 80}},
+			Clients: []config.Client{
+				{Name: "laptop", Address: "laptop.onion", Auth: "laptop-auth"},
+				{Name: "phone", Address: "phone.onion", Auth: "phone-auth"},
+				{Name: "old", Address: "old.onion", Auth: "old-auth"},
+			},
+		},
+		Remotes: []config.Remote{{Name: "server", Address: "abcdefghijklmnop.onion", Auth: "stale"}},
+	}
+	issued := func(torName string) bool { return torName != "phone" }
+	changes := Reconcile(&node, spec, Options{Issued: issued, Now: time.Now()})
+	assert.Equal(t, []Change{
+		{Action: Add, Kind: "export", Name: "22 -> 127.0.0.1:22"},
+		{Action: Update, Kind: "client", Name: "laptop", Fields: []string{"notes"}},
+		{Action: Update, Kind: "client", Name: "phone", Fields: []string{"credentials"}},
+		{Action: Update, Kind: "remote", Name: "server", Fields: []string{"auth", "imports"}},
+	}, changes)
+	assert.Len(t, node.Service.Exports, 2)
+	assert.Len(t, node.Service.Clients, 3)
+	assert.Equal(t, "", node.Service.Clients[1].Address)
+	assert.Equal(t, "token", node.Remotes[0].Auth)
+
+	// Applying the spec again changes nothing but the credentials, which
+	// are only issued by tor.
+	node.Service.Clients[1].Address = "phone.onion"
+	assert.Empty(t, Reconcile(&node, spec, Options{Issued: func(string) bool { return true }}))
+
+	changes = Reconcile(&node, spec, Options{Prune: true})
+	assert.Equal(t, []Change{
+		{Action: Delete, Kind: "export", Name: "80 -> 127.0.0.1:80"},
+		{Action: Delete, Kind: "client", Name: "old"},
+	}, changes)
+	assert.NoError(t, Check(&node))
+
+	// Exports are updated in place when they are published on the same
+	// port and protocol.
+	spec.Exports[0].LocalAddr = "127.0.0.1:2222"
+	changes = Reconcile(&node, spec, Options{})
+	assert.Equal(t, []Change{
+		{Action: Update, Kind: "export", Name: "22 -> 127.0.0.1:2222", Fields: []string{"local-addr"}},
+	}, changes)
+	assert.Equal(t, []config.Export{{LocalAddr: "127.0.0.1:2222", Port: 22}}, node.Service.Exports)
+	assert.NoError(t, Check(&node))
+}
+
+func TestCheck(t *testing.T) {
+	node := config.Node{
+		Remotes: []config.Remote{{Name: "a"}},
+		Groups:  []config.Group{{Name: "g", Remotes: []string{"a", "b"}}},
+	}
+	assert.Error(t, Check(&node))
+	node.Remotes = append(node.Remotes, config.Remote{Name: "b"})
+	assert.NoError(t, Check(&node))
+	node.Remotes = append(node.Remotes, config.Remote{Name: "g"})
+	assert.Error(t, Check(&node))
+}
+
+func TestCheckPorts(t *testing.T) {
+	node := config.Node{Service: config.Service{
+		Exports: []config.Export{
+			{LocalAddr: "127.0.0.1:22", Port: 22},
+			{LocalAddr: "127.0.0.1:53", Port: 53, Protocol: config.ProtocolUDP},
+		},
+	}}
+	assert.NoError(t, Check(&node))
+
+	node.Service.Exports = append(node.Service.Exports, config.Export{LocalAddr: "127.0.0.1:2222", Port: 22})
+	assert.Error(t, Check(&node))
+	node.Service.Exports = node.Service.Exports[:2]
+
+	node.Service.Exports = append(node.Service.Exports, config.Export{LocalAddr: "127.0.0.1:8080", Port: 80})
+	assert.NoError(t, Check(&node))
+	node.Service.Routes = []config.Route{{PathPrefix: "/", Backend: "127.0.0.1:8081"}}
+	assert.Error(t, Check(&node))
+	node.Service.Exports = node.Service.Exports[:2]
+	assert.NoError(t, Check(&node))
+
+	// The UDP export enables the endpoint.
+	node.Service.Exports = append(node.Service.Exports, config.Export{LocalAddr: "127.0.0.1:9000", Port: config.EndpointPort})
+	assert.Error(t, Check(&node))
+	node.Service.Exports = node.Service.Exports[:2]
+	node.Service.Gateway.Port = 22
+	assert.Error(t, Check(&node))
+	node.Service.Gateway.Port = 1080
+	assert.NoError(t, Check(&node))
+}
@@ -0,0 +1,112 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records operations which change who may access a node, and
+// what it may access, in an append-only log of JSON objects, one per line.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sources of audited operations.
+const (
+	SourceCLI   = "cli"
+	SourceAgent = "agent"
+)
+
+// Entry records an operation.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Actor is the user performing the operation, as user@host.
+	Actor string `json:"actor"`
+	// Source is SourceCLI or SourceAgent.
+	Source string `json:"source"`
+	// Action is what was done, such as "client add".
+	Action string `json:"action"`
+	// Subject names what the action was done to, such as a client.
+	Subject string            `json:"subject,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Path returns the path of the audit log kept with the configuration in
+// configDir.
+func Path(configDir string) string {
+	return filepath.Join(configDir, "audit.log")
+}
+
+// Actor returns the current user, as user@host.
+func Actor() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s@%s", name, host)
+}
+
+// Append appends an entry to the audit log at path, setting its time and
+// actor if they are not set.
+func Append(path string, e *Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Actor == "" {
+		e.Actor = Actor()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open audit log %q", path)
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return errors.Wrapf(err, "failed to write audit log %q", path)
+	}
+	return nil
+}
+
+// Read returns the entries in the audit log at path.
+func Read(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	var entries []Entry
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, n)
+		}
+		entries = append(entries, e)
+	}
+	return entries, errors.WithStack(lines.Err())
+}
@@ -0,0 +1,53 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := Path(dir)
+	assert.Equal(t, filepath.Join(dir, "audit.log"), path)
+
+	err = Append(path, &Entry{Source: SourceCLI, Action: "client add", Subject: "bob",
+		Details: map[string]string{"expires": "2026-12-01T00:00:00Z"}})
+	assert.NoError(t, err)
+	err = Append(path, &Entry{Source: SourceAgent, Action: "client revoke", Subject: "bob"})
+	assert.NoError(t, err)
+
+	entries, err := Read(path)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "client add", entries[0].Action)
+		assert.Equal(t, "2026-12-01T00:00:00Z", entries[0].Details["expires"])
+		assert.NotEmpty(t, entries[0].Actor)
+		assert.False(t, entries[0].Time.IsZero())
+		assert.Equal(t, SourceAgent, entries[1].Source)
+	}
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,363 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup bundles a node's configuration and onion service keys into
+// an archive, and restores them, possibly on a different host.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/audit"
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/secrets"
+)
+
+// Version is the archive format version.
+const Version = 1
+
+// Names of entries in the archive.
+const (
+	manifestName = "manifest.json"
+	configName   = "config.toml"
+	auditName    = "audit.log"
+	secretsName  = "secrets"
+	servicesDir  = "services"
+	rotationDir  = "rotation"
+)
+
+// Manifest describes the archive.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Actor   string    `json:"actor"`
+	// ConfigDir is the directory of the configuration which was backed up.
+	// Paths under it are moved to the directory of the restored
+	// configuration.
+	ConfigDir string `json:"config_dir"`
+}
+
+// Write writes an archive of the configuration, its audit log, its secrets
+// file if it has one, and the onion service keys, including a previous key
+// during a rotation, to w. Secrets kept by a command are not included.
+func Write(w io.Writer, cfg *config.Config) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(&Manifest{
+		Version:   Version,
+		Created:   time.Now().UTC().Round(time.Second),
+		Actor:     audit.Actor(),
+		ConfigDir: cfg.Dir,
+	}, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeEntry(tw, manifestName, manifest); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeFile(tw, configName, cfg.Path); err != nil {
+		return errors.WithStack(err)
+	}
+	err = writeFile(tw, auditName, audit.Path(cfg.Dir))
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return errors.WithStack(err)
+	}
+	switch cfg.Node.Secrets.Backend {
+	case config.SecretsFile, config.SecretsEncryptedFile:
+		err = writeFile(tw, secretsName, secrets.FilePath(cfg))
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return errors.WithStack(err)
+		}
+	}
+	if err := writeDir(tw, servicesDir, cfg.Node.Agent.TorServicesDir); err != nil {
+		return errors.WithStack(err)
+	}
+	if rotation := cfg.Node.Service.Rotation; rotation != nil && !rotation.IsRetired(time.Now()) {
+		if err := writeDir(tw, rotationDir, rotation.Dir); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(gz.Close())
+}
+
+func writeEntry(tw *tar.Writer, name string, contents []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tw.Write(contents)
+	return errors.WithStack(err)
+}
+
+func writeFile(tw *tar.Writer, name, fpath string) error {
+	contents, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return writeEntry(tw, name, contents)
+}
+
+// writeDir writes the regular files in dir to the archive, under prefix.
+func writeDir(tw *tar.Writer, prefix, dir string) error {
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %q", fpath)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return writeFile(tw, path.Join(prefix, filepath.ToSlash(rel)), fpath)
+	})
+}
+
+// Archive is the contents of a backup.
+type Archive struct {
+	Manifest Manifest
+	Config   []byte
+	Audit    []byte
+	Secrets  []byte
+	// Services and Rotation are the files of the onion service key and a
+	// previous key, keyed by slash-separated paths relative to their
+	// directories.
+	Services map[string][]byte
+	Rotation map[string][]byte
+}
+
+// Read reads an archive written by Write.
+func Read(r io.Reader) (*Archive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "not a backup archive")
+	}
+	a := &Archive{
+		Services: map[string][]byte{},
+		Rotation: map[string][]byte{},
+	}
+	var haveManifest bool
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read backup archive")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, errors.Errorf("invalid path %q in backup archive", hdr.Name)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read backup archive")
+		}
+		switch {
+		case name == manifestName:
+			if err := json.Unmarshal(contents, &a.Manifest); err != nil {
+				return nil, errors.Wrap(err, "invalid backup manifest")
+			}
+			haveManifest = true
+		case name == configName:
+			a.Config = contents
+		case name == auditName:
+			a.Audit = contents
+		case name == secretsName:
+			a.Secrets = contents
+		case strings.HasPrefix(name, servicesDir+"/"):
+			a.Services[strings.TrimPrefix(name, servicesDir+"/")] = contents
+		case strings.HasPrefix(name, rotationDir+"/"):
+			a.Rotation[strings.TrimPrefix(name, rotationDir+"/")] = contents
+		}
+	}
+	if !haveManifest || a.Config == nil {
+		return nil, errors.New("incomplete backup archive")
+	}
+	if a.Manifest.Version > Version {
+		return nil, errors.Errorf("backup archive version %d is newer than supported", a.Manifest.Version)
+	}
+	return a, nil
+}
+
+// Restore restores the archive to a configuration at cfgPath, moving paths
+// in the configuration which were under the original configuration's
+// directory to cfgPath's. Tor's files, onion service keys and the secrets
+// file are only restored under cfgPath's directory; paths elsewhere are
+// replaced with their defaults for cfgPath. A previous key is restored
+// alongside the current one. An existing configuration or secrets file, or a
+// key directory which is not empty, is only replaced if force is true.
+func Restore(a *Archive, cfgPath string, force bool) (*config.Config, error) {
+	if _, err := os.Stat(cfgPath); err == nil && !force {
+		return nil, errors.Errorf("%q already exists", cfgPath)
+	}
+	cfg, err := config.Parse(a.Config, cfgPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defaults, err := config.Parse(nil, cfgPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	agentCfg := &cfg.Node.Agent
+	for _, p := range []*string{&agentCfg.TorDataDir, &agentCfg.TorrcPath, &agentCfg.TorServicesDir, &cfg.Node.Secrets.Path} {
+		*p = rebase(*p, a.Manifest.ConfigDir, cfg.Dir)
+	}
+	// The archive cannot be trusted to name where files are written.
+	if !within(agentCfg.TorDataDir, cfg.Dir) {
+		agentCfg.TorDataDir = defaults.Node.Agent.TorDataDir
+	}
+	if !within(agentCfg.TorrcPath, cfg.Dir) {
+		agentCfg.TorrcPath = defaults.Node.Agent.TorrcPath
+	}
+	if !within(agentCfg.TorServicesDir, cfg.Dir) {
+		agentCfg.TorServicesDir = defaults.Node.Agent.TorServicesDir
+	}
+	if cfg.Node.Secrets.Path != "" && !within(cfg.Node.Secrets.Path, cfg.Dir) {
+		cfg.Node.Secrets.Path = defaults.Node.Secrets.Path
+	}
+	dirs := map[string]map[string][]byte{agentCfg.TorServicesDir: a.Services}
+	if rotation := cfg.Node.Service.Rotation; rotation != nil {
+		if len(a.Rotation) == 0 {
+			// The previous key had been retired when the backup was made.
+			cfg.Node.Service.Rotation = nil
+		} else {
+			// Named as 'service rotate' names it.
+			rotation.Dir = fmt.Sprintf("%s-%s", agentCfg.TorServicesDir,
+				rotation.Started.UTC().Format("20060102T150405"))
+			dirs[rotation.Dir] = a.Rotation
+		}
+	}
+	if !force {
+		if a.Secrets != nil {
+			secretsPath := secrets.FilePath(cfg)
+			if _, err := os.Stat(secretsPath); err == nil {
+				return nil, errors.Errorf("%q already exists", secretsPath)
+			}
+		}
+		for dir := range dirs {
+			names, err := ioutil.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "failed to read %q", dir)
+			}
+			if len(names) > 0 {
+				return nil, errors.Errorf("%q is not empty", dir)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory %q", cfg.Dir)
+	}
+	for dir, files := range dirs {
+		if err := restoreDir(dir, files); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if a.Audit != nil {
+		auditPath := audit.Path(cfg.Dir)
+		if err := ioutil.WriteFile(auditPath, a.Audit, 0600); err != nil {
+			return nil, errors.Wrapf(err, "failed to write %q", auditPath)
+		}
+	}
+	if a.Secrets != nil {
+		secretsPath := secrets.FilePath(cfg)
+		if err := os.MkdirAll(filepath.Dir(secretsPath), 0700); err != nil {
+			return nil, errors.Wrapf(err, "failed to create directory %q", filepath.Dir(secretsPath))
+		}
+		if err := ioutil.WriteFile(secretsPath, a.Secrets, 0600); err != nil {
+			return nil, errors.Wrapf(err, "failed to write %q", secretsPath)
+		}
+	}
+	if err := config.WriteFile(cfg, cfgPath); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cfg, nil
+}
+
+// within returns whether p is dir or under it.
+func within(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// rebase moves p from under oldDir to under newDir, if it is under oldDir.
+func rebase(p, oldDir, newDir string) string {
+	if oldDir == "" || p == "" {
+		return p
+	}
+	if !within(p, oldDir) {
+		return p
+	}
+	rel, _ := filepath.Rel(oldDir, p)
+	return filepath.Join(newDir, rel)
+}
+
+// restoreDir replaces the files in dir with files, readable only by the
+// owner, as tor requires. Subdirectories of dir are left alone.
+func restoreDir(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory %q", dir)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %q", dir)
+	}
+	for _, info := range existing {
+		if info.IsDir() {
+			continue
+		}
+		fpath := filepath.Join(dir, info.Name())
+		if err := os.Remove(fpath); err != nil {
+			return errors.Wrapf(err, "failed to remove %q", fpath)
+		}
+	}
+	for name, contents := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+			return errors.Wrapf(err, "failed to create directory %q", filepath.Dir(fpath))
+		}
+		if err := ioutil.WriteFile(fpath, contents, 0600); err != nil {
+			return errors.Wrapf(err, "failed to write %q", fpath)
+		}
+	}
+	return nil
+}
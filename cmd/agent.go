@@ -15,7 +15,17 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
 )
 
 // agentCmd represents the agent command
@@ -27,3 +37,43 @@ var agentCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(agentCmd)
 }
+
+// agentAPIGet requests path from the running agent's API, decoding the JSON
+// response into v.
+func agentAPIGet(cfg *config.Config, path string, v interface{}) error {
+	return agentAPIGetTimeout(cfg, path, 10*time.Second, v)
+}
+
+// agentAPIGetTimeout is agentAPIGet, for requests which may take longer.
+func agentAPIGetTimeout(cfg *config.Config, path string, timeout time.Duration, v interface{}) error {
+	req, err := agentAPIRequest(cfg, path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to contact agent; is 'ormesh agent run' running?")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("agent: %s: %s", resp.Status, body)
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
+
+// agentAPIRequest returns a request for path from the running agent's API,
+// bearing the agent's API token.
+func agentAPIRequest(cfg *config.Config, path string) (*http.Request, error) {
+	token, err := agent.ReadAPIToken(cfg.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read agent api token; is 'ormesh agent run' running?")
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", cfg.Node.Agent.APIAddr, path), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
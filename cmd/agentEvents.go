@@ -0,0 +1,97 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
+)
+
+var (
+	agentEventsTypes []string
+	agentEventsJSON  bool
+)
+
+// agentEventsCmd represents the agentEvents command
+var agentEventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Stream tor events from the running agent",
+	Long: `Stream tor events from the running agent until interrupted: circuit builds,
+descriptor uploads and fetches, and stream attachments concerning this node's
+onion service or its remotes, and tor's client status.
+
+With --json, each event is printed as a JSON object on its own line.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			req, err := agentAPIRequest(cfg, "/events?"+
+				url.Values{"type": {strings.Join(agentEventsTypes, ",")}}.Encode())
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return errors.Wrap(err, "failed to contact agent; is 'ormesh agent run' running?")
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := ioutil.ReadAll(resp.Body)
+				return errors.Errorf("agent: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+			}
+			dec := json.NewDecoder(resp.Body)
+			enc := json.NewEncoder(os.Stdout)
+			for {
+				var ev agent.TorEvent
+				err := dec.Decode(&ev)
+				if err == io.EOF {
+					return errors.New("agent closed the event stream")
+				} else if err != nil {
+					return errors.WithStack(err)
+				}
+				if agentEventsJSON {
+					if err := enc.Encode(&ev); err != nil {
+						return errors.WithStack(err)
+					}
+					continue
+				}
+				subject := ev.Subject
+				if subject == "" {
+					subject = "tor"
+				}
+				fmt.Printf("%s  %-13s  %-20s  %s\n",
+					ev.Time.Format("15:04:05"), ev.Type, subject, ev.String())
+			}
+		})
+	},
+}
+
+func init() {
+	agentEventsCmd.Flags().StringSliceVarP(&agentEventsTypes, "type", "", agent.EventTypes,
+		"Event types to stream: "+strings.Join(agent.EventTypes, ", "))
+	agentEventsCmd.Flags().BoolVarP(&agentEventsJSON, "json", "", false, "Print events as JSON")
+	agentCmd.AddCommand(agentEventsCmd)
+}
@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -37,23 +38,25 @@ privileged ports (<1024).`,
 		if err != nil {
 			log.Fatalf("%v", err)
 		}
+		var setcap *exec.Cmd
 		if os.Getuid() == 0 {
-			cmd := exec.Command("setcap", "cap_net_bind_service=+ep", binaryPath)
-			err := cmd.Run()
-			if err != nil {
-				log.Fatalf("setcap failed: %v", err)
-			}
+			setcap = exec.Command("setcap", "cap_net_bind_service=+ep", binaryPath)
 		} else {
-			cmd := exec.Command("/bin/sh", "-c",
+			setcap = exec.Command("/bin/sh", "-c",
 				fmt.Sprintf("sudo setcap 'cap_net_bind_service=+ep' %s", binaryPath))
-			err := cmd.Run()
-			if err != nil {
-				log.Fatalf("setcap failed: %v", err)
-			}
+		}
+		if dryRun {
+			fmt.Printf("dry run; would run: %s\n", strings.Join(setcap.Args, " "))
+			return
+		}
+		err = setcap.Run()
+		if err != nil {
+			log.Fatalf("setcap failed: %v", err)
 		}
 	},
 }
 
 func init() {
 	agentCmd.AddCommand(agentPrivbindCmd)
+	addDryRunFlag(agentPrivbindCmd)
 }
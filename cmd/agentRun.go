@@ -18,6 +18,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -26,7 +27,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/apply"
 	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/logging"
 )
 
 // agentRunCmd represents the agentRun command
@@ -36,44 +39,65 @@ var agentRunCmd = &cobra.Command{
 	Long: `The agent launches and operate a tor subprocess, implementing the configured
 service policies. Configuration is automatically refreshed and applied when the
 ormesh configuration file is modified or a SIGHUP received. This command will
-not exit until an interrupt signal is received or an error is encountered.`,
+not exit until an interrupt signal is received or an error is encountered.
+
+With --dry-run, the tor control commands the agent would issue at start, and
+the tor options in effect afterwards, are printed instead.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if exportsValue := os.Getenv("ORMESH_EXPORTS"); exportsValue != "" {
-			exports := strings.Split(exportsValue, ";")
-			for i := range exports {
-				exportArgs := strings.Split(exports[i], " ")
-				exportAddCmd.Run(exportAddCmd, exportArgs)
+		withConfig(func(cfg *config.Config) error {
+			spec, err := envSpec(cfg)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-		}
-		if clientsValue := os.Getenv("ORMESH_CLIENTS"); clientsValue != "" {
-			clients := strings.Split(clientsValue, ";")
-			for i := range clients {
-				clientAddCmd.Run(clientAddCmd, []string{clients[i]})
+			if spec != nil && dryRun {
+				// The tor configuration printed below includes the
+				// changes, so only they are printed here.
+				changes, err := planSpec(cfg, spec, false)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				printChanges(changes)
+			} else if spec != nil {
+				err = applySpec(cfg, spec, "environment", false)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			err = resolveSecrets(cfg)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if dryRun {
+				printTorConfig(os.Stdout, nil, cfg)
+				return nil
+			}
+			err = configureLogging(&cfg.Node.Agent)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-		}
-		withConfig(func(cfg *config.Config) error {
 			a, err := agent.New(cfg)
 			if err != nil {
 				return errors.Wrap(err, "failed to initialize agent")
 			}
+			store, err := openSecrets(cfg)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			a.SetSecretStore(store)
 			err = a.Start()
 			if err != nil {
 				return errors.Wrap(err, "failed to start agent")
 			}
 			defer a.Stop()
+			err = a.StartListeners()
+			if err != nil {
+				return errors.Wrap(err, "failed to start agent listeners")
+			}
 
-			refresh := func(cfg *config.Config) error {
-				err = a.UpdateServices(&cfg.Node.Service)
-				if err != nil {
-					return errors.Wrap(err, "failed to configure hidden services")
-				}
-				err = a.UpdateRemotes(&cfg.Node)
-				if err != nil {
-					return errors.Wrap(err, "failed to configure remotes")
-				}
-				return nil
+			err = a.Configure(&cfg.Node)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-			refresh(cfg)
 
 			if cfg.Node.Agent.UseTorBrowser {
 				var nImports int
@@ -107,7 +131,7 @@ not exit until an interrupt signal is received or an error is encountered.`,
 				case s := <-exitSignal:
 					return errors.Errorf("exit on signal %v", s)
 				case <-refreshSignal:
-					err = refresh(cfg)
+					err = a.Configure(&cfg.Node)
 					if err != nil {
 						return errors.WithStack(err)
 					}
@@ -117,8 +141,16 @@ not exit until an interrupt signal is received or an error is encountered.`,
 						if err != nil {
 							return errors.WithStack(err)
 						}
+						err = resolveSecrets(cfg)
+						if err != nil {
+							return errors.WithStack(err)
+						}
 						log.Printf("configuration changed")
-						err = refresh(cfg)
+						err = configureLogging(&cfg.Node.Agent)
+						if err != nil {
+							return errors.WithStack(err)
+						}
+						err = a.Configure(&cfg.Node)
 						if err != nil {
 							return errors.WithStack(err)
 						}
@@ -129,6 +161,73 @@ not exit until an interrupt signal is received or an error is encountered.`,
 	},
 }
 
+// envSpec returns a spec of the exports and clients in the ORMESH_EXPORTS
+// and ORMESH_CLIENTS environment variables, or nil if neither is set. Each is
+// a list separated by ";", of exports as "[bind addr:]port [port]", and of
+// client names. Clients which already exist are left as they are.
+func envSpec(cfg *config.Config) (*apply.Spec, error) {
+	exportsValue, clientsValue := os.Getenv("ORMESH_EXPORTS"), os.Getenv("ORMESH_CLIENTS")
+	if exportsValue == "" && clientsValue == "" {
+		return nil, nil
+	}
+	var spec apply.Spec
+	for _, exportValue := range strings.Split(exportsValue, ";") {
+		fields := strings.Fields(exportValue)
+		if len(fields) == 0 {
+			continue
+		}
+		export := config.Export{LocalAddr: fields[0]}
+		if len(fields) > 1 {
+			port, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, errors.Errorf("invalid port %q in ORMESH_EXPORTS", fields[1])
+			}
+			export.Port = port
+		}
+		spec.Exports = append(spec.Exports, export)
+	}
+	for _, clientName := range strings.Split(clientsValue, ";") {
+		clientName = strings.TrimSpace(clientName)
+		if clientName == "" {
+			continue
+		}
+		client := apply.Client{Name: clientName}
+		for _, existing := range cfg.Node.Service.Clients {
+			if existing.Name == clientName {
+				client.Expires, client.Notes, client.Labels = existing.Expires, existing.Notes, existing.Labels
+			}
+		}
+		spec.Clients = append(spec.Clients, client)
+	}
+	return &spec, nil
+}
+
+// configureLogging applies the agent's log level and format, and sends the
+// standard library logger's output through the leveled logger.
+func configureLogging(agentCfg *config.Agent) error {
+	level := logging.Info
+	if agentCfg.LogLevel != "" {
+		var err error
+		level, err = logging.ParseLevel(agentCfg.LogLevel)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	switch agentCfg.LogFormat {
+	case "", "text":
+		logging.Default().SetJSON(false)
+	case "json":
+		logging.Default().SetJSON(true)
+	default:
+		return errors.Errorf("invalid log format %q", agentCfg.LogFormat)
+	}
+	logging.Default().SetLevel(level)
+	log.SetFlags(0)
+	log.SetOutput(logging.Component("ormesh").Writer(logging.Info))
+	return nil
+}
+
 func init() {
 	agentCmd.AddCommand(agentRunCmd)
+	addDryRunFlag(agentRunCmd)
 }
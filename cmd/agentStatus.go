@@ -0,0 +1,100 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
+)
+
+var agentStatusJSON bool
+
+// agentStatusCmd represents the agentStatus command
+var agentStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the running agent's status",
+	Long: `Show tor's bootstrap progress, and counters for each import forwarded by the
+running agent: connections, bytes forwarded, connections closed by timeouts,
+and failed connection attempts to remotes by reason.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			var st agent.Status
+			if err := agentAPIGet(cfg, "/status", &st); err != nil {
+				return errors.WithStack(err)
+			}
+			if agentStatusJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return errors.WithStack(enc.Encode(&st))
+			}
+			fmt.Printf("tor bootstrap: %d%% (%s)\n", st.Bootstrap.Progress, st.Bootstrap.Summary)
+			if st.TorRestarts > 0 {
+				fmt.Printf("tor restarts: %d\n", st.TorRestarts)
+			}
+			if st.Descriptor.Uploads > 0 || st.Descriptor.Failures > 0 {
+				fmt.Printf("descriptor uploads: %d uploaded, %d failed", st.Descriptor.Uploads, st.Descriptor.Failures)
+				if !st.Descriptor.LastUpload.IsZero() {
+					fmt.Printf(", last uploaded %s", st.Descriptor.LastUpload.Format(time.RFC3339))
+				}
+				fmt.Println()
+			}
+			for _, imp := range st.Imports {
+				fmt.Printf("\nimport %s:%d on %s\n", imp.Remote, imp.RemotePort, imp.LocalAddr)
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+				fmt.Fprintf(w, "  connections:\t%d accepted, %d connected, %d active, %d failed, %d rejected\n",
+					imp.Accepted, imp.Connected, imp.Active, imp.Failed, imp.Rejected)
+				fmt.Fprintf(w, "  bytes:\t%d sent, %d received\n", imp.BytesSent, imp.BytesReceived)
+				fmt.Fprintf(w, "  timeouts:\t%d idle, %d lifetime\n", imp.IdleTimeouts, imp.LifetimeTimeouts)
+				if len(imp.DialErrors) > 0 {
+					fmt.Fprintf(w, "  dial errors:\t%s\n", formatCounts(imp.DialErrors))
+				}
+				if err := w.Flush(); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			return nil
+		})
+	},
+}
+
+func formatCounts(counts map[string]uint64) string {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, counts[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func init() {
+	agentStatusCmd.Flags().BoolVarP(&agentStatusJSON, "json", "", false, "Print status as JSON")
+	agentCmd.AddCommand(agentStatusCmd)
+}
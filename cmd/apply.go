@@ -0,0 +1,366 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/apply"
+	"github.com/cmars/ormesh/audit"
+	"github.com/cmars/ormesh/config"
+)
+
+var (
+	applyFile  string
+	applyPrune bool
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply -f <file>",
+	Short: "Reconcile the configuration with a mesh file",
+	Long: `Change the configuration to match a mesh file, which describes the exports,
+HTTP routes, clients, remotes and their imports, groups and hooks the node
+should have, in the same TOML format as the configuration.
+
+Each client, remote, group or hook in the file fully describes it; one which
+differs from the configuration is updated to match. Those not in the file are
+kept, unless --prune is given. Clients added, or whose credentials tor no
+longer has, are issued credentials, which are printed.
+
+The changes are printed before they are made. With --dry-run, they are only
+printed, along with the tor configuration the agent would apply. Applying the
+same file again changes nothing.`,
+	Example: `
+  $ cat node.toml
+  [[Exports]]
+  LocalAddr = "127.0.0.1:22"
+
+  [[Clients]]
+  Name = "laptop"
+
+  [[Remotes]]
+  Name = "server"
+  Address = "abcdefghijklmnop.onion"
+  Auth = "Y5Cfw7A5RhP8Rd7xGYfD8N4oyEBpBWNR+6Qkgrbepk0="
+    [[Remotes.Imports]]
+    RemotePort = 22
+    LocalPort = 8022
+
+  $ ormesh apply -f node.toml --dry-run
+  + export 22 -> 127.0.0.1:22
+  + client laptop
+  + remote server
+  3 to add, 0 to update, 0 to delete`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			if applyFile == "" {
+				return errors.New("--file is required")
+			}
+			spec, err := apply.ReadFile(applyFile)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return applySpec(cfg, spec, applyFile, applyPrune)
+		})
+	},
+}
+
+// applySpec reconciles the configuration with spec, printing the changes,
+// and unless in a dry run, makes them. source names where the spec came from
+// in the audit log.
+func applySpec(cfg *config.Config, spec *apply.Spec, source string, prune bool) error {
+	changes, err := planSpec(cfg, spec, prune)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	printChanges(changes)
+	if len(changes) == 0 {
+		return nil
+	}
+	if dryRun {
+		return errors.WithStack(printDryRun(cfg))
+	}
+	err = issueSpecClients(cfg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = writeConfig(cfg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	counts := map[apply.Action]int{}
+	for _, change := range changes {
+		counts[change.Action]++
+	}
+	err = audit.Append(audit.Path(cfg.Dir), &audit.Entry{
+		Source:  audit.SourceCLI,
+		Action:  "apply",
+		Subject: source,
+		Details: map[string]string{
+			"added":   strconv.Itoa(counts[apply.Add]),
+			"updated": strconv.Itoa(counts[apply.Update]),
+			"deleted": strconv.Itoa(counts[apply.Delete]),
+		},
+	})
+	if err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	return nil
+}
+
+// printChanges prints the changes made to reconcile the configuration with a
+// spec, and their summary.
+func printChanges(changes []apply.Change) {
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	summary := apply.Summary(changes)
+	if dryRun {
+		summary += " (dry run)"
+	}
+	fmt.Println(summary)
+}
+
+// planSpec validates spec and reconciles cfg with it, against the client
+// credentials tor has issued. Nothing is written.
+func planSpec(cfg *config.Config, spec *apply.Spec, prune bool) ([]apply.Change, error) {
+	now := time.Now()
+	err := normalizeSpec(spec)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Existing clients may have expired since the spec was written, but
+	// there is no point adding one which has.
+	existing := map[string]bool{}
+	for _, client := range cfg.Node.Service.Clients {
+		existing[client.Name] = true
+	}
+	for _, client := range spec.Clients {
+		if client.Expires != nil && !client.Expires.After(now) && !existing[client.Name] {
+			return nil, errors.Errorf("client %q expires in the past", client.Name)
+		}
+	}
+	err = resolveSecrets(cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	issued, err := agent.IssuedCredentials(cfg.Node.Agent.TorServicesDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	changes := apply.Reconcile(&cfg.Node, spec, apply.Options{
+		Prune:  prune,
+		Now:    now,
+		Actor:  audit.Actor(),
+		Issued: func(torName string) bool { return issued[torName] },
+	})
+	err = apply.Check(&cfg.Node)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return changes, nil
+}
+
+// issueSpecClients issues credentials to the active clients which have none,
+// and prints them.
+func issueSpecClients(cfg *config.Config) error {
+	now := time.Now()
+	var clientNames []string
+	for _, client := range cfg.Node.Service.Clients {
+		if client.Address == "" && !client.IsExpired(now) {
+			clientNames = append(clientNames, client.Name)
+		}
+	}
+	if len(clientNames) == 0 {
+		return nil
+	}
+	err := issueClientAccess(cfg, clientNames)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, client := range cfg.Node.Service.Clients {
+		for _, clientName := range clientNames {
+			if client.Name == clientName {
+				fmt.Printf("%s %s %s\n", client.Name, client.Address, client.Auth)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeSpec validates spec, and fills in defaults the way the
+// corresponding add commands do, so that it compares equal to a
+// configuration made with them.
+func normalizeSpec(spec *apply.Spec) error {
+	for i := range spec.Exports {
+		export := &spec.Exports[i]
+		localAddr, err := NormalizeAddrPort(export.LocalAddr)
+		if err != nil {
+			return errors.Errorf("invalid export address %q", export.LocalAddr)
+		}
+		export.LocalAddr = localAddr
+		if export.Port == 0 {
+			_, portStr, err := net.SplitHostPort(localAddr)
+			if err != nil {
+				return errors.Errorf("invalid export address %q", localAddr)
+			}
+			export.Port, err = strconv.Atoi(portStr)
+			if err != nil {
+				return errors.Errorf("invalid export address %q", localAddr)
+			}
+		}
+		if export.Protocol, err = normalizeProtocol(export.Protocol); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := config.CheckSessionTimeout(export.SessionTimeout.Duration); err != nil {
+			return errors.Wrapf(err, "export %d", export.Port)
+		}
+	}
+	for i := range spec.Routes {
+		route := &spec.Routes[i]
+		if route.Host == "" && route.PathPrefix == "" {
+			return errors.New("routes require a Host or PathPrefix")
+		}
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			return errors.Errorf("invalid path prefix %q", route.PathPrefix)
+		}
+		backend, err := NormalizeAddrPort(route.Backend)
+		if err != nil {
+			return errors.Errorf("invalid backend address %q", route.Backend)
+		}
+		route.Backend = backend
+	}
+	for _, client := range spec.Clients {
+		if !IsValidClientName(client.Name) {
+			return errors.Errorf("invalid client name %q", client.Name)
+		}
+	}
+	for i := range spec.Remotes {
+		remote := &spec.Remotes[i]
+		if !IsValidRemoteName(remote.Name) {
+			return errors.Errorf("invalid remote name %q", remote.Name)
+		}
+		if !strings.HasSuffix(remote.Address, ".onion") {
+			return errors.Errorf("invalid remote addr %q", remote.Address)
+		}
+		if remote.AuthRef != "" {
+			return errors.Errorf("remote %q: AuthRef may not be set; give its Auth", remote.Name)
+		}
+		if err := normalizeImports(remote.Imports); err != nil {
+			return errors.Wrapf(err, "remote %q", remote.Name)
+		}
+	}
+	for i := range spec.Groups {
+		group := &spec.Groups[i]
+		if !IsValidRemoteName(group.Name) {
+			return errors.Errorf("invalid group name %q", group.Name)
+		}
+		if group.Strategy == "" {
+			group.Strategy = config.StrategyFailover
+		}
+		if !config.IsValidStrategy(group.Strategy) {
+			return errors.Errorf("invalid strategy %q", group.Strategy)
+		}
+		if err := normalizeImports(group.Imports); err != nil {
+			return errors.Wrapf(err, "group %q", group.Name)
+		}
+		for _, import_ := range group.Imports {
+			if import_.IsUDP() {
+				return errors.Errorf("group %q: UDP services cannot be imported from a group", group.Name)
+			}
+		}
+	}
+	for i := range spec.Hooks {
+		hook := &spec.Hooks[i]
+		if !IsValidHookName(hook.Name) {
+			return errors.Errorf("invalid hook name %q", hook.Name)
+		}
+		if len(hook.Events) == 0 {
+			return errors.Errorf("hook %q: at least one event is required", hook.Name)
+		}
+		for _, event := range hook.Events {
+			if !config.IsValidHookEvent(event) {
+				return errors.Errorf("hook %q: invalid event %q; events are %s",
+					hook.Name, event, strings.Join(config.HookEvents, ", "))
+			}
+		}
+		if len(hook.Command) == 0 && hook.URL == "" {
+			return errors.Errorf("hook %q: a command or URL is required", hook.Name)
+		}
+		if hook.Timeout.Duration < 0 || hook.Debounce.Duration < 0 {
+			return errors.Errorf("hook %q: Timeout and Debounce must be positive", hook.Name)
+		}
+		if hook.Timeout.Duration == 0 {
+			hook.Timeout.Duration = config.DefaultHookTimeout
+		}
+		if hook.Debounce.Duration == 0 {
+			hook.Debounce.Duration = config.DefaultHookDebounce
+		}
+	}
+	return nil
+}
+
+func normalizeImports(imports []config.Import) error {
+	for i := range imports {
+		import_ := &imports[i]
+		if import_.LocalAddr == "" {
+			import_.LocalAddr = "127.0.0.1"
+		}
+		if import_.LocalPort <= 0 || import_.RemotePort <= 0 {
+			return errors.New("imports require a LocalPort and RemotePort")
+		}
+		var err error
+		if import_.Protocol, err = normalizeProtocol(import_.Protocol); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := config.CheckSessionTimeout(import_.SessionTimeout.Duration); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// normalizeProtocol returns protocol as the add commands record it, where
+// TCP is the default and left empty.
+func normalizeProtocol(protocol string) (string, error) {
+	switch protocol {
+	case "", config.ProtocolTCP:
+		return "", nil
+	case config.ProtocolUDP:
+		return protocol, nil
+	}
+	return "", errors.Errorf("invalid protocol %q", protocol)
+}
+
+func init() {
+	applyCmd.Flags().StringVarP(&applyFile, "file", "f", "", "Mesh file to apply")
+	applyCmd.Flags().BoolVarP(&applyPrune, "prune", "", false, "Delete what is not in the mesh file")
+	RootCmd.AddCommand(applyCmd)
+	addDryRunFlag(applyCmd)
+}
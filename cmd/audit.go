@@ -0,0 +1,160 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/cmars/ormesh/audit"
+	"github.com/cmars/ormesh/config"
+)
+
+var auditJSON bool
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show the audit log",
+	Long: `Show the audit log, which records each client, remote, export, import, group
+and hook added, deleted or rotated, and each backup and restore, when and by
+whom, and clients revoked by the agent when they expire. The log is kept next
+to the configuration file.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			entries, err := audit.Read(audit.Path(cfg.Dir))
+			if os.IsNotExist(errors.Cause(err)) {
+				return nil
+			} else if err != nil {
+				return errors.WithStack(err)
+			}
+			if auditJSON {
+				enc := json.NewEncoder(os.Stdout)
+				for i := range entries {
+					if err := enc.Encode(&entries[i]); err != nil {
+						return errors.WithStack(err)
+					}
+				}
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tACTOR\tSOURCE\tACTION\tSUBJECT\tDETAILS")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339),
+					e.Actor, e.Source, e.Action, e.Subject, formatLabels(e.Details))
+			}
+			return errors.WithStack(w.Flush())
+		})
+	},
+}
+
+// auditedCommands are the names of commands recorded in the audit log.
+var auditedCommands = map[string]bool{
+	"add":     true,
+	"delete":  true,
+	"rotate":  true,
+	"backup":  true,
+	"restore": true,
+	"migrate": true,
+}
+
+// auditedFlags are the names of flags whose values are recorded in the audit
+// log. Other flags, such as --url which may hold a webhook's credentials, are
+// recorded without their values.
+var auditedFlags = map[string]bool{
+	"all":             true,
+	"allow-net":       true,
+	"allow-port":      true,
+	"debounce":        true,
+	"dial-retries":    true,
+	"dial-timeout":    true,
+	"event":           true,
+	"expires":         true,
+	"file":            true,
+	"finish":          true,
+	"force":           true,
+	"grace":           true,
+	"host":            true,
+	"idle-timeout":    true,
+	"label":           true,
+	"max-conns":       true,
+	"max-flows":       true,
+	"max-lifetime":    true,
+	"note":            true,
+	"out":             true,
+	"overlap":         true,
+	"path":            true,
+	"prune":           true,
+	"read-rate":       true,
+	"retry-backoff":   true,
+	"session-timeout": true,
+	"strategy":        true,
+	"strip-prefix":    true,
+	"timeout":         true,
+	"udp":             true,
+	"until":           true,
+	"write-rate":      true,
+}
+
+// auditCommand records a command which has changed the configuration in the
+// audit log. The first argument is recorded as the subject, and flags which
+// were set as details, with the values of those in auditedFlags; other
+// arguments may be secrets, and are not recorded. Dry runs, and commands
+// which left the configuration as it was, are not recorded.
+func auditCommand(cmd *cobra.Command, args []string) {
+	if !auditedCommands[cmd.Name()] || dryRun || !changed {
+		return
+	}
+	e := &audit.Entry{
+		Source: audit.SourceCLI,
+		Action: strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" "),
+	}
+	if len(args) > 0 {
+		e.Subject = args[0]
+	}
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if cmd.LocalFlags().Lookup(f.Name) == nil {
+			return
+		}
+		if e.Details == nil {
+			e.Details = map[string]string{}
+		}
+		if auditedFlags[f.Name] {
+			e.Details[f.Name] = f.Value.String()
+		} else {
+			e.Details[f.Name] = "(redacted)"
+		}
+	})
+	if err := audit.Append(audit.Path(filepath.Dir(cfgFile)), e); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+}
+
+func init() {
+	auditCmd.Flags().BoolVarP(&auditJSON, "json", "", false, "Print entries as JSON")
+	RootCmd.AddCommand(auditCmd)
+	// Commands exit on error, so this only runs for those which succeed.
+	RootCmd.PersistentPostRun = auditCommand
+}
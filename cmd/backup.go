@@ -0,0 +1,122 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/backup"
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/seal"
+)
+
+var (
+	backupOut       string
+	backupRecipient string
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup --out <file>",
+	Short: "Back up the node's configuration and onion service keys",
+	Long: `Write an encrypted backup of the node's configuration, including its remotes
+and clients, its audit log and its onion service keys, which may be restored
+with 'ormesh restore', on this host or another.
+
+The backup is encrypted with a passphrase, read from $ORMESH_PASSPHRASE or
+prompted for, or with --recipient, to a key created by 'ormesh backup keygen'.`,
+	Example: `
+  $ ormesh backup --out node.backup
+
+  Back up unattended to a recipient key, whose identity is kept elsewhere:
+
+  $ ormesh backup keygen --out ~/backup.key
+  ormesh-recipient-hRAcyKX8lp1iBfxNd0nV1bQ0y2pRvN5i0jM0Gk3xWTE
+  $ ormesh backup --recipient ormesh-recipient-hRAcyKX8lp1iBfxNd0nV1bQ0y2pRvN5i0jM0Gk3xWTE --out node.backup`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			if backupOut == "" {
+				return errors.New("--out is required")
+			}
+			var archive bytes.Buffer
+			err := backup.Write(&archive, cfg)
+			if err != nil {
+				return errors.Wrap(err, "failed to create backup")
+			}
+			if cfg.Node.Secrets.Backend == config.SecretsCommand {
+				fmt.Fprintln(os.Stderr, "warning: secrets kept by the secrets command are not included")
+			}
+			var sealed []byte
+			if backupRecipient != "" {
+				recipient, err := readRecipient(backupRecipient)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				sealed, err = seal.ToRecipient(archive.Bytes(), recipient)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			} else {
+				passphrase, err := readPassphrase(backupPassphraseEnv, "Backup passphrase", true)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				sealed, err = seal.WithPassphrase(archive.Bytes(), passphrase)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			if backupOut == "-" {
+				_, err = os.Stdout.Write(sealed)
+				changed = err == nil
+				return errors.WithStack(err)
+			}
+			err = ioutil.WriteFile(backupOut, sealed, 0600)
+			if err != nil {
+				return errors.Wrapf(err, "failed to write %q", backupOut)
+			}
+			changed = true
+			fmt.Printf("wrote %s\n", backupOut)
+			return nil
+		})
+	},
+}
+
+// readRecipient parses a recipient key, or reads one from a file.
+func readRecipient(s string) (*seal.Recipient, error) {
+	if !strings.HasPrefix(s, "ormesh-recipient-") {
+		contents, err := ioutil.ReadFile(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read recipient %q", s)
+		}
+		s = string(contents)
+	}
+	return seal.ParseRecipient(s)
+}
+
+func init() {
+	backupCmd.Flags().StringVarP(&backupOut, "out", "o", "", "Write the backup to this file, or - for standard output")
+	backupCmd.Flags().StringVarP(&backupRecipient, "recipient", "r", "",
+		"Encrypt to this recipient key, or the key in this file, rather than a passphrase")
+	RootCmd.AddCommand(backupCmd)
+}
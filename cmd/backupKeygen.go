@@ -0,0 +1,71 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/seal"
+)
+
+var keygenOut string
+
+// backupKeygenCmd represents the backupKeygen command
+var backupKeygenCmd = &cobra.Command{
+	Use:   "keygen --out <identity file>",
+	Short: "Create a key pair for encrypting backups",
+	Long: `Create an identity file, which decrypts backups made with 'ormesh backup
+--recipient', and print its recipient key. Keep the identity file somewhere
+other than the node it backs up.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := backupKeygen(); err != nil {
+			log.Fatalf("%v", err)
+		}
+	},
+}
+
+func backupKeygen() error {
+	if keygenOut == "" {
+		return errors.New("--out is required")
+	}
+	id, err := seal.NewIdentity()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.OpenFile(keygenOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %q", keygenOut)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "# created: %s\n# recipient: %s\n%s\n",
+		time.Now().UTC().Format(time.RFC3339), id.Recipient(), id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %q", keygenOut)
+	}
+	fmt.Println(id.Recipient())
+	return nil
+}
+
+func init() {
+	backupKeygenCmd.Flags().StringVarP(&keygenOut, "out", "o", "", "Write the identity to this file")
+	backupCmd.AddCommand(backupKeygenCmd)
+}
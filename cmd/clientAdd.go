@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/mdp/qrterminal"
 	"github.com/pkg/errors"
@@ -27,50 +28,106 @@ import (
 	"github.com/cmars/ormesh/config"
 )
 
-var displayQR bool
+var (
+	displayQR     bool
+	clientExpires time.Duration
+	clientUntil   string
+	clientNotes   string
+	clientLabels  []string
+)
 
 // clientAddCmd represents the clientAdd command
 var clientAddCmd = &cobra.Command{
 	Use:   "add <client name>",
 	Short: "Add a client authorization",
 	Long: `Create an auth token allowing a client to access exported services. The token
-should be securely transmitted to the client.`,
+should be securely transmitted to the client.
+
+With --expires or --until, the running agent revokes the client's access when
+it expires.
+
+--note and --label record why the client was added, and are shown by
+'ormesh client show'.`,
 	Example: `
   $ ormesh client add my-MacBook
   Y5Cfw7A5RhP8Rd7xGYfD8N4oyEBpBWNR+6Qkgrbepk0=
 
   Then paste this token as an argument to 'ormesh remote add':
 
-  $ ormesh remote add my-server Y5Cfw7A5RhP8Rd7xGYfD8N4oyEBpBWNR+6Qkgrbepk0=`,
+  $ ormesh remote add my-server Y5Cfw7A5RhP8Rd7xGYfD8N4oyEBpBWNR+6Qkgrbepk0=
+
+  Grant access for three days:
+
+  $ ormesh client add --expires 72h contractor
+
+  Record who a client belongs to:
+
+  $ ormesh client add --note "Alice's laptop" --label team=ops alice-laptop`,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		withConfigForUpdate(func(cfg *config.Config) error {
-			client, err := addClient(cfg, args[0])
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			if displayQR {
-				qrDoc := struct {
-					AuthCookieValue string `json:"auth_cookie_value"`
-					Domain          string `json:"domain"`
-				}{
-					AuthCookieValue: client.Auth,
-					Domain:          client.Address,
-				}
-				qrText, err := json.Marshal(&qrDoc)
+			var expires *time.Time
+			if clientExpires != 0 && clientUntil != "" {
+				return errors.New("--expires and --until are mutually exclusive")
+			} else if clientExpires < 0 {
+				return errors.Errorf("invalid expiry %v", clientExpires)
+			} else if clientExpires > 0 {
+				t := time.Now().Add(clientExpires).Round(time.Second)
+				expires = &t
+			} else if clientUntil != "" {
+				t, err := ParseUntil(clientUntil)
 				if err != nil {
 					return errors.WithStack(err)
 				}
-				qrterminal.Generate(string(qrText), qrterminal.H, os.Stdout)
-			} else {
-				fmt.Printf("%s %s\n", client.Address, client.Auth)
+				if !t.After(time.Now()) {
+					return errors.Errorf("%s is in the past", clientUntil)
+				}
+				expires = &t
+			}
+			metadata, err := newMetadata(clientNotes, clientLabels)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			client, err := addClient(cfg, args[0], expires, &metadata)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-			return nil
+			return printClientAccess(client.Address, client.Auth)
 		})
 	},
 }
 
-func addClient(cfg *config.Config, clientName string) (*config.Client, error) {
+// printClientAccess prints a client's onion address and auth token, or with
+// --qr, a QR code for Orbot. Nothing is issued in a dry run, so there is
+// nothing to print.
+func printClientAccess(address, auth string) error {
+	if dryRun {
+		return nil
+	}
+	if !displayQR {
+		fmt.Printf("%s %s\n", address, auth)
+		return nil
+	}
+	qrDoc := struct {
+		AuthCookieValue string `json:"auth_cookie_value"`
+		Domain          string `json:"domain"`
+	}{
+		AuthCookieValue: auth,
+		Domain:          address,
+	}
+	qrText, err := json.Marshal(&qrDoc)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	qrterminal.Generate(string(qrText), qrterminal.H, os.Stdout)
+	return nil
+}
+
+// addClient authorizes a client, or returns the existing authorization of
+// the named client. The client expires at expires, if not nil. Metadata, if
+// not nil, is recorded for a new client; the notes and labels in it replace
+// those of an existing client, if set.
+func addClient(cfg *config.Config, clientName string, expires *time.Time, metadata *config.Metadata) (*config.Client, error) {
 	if !IsValidClientName(clientName) {
 		return nil, errors.Errorf("invalid client name %q", clientName)
 	}
@@ -86,30 +143,73 @@ func addClient(cfg *config.Config, clientName string) (*config.Client, error) {
 		cfg.Node.Service.Clients = append(cfg.Node.Service.Clients, config.Client{
 			Name: clientName,
 		})
+		if metadata != nil {
+			cfg.Node.Service.Clients[index].Metadata = *metadata
+		}
+	} else if metadata != nil {
+		if metadata.Notes != "" {
+			cfg.Node.Service.Clients[index].Notes = metadata.Notes
+		}
+		if metadata.Labels != nil {
+			cfg.Node.Service.Clients[index].Labels = metadata.Labels
+		}
+	}
+	if expires != nil {
+		cfg.Node.Service.Clients[index].Expires = expires
+	} else if cfg.Node.Service.Clients[index].IsExpired(time.Now()) {
+		return nil, errors.Errorf("client %q has expired; renew it with --expires or --until", clientName)
+	}
+	err := issueClientAccess(cfg, []string{clientName})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &cfg.Node.Service.Clients[index], nil
+}
+
+// issueClientAccess applies the service configuration to tor, and records
+// the address and auth token tor issued to each of the named clients. In a
+// dry run, tor is not started and nothing is issued.
+func issueClientAccess(cfg *config.Config, clientNames []string) error {
+	if dryRun {
+		return nil
 	}
 	a, err := agent.New(cfg)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to initialize agent")
+		return errors.Wrap(err, "failed to initialize agent")
 	}
 	err = a.Start()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to start agent")
+		return errors.Wrap(err, "failed to start agent")
 	}
 	defer a.Stop()
 	err = a.UpdateServices(&cfg.Node.Service)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to update tor hidden services")
+		return errors.Wrap(err, "failed to update tor hidden services")
 	}
-	address, clientAuth, err := a.ClientAccess(clientName)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to read tor client auth")
+	for _, clientName := range clientNames {
+		for i := range cfg.Node.Service.Clients {
+			client := &cfg.Node.Service.Clients[i]
+			if client.Name != clientName {
+				continue
+			}
+			client.Address, client.Auth, err = a.ClientAccess(client.CredentialName())
+			if err != nil {
+				return errors.Wrapf(err, "failed to read tor client auth for %q", clientName)
+			}
+		}
 	}
-	cfg.Node.Service.Clients[index].Address = address
-	cfg.Node.Service.Clients[index].Auth = clientAuth
-	return &cfg.Node.Service.Clients[index], nil
+	return nil
 }
 
 func init() {
 	clientAddCmd.Flags().BoolVarP(&displayQR, "qr", "", false, "Display Orbot client cookie QR code")
+	clientAddCmd.Flags().DurationVarP(&clientExpires, "expires", "", 0,
+		"Revoke the client after this long, such as 72h")
+	clientAddCmd.Flags().StringVarP(&clientUntil, "until", "", "",
+		"Revoke the client at this time, such as 2026-12-01")
+	clientAddCmd.Flags().StringVarP(&clientNotes, "note", "", "", "Notes about the client")
+	clientAddCmd.Flags().StringSliceVarP(&clientLabels, "label", "", nil,
+		"Label the client with key=value; may be repeated")
 	clientCmd.AddCommand(clientAddCmd)
+	addDryRunFlag(clientAddCmd)
 }
@@ -53,4 +53,5 @@ var clientDeleteCmd = &cobra.Command{
 
 func init() {
 	clientCmd.AddCommand(clientDeleteCmd)
+	addDryRunFlag(clientDeleteCmd)
 }
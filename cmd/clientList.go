@@ -16,7 +16,12 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
 	"github.com/cmars/ormesh/config"
@@ -29,14 +34,43 @@ var clientListCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		withConfig(func(cfg *config.Config) error {
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tADDRESS\tEXPIRES\tLABELS")
+			now := time.Now()
 			for _, client := range cfg.Node.Service.Clients {
-				fmt.Printf("%#v\n", client)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", client.Name, client.Address,
+					formatExpiry(&client, now), formatLabels(client.Labels))
 			}
-			return nil
+			return errors.WithStack(w.Flush())
 		})
 	},
 }
 
+// formatExpiry describes when a client expires relative to now.
+func formatExpiry(client *config.Client, now time.Time) string {
+	switch {
+	case client.Expires == nil:
+		return "never"
+	case client.IsExpired(now):
+		return fmt.Sprintf("expired %s ago", formatRemaining(now.Sub(*client.Expires)))
+	}
+	return fmt.Sprintf("in %s (%s)", formatRemaining(client.Expires.Sub(now)),
+		client.Expires.Local().Format("2006-01-02 15:04"))
+}
+
+// formatRemaining formats a duration to the minute, or in days and hours if
+// longer than two days.
+func formatRemaining(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	}
+	d = d.Round(time.Minute)
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	return strings.TrimSuffix(d.String(), "0s")
+}
+
 func init() {
 	clientCmd.AddCommand(clientListCmd)
 }
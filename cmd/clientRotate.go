@@ -0,0 +1,131 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+var rotateGrace time.Duration
+
+// clientRotateCmd represents the clientRotate command
+var clientRotateCmd = &cobra.Command{
+	Use:   "rotate <client name>",
+	Short: "Issue a new client credential",
+	Long: `Issue a new auth token for a client, alongside its current one, so that the
+client keeps working until it is given the new token.
+
+The agent revokes the previous credential when the --grace period ends.`,
+	Example: `
+  $ ormesh client rotate --grace 24h my-MacBook
+  mqo3ldwxj4xh5yxa.onion 2hF0l+8wXkTzqT1Vn9b4aA`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			client, err := rotateClient(cfg, args[0], rotateGrace)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return printClientAccess(client.Next.Address, client.Next.Auth)
+		})
+	},
+}
+
+// rotateClient issues a next credential to the named client, which replaces
+// its current one within grace. A next credential already issued is
+// replaced.
+func rotateClient(cfg *config.Config, clientName string, grace time.Duration) (*config.Client, error) {
+	if grace <= 0 {
+		return nil, errors.Errorf("invalid grace period %v", grace)
+	}
+	var client *config.Client
+	for i := range cfg.Node.Service.Clients {
+		if cfg.Node.Service.Clients[i].Name == clientName {
+			client = &cfg.Node.Service.Clients[i]
+			break
+		}
+	}
+	if client == nil {
+		return nil, errors.Errorf("no such client %q", clientName)
+	}
+	now := time.Now()
+	if client.IsExpired(now) {
+		return nil, errors.Errorf("client %q has expired; renew it with 'ormesh client add'", clientName)
+	}
+	if client.Next != nil {
+		fmt.Fprintf(os.Stderr, "replacing the credential issued to %q at %s\n",
+			clientName, client.Next.Issued.Local().Format("2006-01-02 15:04"))
+	}
+	torName, err := newCredentialName(cfg, clientName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	client.Next = &config.Credential{
+		TorName:   torName,
+		Issued:    now.UTC().Round(time.Second),
+		GraceEnds: now.Add(grace).UTC().Round(time.Second),
+	}
+	err = updateClientAccess(cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return client, nil
+}
+
+// maxCredentialName is the longest client name tor accepts.
+const maxCredentialName = 16
+
+// newCredentialName returns an unused name for a new credential for the
+// named client.
+func newCredentialName(cfg *config.Config, clientName string) (string, error) {
+	used := map[string]bool{}
+	for _, client := range cfg.Node.Service.Clients {
+		used[client.CredentialName()] = true
+		if client.Next != nil {
+			used[client.Next.TorName] = true
+		}
+	}
+	prefix := clientName
+	if len(prefix) > maxCredentialName-5 {
+		prefix = prefix[:maxCredentialName-5]
+	}
+	for {
+		var suffix [2]byte
+		if _, err := rand.Read(suffix[:]); err != nil {
+			return "", errors.WithStack(err)
+		}
+		name := prefix + "-" + hex.EncodeToString(suffix[:])
+		if !used[name] {
+			return name, nil
+		}
+	}
+}
+
+func init() {
+	clientRotateCmd.Flags().DurationVarP(&rotateGrace, "grace", "", 72*time.Hour,
+		"Revoke the previous credential after this long")
+	clientRotateCmd.Flags().BoolVarP(&displayQR, "qr", "", false, "Display Orbot client cookie QR code")
+	clientCmd.AddCommand(clientRotateCmd)
+	addDryRunFlag(clientRotateCmd)
+}
@@ -16,6 +16,8 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -34,9 +36,20 @@ var clientShowCmd = &cobra.Command{
 			if !IsValidClientName(clientName) {
 				return errors.Errorf("invalid client name %q", clientName)
 			}
+			if err := resolveSecrets(cfg); err != nil {
+				return errors.WithStack(err)
+			}
 			for _, client := range cfg.Node.Service.Clients {
 				if client.Name == clientName {
-					fmt.Printf("%#v\n", client)
+					fmt.Printf("name: %s\naddress: %s\nauth: %s\nexpires: %s\n",
+						client.Name, client.Address, client.Auth, formatExpiry(&client, time.Now()))
+					if client.Next != nil {
+						fmt.Printf("next: %s %s (issued %s, replaces the current credential at %s)\n",
+							client.Next.Address, client.Next.Auth,
+							client.Next.Issued.Local().Format("2006-01-02 15:04"),
+							client.Next.GraceEnds.Local().Format("2006-01-02 15:04"))
+					}
+					printMetadata(os.Stdout, &client.Metadata)
 					return nil
 				}
 			}
@@ -0,0 +1,377 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/cmars/orc/control"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
+)
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the environment for problems running the agent",
+	Long: `Check the agent's environment for common problems: the tor binary and its
+version, ports already in use, data directory permissions, a stale tor control
+cookie, permission to listen on privileged ports, and whether Tor Browser is
+running when the agent uses it. Each check passes, warns or fails, with steps
+to fix warnings and failures.
+
+Exits non-zero if any check fails.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			var st agent.Status
+			agentRunning := agentAPIGet(cfg, "/status", &st) == nil
+
+			var checks []doctorCheck
+			if agentRunning {
+				checks = append(checks, doctorCheck{status: checkPass, name: "agent",
+					detail: fmt.Sprintf("running; tor bootstrap %d%%", st.Bootstrap.Progress)})
+			} else {
+				checks = append(checks, doctorCheck{status: checkPass, name: "agent", detail: "not running"})
+			}
+			if cfg.Node.Agent.UseTorBrowser {
+				checks = append(checks, checkTorBrowser(&cfg.Node.Agent)...)
+			} else {
+				checks = append(checks, checkTorBinary(&cfg.Node.Agent)...)
+				checks = append(checks, checkDir("tor data directory", cfg.Node.Agent.TorDataDir))
+			}
+			checks = append(checks, checkDir("onion services directory", cfg.Node.Agent.TorServicesDir))
+			checks = append(checks, checkControlCookie(&cfg.Node.Agent, agentRunning))
+			checks = append(checks, checkPorts(&cfg.Node, agentRunning)...)
+			checks = append(checks, checkPrivilegedPorts(&cfg.Node)...)
+
+			var failed int
+			for _, check := range checks {
+				fmt.Printf("%-4s  %s: %s\n", check.status, check.name, check.detail)
+				if check.fix != "" {
+					fmt.Printf("      fix: %s\n", check.fix)
+				}
+				if check.status == checkFail {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return errors.Errorf("%d checks failed", failed)
+			}
+			return nil
+		})
+	},
+}
+
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// doctorCheck is the result of checking one aspect of the environment, with
+// a remediation if it did not pass.
+type doctorCheck struct {
+	status string
+	name   string
+	detail string
+	fix    string
+}
+
+// Tor versions supported by the agent. ExtendedErrors on the SocksPort was
+// added in 0.4.3; stealth client authorization uses version 2 onion
+// services, which were removed in 0.4.6.
+var (
+	minTorVersion   = []int{0, 4, 3}
+	maxV2TorVersion = []int{0, 4, 6}
+)
+
+var torVersionRE = regexp.MustCompile(`Tor version (\d+)\.(\d+)\.(\d+)`)
+
+// parseTorVersion returns the version numbers in the output of tor
+// --version.
+func parseTorVersion(s string) ([]int, bool) {
+	m := torVersionRE.FindStringSubmatch(s)
+	if m == nil {
+		return nil, false
+	}
+	var version []int
+	for _, part := range m[1:] {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		version = append(version, n)
+	}
+	return version, true
+}
+
+// versionLess returns whether version a is earlier than version b.
+func versionLess(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func formatVersion(version []int) string {
+	s := ""
+	for i, n := range version {
+		if i > 0 {
+			s += "."
+		}
+		s += strconv.Itoa(n)
+	}
+	return s
+}
+
+func checkTorBinary(agentCfg *config.Agent) []doctorCheck {
+	name := "tor binary"
+	path, err := exec.LookPath(agentCfg.TorBinaryPath)
+	if err != nil {
+		return []doctorCheck{{status: checkFail, name: name,
+			detail: fmt.Sprintf("%q not found: %v", agentCfg.TorBinaryPath, err),
+			fix:    "install tor, or set TorBinaryPath in the [Node.Agent] section of the configuration"}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return []doctorCheck{{status: checkFail, name: name,
+			detail: fmt.Sprintf("%s --version failed: %v", path, err),
+			fix:    "check that TorBinaryPath in the [Node.Agent] section of the configuration is tor"}}
+	}
+	version, ok := parseTorVersion(string(out))
+	if !ok {
+		return []doctorCheck{{status: checkWarn, name: name,
+			detail: fmt.Sprintf("%s: unrecognized version %q", path, out)}}
+	}
+	checks := []doctorCheck{{status: checkPass, name: name,
+		detail: fmt.Sprintf("%s, version %s", path, formatVersion(version))}}
+	if versionLess(version, minTorVersion) {
+		checks[0].status = checkFail
+		checks[0].detail += fmt.Sprintf(", older than the minimum supported version %s", formatVersion(minTorVersion))
+		checks[0].fix = "upgrade tor, for example from https://support.torproject.org/apt/"
+	} else if !versionLess(version, maxV2TorVersion) {
+		checks[0].status = checkWarn
+		checks[0].detail += ", which does not support client authorization with 'ormesh client add'"
+		checks[0].fix = fmt.Sprintf("use a tor release earlier than %s to authorize clients", formatVersion(maxV2TorVersion))
+	}
+	return checks
+}
+
+func checkTorBrowser(agentCfg *config.Agent) []doctorCheck {
+	name := "tor browser"
+	conn, err := net.DialTimeout("tcp", agentCfg.ControlAddr, 2*time.Second)
+	if err != nil {
+		return []doctorCheck{{status: checkFail, name: name,
+			detail: fmt.Sprintf("not running; nothing is listening on control port %s", agentCfg.ControlAddr),
+			fix:    "start Tor Browser and leave it running while the agent runs"}}
+	}
+	conn.Close()
+	return []doctorCheck{{status: checkPass, name: name,
+		detail: fmt.Sprintf("running, control port %s", agentCfg.ControlAddr)}}
+}
+
+func checkDir(name, dir string) doctorCheck {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return doctorCheck{status: checkPass, name: name,
+			detail: fmt.Sprintf("%s will be created when the agent starts", dir)}
+	} else if err != nil {
+		return doctorCheck{status: checkFail, name: name, detail: err.Error(),
+			fix: fmt.Sprintf("check the permissions of %s and its parent directories", dir)}
+	}
+	if !info.IsDir() {
+		return doctorCheck{status: checkFail, name: name,
+			detail: fmt.Sprintf("%s is not a directory", dir),
+			fix:    fmt.Sprintf("remove or rename %s", dir)}
+	}
+	f, err := ioutil.TempFile(dir, ".ormesh-doctor")
+	if err != nil {
+		return doctorCheck{status: checkFail, name: name,
+			detail: fmt.Sprintf("%s is not writable: %v", dir, err),
+			fix:    fmt.Sprintf("chown -R %s %s", currentUser(), dir)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if info.Mode().Perm()&0077 != 0 {
+		return doctorCheck{status: checkWarn, name: name,
+			detail: fmt.Sprintf("%s is accessible to other users (mode %#o); tor may refuse to use it", dir, info.Mode().Perm()),
+			fix:    fmt.Sprintf("chmod 700 %s", dir)}
+	}
+	return doctorCheck{status: checkPass, name: name, detail: dir}
+}
+
+func currentUser() string {
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+func checkControlCookie(agentCfg *config.Agent, agentRunning bool) doctorCheck {
+	name := "tor control cookie"
+	cookiePath := filepath.Join(agentCfg.TorDataDir, "control_auth_cookie")
+	if agentCfg.UseTorBrowser && agentCfg.ControlCookie != "" {
+		cookiePath = agentCfg.ControlCookie
+	}
+	cookie, err := ioutil.ReadFile(cookiePath)
+	if os.IsNotExist(err) {
+		if agentCfg.UseTorBrowser {
+			return doctorCheck{status: checkFail, name: name,
+				detail: fmt.Sprintf("%s not found", cookiePath),
+				fix:    "start Tor Browser, or set ControlCookie in the [Node.Agent] section of the configuration"}
+		}
+		return doctorCheck{status: checkPass, name: name,
+			detail: fmt.Sprintf("%s will be created when tor starts", cookiePath)}
+	} else if err != nil {
+		return doctorCheck{status: checkFail, name: name, detail: err.Error(),
+			fix: fmt.Sprintf("check the permissions of %s", cookiePath)}
+	}
+
+	netConn, err := net.DialTimeout("tcp", agentCfg.ControlAddr, 2*time.Second)
+	if err != nil {
+		if agentCfg.UseTorBrowser || agentRunning {
+			return doctorCheck{status: checkFail, name: name,
+				detail: fmt.Sprintf("cannot connect to control port %s: %v", agentCfg.ControlAddr, err),
+				fix:    "check ControlAddr in the [Node.Agent] section of the configuration"}
+		}
+		return doctorCheck{status: checkWarn, name: name,
+			detail: fmt.Sprintf("%s is left over from a previous run of tor", cookiePath),
+			fix:    fmt.Sprintf("if the agent fails to authenticate to tor when starting, remove %s", cookiePath)}
+	}
+	defer netConn.Close()
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := control.Client(netConn).AuthCookie(cookie); err != nil {
+		return doctorCheck{status: checkFail, name: name,
+			detail: fmt.Sprintf("%s is not accepted by the tor listening on %s: %v", cookiePath, agentCfg.ControlAddr, err),
+			fix: "another tor may be using the control port; stop it, or change ControlAddr in the " +
+				"[Node.Agent] section of the configuration"}
+	}
+	return doctorCheck{status: checkPass, name: name,
+		detail: fmt.Sprintf("%s accepted by tor on %s", cookiePath, agentCfg.ControlAddr)}
+}
+
+// doctorPort is a local address the agent listens on.
+type doctorPort struct {
+	name, addr, fix string
+}
+
+func checkPorts(node *config.Node, agentRunning bool) []doctorCheck {
+	if agentRunning {
+		return []doctorCheck{{status: checkPass, name: "ports", detail: "in use by the running agent"}}
+	}
+	agentFix := func(key string) string {
+		return fmt.Sprintf("stop the process using it, or change %s in the [Node.Agent] section of the configuration", key)
+	}
+	var ports []doctorPort
+	if !node.Agent.UseTorBrowser {
+		ports = append(ports,
+			doctorPort{"tor SOCKS port", node.Agent.SocksAddr, agentFix("SocksAddr")},
+			doctorPort{"tor control port", node.Agent.ControlAddr, agentFix("ControlAddr")})
+	}
+	ports = append(ports,
+		doctorPort{"mesh SOCKS proxy", node.Agent.MeshSocksAddr, agentFix("MeshSocksAddr")},
+		doctorPort{"mesh HTTP proxy", node.Agent.MeshHTTPAddr, agentFix("MeshHTTPAddr")},
+		doctorPort{"agent API", node.Agent.APIAddr, agentFix("APIAddr")},
+		doctorPort{"metrics", node.Agent.MetricsAddr, agentFix("MetricsAddr")})
+	if len(node.Service.Routes) > 0 {
+		ports = append(ports, doctorPort{"HTTP router", node.Agent.HTTPRouterAddr, agentFix("HTTPRouterAddr")})
+	}
+	if node.Service.EndpointEnabled() {
+		ports = append(ports, doctorPort{"endpoint", node.Agent.EndpointAddr, agentFix("EndpointAddr")})
+	}
+	if node.Service.Gateway.Port != 0 {
+		ports = append(ports, doctorPort{"gateway", node.Agent.GatewayAddr, agentFix("GatewayAddr")})
+	}
+	for _, imp := range allImports(node) {
+		if imp.imp.IsUDP() || imp.imp.LocalPort < 1024 {
+			// UDP ports are not checked, and privileged ports are checked
+			// separately.
+			continue
+		}
+		ports = append(ports, doctorPort{
+			name: fmt.Sprintf("import %s:%d", imp.name, imp.imp.RemotePort),
+			addr: net.JoinHostPort(imp.imp.LocalAddr, strconv.Itoa(imp.imp.LocalPort)),
+			fix: "stop the process using it, or delete the import and add it on another port " +
+				"with 'ormesh import add'",
+		})
+	}
+
+	var checks []doctorCheck
+	used := map[string]string{}
+	for _, port := range ports {
+		if port.addr == "" {
+			continue
+		}
+		if other, ok := used[port.addr]; ok {
+			checks = append(checks, doctorCheck{status: checkFail, name: port.name,
+				detail: fmt.Sprintf("%s is also configured for the %s", port.addr, other), fix: port.fix})
+			continue
+		}
+		used[port.addr] = port.name
+		l, err := net.Listen("tcp", port.addr)
+		if err != nil {
+			checks = append(checks, doctorCheck{status: checkFail, name: port.name,
+				detail: fmt.Sprintf("cannot listen on %s: %v", port.addr, err), fix: port.fix})
+			continue
+		}
+		l.Close()
+		checks = append(checks, doctorCheck{status: checkPass, name: port.name,
+			detail: fmt.Sprintf("%s is available", port.addr)})
+	}
+	return checks
+}
+
+// namedImport is an import with the name of the remote or group it is
+// imported from.
+type namedImport struct {
+	name string
+	imp  *config.Import
+}
+
+func allImports(node *config.Node) []namedImport {
+	var imports []namedImport
+	for i := range node.Remotes {
+		for j := range node.Remotes[i].Imports {
+			imports = append(imports, namedImport{node.Remotes[i].Name, &node.Remotes[i].Imports[j]})
+		}
+	}
+	for i := range node.Groups {
+		for j := range node.Groups[i].Imports {
+			imports = append(imports, namedImport{node.Groups[i].Name, &node.Groups[i].Imports[j]})
+		}
+	}
+	return imports
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+}
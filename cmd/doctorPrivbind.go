@@ -0,0 +1,88 @@
+// +build linux
+
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// capNetBindService is the bit for CAP_NET_BIND_SERVICE in a capability set.
+const capNetBindService = 10
+
+func checkPrivilegedPorts(node *config.Node) []doctorCheck {
+	name := "privileged ports"
+	var privileged []string
+	lowest := 1024
+	for _, imp := range allImports(node) {
+		if imp.imp.LocalPort < 1024 {
+			privileged = append(privileged, strconv.Itoa(imp.imp.LocalPort))
+			if imp.imp.LocalPort < lowest {
+				lowest = imp.imp.LocalPort
+			}
+		}
+	}
+	if len(privileged) == 0 {
+		return nil
+	}
+	ports := "port " + strings.Join(privileged, ", ")
+	if len(privileged) > 1 {
+		ports = "ports " + strings.Join(privileged, ", ")
+	}
+	if os.Geteuid() == 0 {
+		return []doctorCheck{{status: checkPass, name: name,
+			detail: fmt.Sprintf("running as root, so imports may listen on %s", ports)}}
+	}
+	if start, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(start))); err == nil && n <= lowest {
+			return []doctorCheck{{status: checkPass, name: name,
+				detail: fmt.Sprintf("unprivileged processes may listen on ports from %d", n)}}
+		}
+	}
+	if hasCapability(capNetBindService) {
+		return []doctorCheck{{status: checkPass, name: name,
+			detail: fmt.Sprintf("cap_net_bind_service allows imports to listen on %s", ports)}}
+	}
+	return []doctorCheck{{status: checkFail, name: name,
+		detail: fmt.Sprintf("imports on %s require cap_net_bind_service", ports),
+		fix:    "run 'ormesh agent privbind', again each time ormesh is upgraded"}}
+}
+
+// hasCapability returns whether this process has the given capability in
+// its effective set.
+func hasCapability(bit uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		if !strings.HasPrefix(lines.Text(), "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(lines.Text(), "CapEff:")), 16, 64)
+		return err == nil && caps&(1<<bit) != 0
+	}
+	return false
+}
@@ -17,6 +17,7 @@ package cmd
 import (
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -24,12 +25,22 @@ import (
 	"github.com/cmars/ormesh/config"
 )
 
+var (
+	exportUDP            bool
+	exportSessionTimeout time.Duration
+	exportMaxFlows       int
+)
+
 // exportAddCmd represents the exportAdd command
 var exportAddCmd = &cobra.Command{
 	Use:   "add [bind addr:]port",
 	Short: "Add a service export",
 	Long: `Add a service to export as a hidden service. Bind address defaults to 127.0.0.1
-if not specified.`,
+if not specified.
+
+UDP services may be exported with --udp. Tor only carries TCP, so UDP exports
+are relayed by the ormesh endpoint to remote ormesh agents which import them,
+and the endpoint is published automatically.`,
 	Args: cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
 		withConfigForUpdate(func(cfg *config.Config) error {
@@ -40,6 +51,14 @@ if not specified.`,
 			export := config.Export{
 				LocalAddr: localAddr,
 			}
+			if err := config.CheckSessionTimeout(exportSessionTimeout); err != nil {
+				return errors.WithStack(err)
+			}
+			if exportUDP {
+				export.Protocol = config.ProtocolUDP
+				export.SessionTimeout = config.Duration{Duration: exportSessionTimeout}
+				export.MaxFlows = exportMaxFlows
+			}
 			var portStr string
 			if len(args) > 1 {
 				portStr = args[1]
@@ -63,11 +82,17 @@ if not specified.`,
 			if index < 0 {
 				cfg.Node.Service.Exports = append(cfg.Node.Service.Exports, export)
 			}
-			return nil
+			return errors.WithStack(cfg.Node.Service.CheckPorts())
 		})
 	},
 }
 
 func init() {
+	exportAddCmd.Flags().BoolVarP(&exportUDP, "udp", "", false, "Export a UDP service")
+	exportAddCmd.Flags().DurationVarP(&exportSessionTimeout, "session-timeout", "", 0,
+		"Discard UDP flows idle this long (default 2m)")
+	exportAddCmd.Flags().IntVarP(&exportMaxFlows, "max-flows", "", 0,
+		"Maximum concurrent UDP flows per tunnel (default 256)")
 	exportCmd.AddCommand(exportAddCmd)
+	addDryRunFlag(exportAddCmd)
 }
@@ -21,6 +21,8 @@ import (
 	"github.com/cmars/ormesh/config"
 )
 
+var exportDeleteUDP bool
+
 // exportDeleteCmd represents the exportDelete command
 var exportDeleteCmd = &cobra.Command{
 	Use:   "delete [bind addr:]port",
@@ -36,7 +38,8 @@ entry to be deleted, defaulting to 127.0.0.1 if not specified.`,
 			}
 			index := -1
 			for i := range cfg.Node.Service.Exports {
-				if cfg.Node.Service.Exports[i].LocalAddr == localAddr {
+				export := &cfg.Node.Service.Exports[i]
+				if export.LocalAddr == localAddr && export.IsUDP() == exportDeleteUDP {
 					index = i
 					break
 				}
@@ -53,5 +56,7 @@ entry to be deleted, defaulting to 127.0.0.1 if not specified.`,
 }
 
 func init() {
+	exportDeleteCmd.Flags().BoolVarP(&exportDeleteUDP, "udp", "", false, "Delete a UDP export")
 	exportCmd.AddCommand(exportDeleteCmd)
+	addDryRunFlag(exportDeleteCmd)
 }
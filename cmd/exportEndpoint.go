@@ -0,0 +1,58 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// exportEndpointCmd represents the exportEndpoint command
+var exportEndpointCmd = &cobra.Command{
+	Use:   "endpoint <on|off>",
+	Short: "Enable or disable the ormesh endpoint",
+	Long: `The ormesh endpoint accepts tunnels from remote ormesh agents, which
+multiplex all of their connections to this node's exported services over a
+single tor stream. The endpoint is published on the onion service alongside
+the exports, and only reaches exported services.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			enabled, err := parseOnOff(args[0])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			cfg.Node.Service.Endpoint = enabled
+			return errors.WithStack(cfg.Node.Service.CheckPorts())
+		})
+	},
+}
+
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, errors.Errorf("expected 'on' or 'off', got %q", s)
+}
+
+func init() {
+	exportCmd.AddCommand(exportEndpointCmd)
+	addDryRunFlag(exportEndpointCmd)
+}
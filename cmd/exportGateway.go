@@ -0,0 +1,88 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+var (
+	gatewayAllowNets  []string
+	gatewayAllowPorts []int
+)
+
+// exportGatewayCmd represents the exportGateway command
+var exportGatewayCmd = &cobra.Command{
+	Use:   "gateway <port|off> --allow-net <cidr> [--allow-port <port>]...",
+	Short: "Export a SOCKS gateway to local networks",
+	Long: `Export a SOCKS5 gateway on the given onion service port, through which
+authorized clients may connect to hosts on the allowed networks and ports,
+like 'ssh -D'. Every request is checked against the allowed networks and
+ports, and logged. All ports are allowed if none are specified.
+
+Clients import the gateway port and use it as a SOCKS5 proxy.`,
+	Example: `
+  $ ormesh export gateway 1080 --allow-net 10.0.0.0/24 --allow-port 22 --allow-port 443
+
+  On a client:
+
+  $ ormesh import add homelab 1080 127.0.0.1:1080
+  $ ssh -o ProxyCommand='nc -X 5 -x 127.0.0.1:1080 %h %p' 10.0.0.5`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			if args[0] == "off" {
+				cfg.Node.Service.Gateway = config.Gateway{}
+				return nil
+			}
+			port, err := strconv.Atoi(args[0])
+			if err != nil || port < 1 || port > 65535 {
+				return errors.Errorf("invalid port %q", args[0])
+			}
+			gateway := config.Gateway{
+				Port:       port,
+				AllowNets:  gatewayAllowNets,
+				AllowPorts: gatewayAllowPorts,
+			}
+			if len(gateway.AllowNets) == 0 {
+				return errors.New("at least one --allow-net is required")
+			}
+			if _, err := gateway.Networks(); err != nil {
+				return errors.WithStack(err)
+			}
+			for _, allowPort := range gateway.AllowPorts {
+				if allowPort < 1 || allowPort > 65535 {
+					return errors.Errorf("invalid allowed port %d", allowPort)
+				}
+			}
+			cfg.Node.Service.Gateway = gateway
+			return errors.WithStack(cfg.Node.Service.CheckPorts())
+		})
+	},
+}
+
+func init() {
+	exportGatewayCmd.Flags().StringSliceVarP(&gatewayAllowNets, "allow-net", "", nil,
+		"Network (CIDR) reachable through the gateway")
+	exportGatewayCmd.Flags().IntSliceVarP(&gatewayAllowPorts, "allow-port", "", nil,
+		"Port reachable through the gateway")
+	exportCmd.AddCommand(exportGatewayCmd)
+	addDryRunFlag(exportGatewayCmd)
+}
@@ -0,0 +1,32 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// exportRouteCmd represents the exportRoute command
+var exportRouteCmd = &cobra.Command{
+	Use:   "route <command> ...",
+	Short: "HTTP route commands",
+	Long: `HTTP routes share onion service port 80 among many local web services. The
+agent operates an HTTP reverse proxy which routes each request to a backend by
+its Host header and/or path prefix.`,
+}
+
+func init() {
+	exportCmd.AddCommand(exportRouteCmd)
+}
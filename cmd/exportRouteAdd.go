@@ -0,0 +1,80 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+var (
+	routeHost        string
+	routePathPrefix  string
+	routeStripPrefix bool
+)
+
+// exportRouteAddCmd represents the exportRouteAdd command
+var exportRouteAddCmd = &cobra.Command{
+	Use:   "add [--host host] [--path /prefix/] [bind addr:]port",
+	Short: "Add an HTTP route",
+	Long: `Add an HTTP route to a local backend. A route's host matches requests for that
+host and its subdomains, so --host grafana matches requests to
+grafana.<remote name> through the mesh proxies, as well as grafana.<onion>.`,
+	Example: `
+  $ ormesh export route add --host grafana 3000
+  $ ormesh export route add --path /prometheus/ 9090`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			if routeHost == "" && routePathPrefix == "" {
+				return errors.New("--host or --path required")
+			}
+			if routePathPrefix != "" && !strings.HasPrefix(routePathPrefix, "/") {
+				return errors.Errorf("invalid path prefix %q", routePathPrefix)
+			}
+			backend, err := NormalizeAddrPort(args[0])
+			if err != nil {
+				return errors.Errorf("invalid backend address %q", args[0])
+			}
+			route := config.Route{
+				Host:        routeHost,
+				PathPrefix:  routePathPrefix,
+				Backend:     backend,
+				StripPrefix: routeStripPrefix,
+			}
+			for i := range cfg.Node.Service.Routes {
+				existing := &cfg.Node.Service.Routes[i]
+				if existing.Host == route.Host && existing.PathPrefix == route.PathPrefix {
+					*existing = route
+					return nil
+				}
+			}
+			cfg.Node.Service.Routes = append(cfg.Node.Service.Routes, route)
+			return errors.WithStack(cfg.Node.Service.CheckPorts())
+		})
+	},
+}
+
+func init() {
+	exportRouteAddCmd.Flags().StringVarP(&routeHost, "host", "", "", "Route requests for this host")
+	exportRouteAddCmd.Flags().StringVarP(&routePathPrefix, "path", "", "", "Route requests with this path prefix")
+	exportRouteAddCmd.Flags().BoolVarP(&routeStripPrefix, "strip-prefix", "", false, "Strip the path prefix from requests")
+	exportRouteCmd.AddCommand(exportRouteAddCmd)
+	addDryRunFlag(exportRouteAddCmd)
+}
@@ -0,0 +1,55 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// exportRouteDeleteCmd represents the exportRouteDelete command
+var exportRouteDeleteCmd = &cobra.Command{
+	Use:   "delete [--host host] [--path /prefix/]",
+	Short: "Delete an HTTP route",
+	Args:  cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			index := -1
+			for i := range cfg.Node.Service.Routes {
+				route := &cfg.Node.Service.Routes[i]
+				if route.Host == routeHost && route.PathPrefix == routePathPrefix {
+					index = i
+					break
+				}
+			}
+			if index == -1 {
+				return errors.Errorf("no such route: host %q path %q", routeHost, routePathPrefix)
+			}
+			cfg.Node.Service.Routes = append(
+				cfg.Node.Service.Routes[:index],
+				cfg.Node.Service.Routes[index+1:]...)
+			return nil
+		})
+	},
+}
+
+func init() {
+	exportRouteDeleteCmd.Flags().StringVarP(&routeHost, "host", "", "", "Host of the route to delete")
+	exportRouteDeleteCmd.Flags().StringVarP(&routePathPrefix, "path", "", "", "Path prefix of the route to delete")
+	exportRouteCmd.AddCommand(exportRouteDeleteCmd)
+	addDryRunFlag(exportRouteDeleteCmd)
+}
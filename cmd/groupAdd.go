@@ -0,0 +1,86 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+var groupStrategy string
+
+// groupAddCmd represents the groupAdd command
+var groupAddCmd = &cobra.Command{
+	Use:   "add <group name> <remote name> [<remote name> ...]",
+	Short: "Add a group of remotes",
+	Long: `Add a group of remotes which export the same services. Services imported
+from the group are connected to one of its remotes, chosen by --strategy:
+
+  failover      try remotes in the order given (default)
+  round-robin   rotate through the remotes
+  latency       try the remote with the lowest recent connect latency first
+
+With any strategy, remotes which recently failed to connect are tried last,
+and the next remote is tried when a connection fails.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			groupName, remoteNames := args[0], args[1:]
+			if !IsValidRemoteName(groupName) {
+				return errors.Errorf("invalid group name %q", groupName)
+			}
+			if !config.IsValidStrategy(groupStrategy) {
+				return errors.Errorf("invalid strategy %q", groupStrategy)
+			}
+			for i := range cfg.Node.Remotes {
+				if cfg.Node.Remotes[i].Name == groupName {
+					return errors.Errorf("remote %q already exists", groupName)
+				}
+			}
+			for i := range cfg.Node.Groups {
+				if cfg.Node.Groups[i].Name == groupName {
+					return errors.Errorf("group %q already exists", groupName)
+				}
+			}
+			for _, remoteName := range remoteNames {
+				found := false
+				for i := range cfg.Node.Remotes {
+					if cfg.Node.Remotes[i].Name == remoteName {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return errors.Errorf("no such remote %q", remoteName)
+				}
+			}
+			cfg.Node.Groups = append(cfg.Node.Groups, config.Group{
+				Name:     groupName,
+				Remotes:  remoteNames,
+				Strategy: groupStrategy,
+			})
+			return nil
+		})
+	},
+}
+
+func init() {
+	groupAddCmd.Flags().StringVarP(&groupStrategy, "strategy", "", config.StrategyFailover,
+		"Strategy for choosing a remote: failover, round-robin or latency")
+	groupCmd.AddCommand(groupAddCmd)
+	addDryRunFlag(groupAddCmd)
+}
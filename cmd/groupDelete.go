@@ -0,0 +1,49 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// groupDeleteCmd represents the groupDelete command
+var groupDeleteCmd = &cobra.Command{
+	Use:   "delete <group name>",
+	Short: "Delete a group of remotes and its imports",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			groupName := args[0]
+			if !IsValidRemoteName(groupName) {
+				return errors.Errorf("invalid group name %q", groupName)
+			}
+			for i := range cfg.Node.Groups {
+				if cfg.Node.Groups[i].Name == groupName {
+					cfg.Node.Groups = append(cfg.Node.Groups[:i], cfg.Node.Groups[i+1:]...)
+					return nil
+				}
+			}
+			return errors.Errorf("no such group %q", groupName)
+		})
+	},
+}
+
+func init() {
+	groupCmd.AddCommand(groupDeleteCmd)
+	addDryRunFlag(groupDeleteCmd)
+}
@@ -0,0 +1,42 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// groupListCmd represents the groupList command
+var groupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List groups of remotes",
+	Args:  cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			for _, group := range cfg.Node.Groups {
+				fmt.Printf("%#v\n", group)
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	groupCmd.AddCommand(groupListCmd)
+}
@@ -0,0 +1,111 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+var (
+	hookEvents   []string
+	hookURL      string
+	hookTimeout  time.Duration
+	hookDebounce time.Duration
+)
+
+// hookAddCmd represents the hookAdd command
+var hookAddCmd = &cobra.Command{
+	Use:   "add <hook name> --event <event> [--url <url>] [-- <command> [<arg> ...]]",
+	Short: "Add a hook run on agent events",
+	Long: `Add a hook which the agent runs when one of the given events occurs. Events
+are:
+
+  agent-ready            tor has connected to the tor network
+  remote-up              connections to a remote succeed after failing
+  remote-down            connections to a remote fail after succeeding
+  descriptor-published   the node's onion service descriptor was uploaded
+  descriptor-failed      the node's onion service descriptor failed to upload
+                         to every HSDir
+  client-added           a client was added to the node's service
+  client-revoked         a client was removed from the node's service
+  config-reloaded        a changed configuration was applied
+
+A command given after -- is run with the event in the environment variables
+ORMESH_EVENT, ORMESH_EVENT_TIME, ORMESH_REMOTE, ORMESH_CLIENT and
+ORMESH_REASON. With --url, the event is POSTed to the URL as a JSON object.
+
+Hooks are run --debounce after an event. Events about the same remote or
+client in the meantime are combined, and the hook run once with the latest.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			hookName, command := args[0], args[1:]
+			if !IsValidHookName(hookName) {
+				return errors.Errorf("invalid hook name %q", hookName)
+			}
+			if len(hookEvents) == 0 {
+				return errors.New("at least one --event is required")
+			}
+			for _, event := range hookEvents {
+				if !config.IsValidHookEvent(event) {
+					return errors.Errorf("invalid event %q; events are %s",
+						event, strings.Join(config.HookEvents, ", "))
+				}
+			}
+			if len(command) == 0 && hookURL == "" {
+				return errors.New("a command or --url is required")
+			}
+			if hookTimeout <= 0 {
+				return errors.Errorf("invalid timeout %v: must be positive", hookTimeout)
+			}
+			if hookDebounce <= 0 {
+				return errors.Errorf("invalid debounce %v: must be positive", hookDebounce)
+			}
+			for i := range cfg.Node.Hooks {
+				if cfg.Node.Hooks[i].Name == hookName {
+					return errors.Errorf("hook %q already exists", hookName)
+				}
+			}
+			cfg.Node.Hooks = append(cfg.Node.Hooks, config.Hook{
+				Name:     hookName,
+				Events:   hookEvents,
+				Command:  command,
+				URL:      hookURL,
+				Timeout:  config.Duration{Duration: hookTimeout},
+				Debounce: config.Duration{Duration: hookDebounce},
+			})
+			return nil
+		})
+	},
+}
+
+func init() {
+	hookAddCmd.Flags().StringSliceVarP(&hookEvents, "event", "", nil,
+		"Event on which to run the hook; may be repeated")
+	hookAddCmd.Flags().StringVarP(&hookURL, "url", "", "",
+		"URL to POST the event to")
+	hookAddCmd.Flags().DurationVarP(&hookTimeout, "timeout", "", config.DefaultHookTimeout,
+		"Time allowed for the command or POST")
+	hookAddCmd.Flags().DurationVarP(&hookDebounce, "debounce", "", config.DefaultHookDebounce,
+		"Delay before running the hook, combining events in the meantime")
+	hookCmd.AddCommand(hookAddCmd)
+	addDryRunFlag(hookAddCmd)
+}
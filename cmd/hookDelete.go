@@ -0,0 +1,49 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// hookDeleteCmd represents the hookDelete command
+var hookDeleteCmd = &cobra.Command{
+	Use:   "delete <hook name>",
+	Short: "Delete a hook",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			hookName := args[0]
+			if !IsValidHookName(hookName) {
+				return errors.Errorf("invalid hook name %q", hookName)
+			}
+			for i := range cfg.Node.Hooks {
+				if cfg.Node.Hooks[i].Name == hookName {
+					cfg.Node.Hooks = append(cfg.Node.Hooks[:i], cfg.Node.Hooks[i+1:]...)
+					return nil
+				}
+			}
+			return errors.Errorf("no such hook %q", hookName)
+		})
+	},
+}
+
+func init() {
+	hookCmd.AddCommand(hookDeleteCmd)
+	addDryRunFlag(hookDeleteCmd)
+}
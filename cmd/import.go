@@ -15,7 +15,10 @@
 package cmd
 
 import (
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
 )
 
 // importCmd represents the import command
@@ -27,3 +30,19 @@ var importCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(importCmd)
 }
+
+// findImports returns the imports of the named remote or group, and whether
+// the name refers to a group.
+func findImports(cfg *config.Config, name string) (*[]config.Import, bool, error) {
+	for i := range cfg.Node.Remotes {
+		if cfg.Node.Remotes[i].Name == name {
+			return &cfg.Node.Remotes[i].Imports, false, nil
+		}
+	}
+	for i := range cfg.Node.Groups {
+		if cfg.Node.Groups[i].Name == name {
+			return &cfg.Node.Groups[i].Imports, true, nil
+		}
+	}
+	return nil, false, errors.Errorf("no such remote or group: %q", name)
+}
@@ -17,6 +17,7 @@ package cmd
 import (
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -24,11 +25,44 @@ import (
 	"github.com/cmars/ormesh/config"
 )
 
+var (
+	importUDP            bool
+	importSessionTimeout time.Duration
+	importMaxFlows       int
+	importDialTimeout    time.Duration
+	importDialRetries    int
+	importRetryBackoff   time.Duration
+	importMaxConns       int
+	importIdleTimeout    time.Duration
+	importMaxLifetime    time.Duration
+	importReadRate       string
+	importWriteRate      string
+)
+
 // importAddCmd represents the importAdd command
 var importAddCmd = &cobra.Command{
-	Use:   "add <remote name> <remote port> <local bind addr>:<local port>",
+	Use:   "add <remote or group name> <remote port> <local bind addr>:<local port>",
 	Short: "Add a service import",
-	Args:  cobra.ExactArgs(3),
+	Long: `Add a service import, forwarding a local port to a port on the remote.
+
+Services may also be imported from a group of remotes (see 'ormesh group add'),
+in which case each connection is forwarded to one of the group's remotes.
+
+UDP services exported by a remote ormesh agent may be imported with --udp.
+Datagrams are tunneled to the remote's ormesh endpoint, which relays them to
+the exported service and returns replies.
+
+Connections to the remote which fail for reasons that may be temporary, such
+as the remote's onion service descriptor not being found yet, are retried
+--dial-retries times with exponential backoff. The local connection is held
+open while retrying.
+
+Connections may be limited with --max-conns, closed when idle with
+--idle-timeout, or closed after --max-lifetime. Bandwidth across all
+connections to the import is limited with --read-rate, for data sent to the
+remote, and --write-rate, for data received from it. Rates are in bytes per
+second, with optional k, M or G suffixes.`,
+	Args: cobra.ExactArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
 		withConfigForUpdate(func(cfg *config.Config) error {
 			remoteName, remotePort, localAddr := args[0], args[1], args[2]
@@ -51,34 +85,75 @@ var importAddCmd = &cobra.Command{
 			if err != nil {
 				return errors.Errorf("invalid local port %q", localPort)
 			}
+			readRate, err := ParseByteRate(importReadRate)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			writeRate, err := ParseByteRate(importWriteRate)
+			if err != nil {
+				return errors.WithStack(err)
+			}
 			newImport := config.Import{
-				LocalAddr:  localHost,
-				LocalPort:  localPortNum,
-				RemotePort: remotePortNum,
+				LocalAddr:    localHost,
+				LocalPort:    localPortNum,
+				RemotePort:   remotePortNum,
+				DialTimeout:  config.Duration{Duration: importDialTimeout},
+				DialRetries:  importDialRetries,
+				RetryBackoff: config.Duration{Duration: importRetryBackoff},
+				MaxConns:     importMaxConns,
+				IdleTimeout:  config.Duration{Duration: importIdleTimeout},
+				MaxLifetime:  config.Duration{Duration: importMaxLifetime},
+				ReadRate:     readRate,
+				WriteRate:    writeRate,
 			}
-			remoteIndex := -1
-			for i := range cfg.Node.Remotes {
-				if cfg.Node.Remotes[i].Name == remoteName {
-					remoteIndex = i
-					break
-				}
+			if err := config.CheckSessionTimeout(importSessionTimeout); err != nil {
+				return errors.WithStack(err)
+			}
+			if importUDP {
+				newImport.Protocol = config.ProtocolUDP
+				newImport.SessionTimeout = config.Duration{Duration: importSessionTimeout}
+				newImport.MaxFlows = importMaxFlows
+			}
+			imports, isGroup, err := findImports(cfg, remoteName)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-			if remoteIndex < 0 {
-				return errors.Errorf("no such remote: %q", remoteName)
+			if isGroup && importUDP {
+				return errors.New("UDP services cannot be imported from a group")
 			}
-			for i := range cfg.Node.Remotes[remoteIndex].Imports {
-				if cfg.Node.Remotes[remoteIndex].Imports[i] == newImport {
+			for i := range *imports {
+				if (*imports)[i] == newImport {
 					return nil
 				}
 			}
-			cfg.Node.Remotes[remoteIndex].Imports = append(
-				cfg.Node.Remotes[remoteIndex].Imports,
-				newImport)
+			*imports = append(*imports, newImport)
 			return nil
 		})
 	},
 }
 
 func init() {
+	importAddCmd.Flags().BoolVarP(&importUDP, "udp", "", false, "Import a UDP service")
+	importAddCmd.Flags().DurationVarP(&importSessionTimeout, "session-timeout", "", 0,
+		"Discard UDP flows idle this long (default 2m)")
+	importAddCmd.Flags().IntVarP(&importMaxFlows, "max-flows", "", 0,
+		"Maximum concurrent UDP flows (default 256)")
+	importAddCmd.Flags().DurationVarP(&importDialTimeout, "dial-timeout", "", 0,
+		"Give up connecting to the remote after this long (default 2m)")
+	importAddCmd.Flags().IntVarP(&importDialRetries, "dial-retries", "", 0,
+		"Retry failed connections to the remote this many times (default 2, -1 to disable)")
+	importAddCmd.Flags().DurationVarP(&importRetryBackoff, "retry-backoff", "", 0,
+		"Wait before the first retry, doubling for each following one (default 1s)")
+	importAddCmd.Flags().IntVarP(&importMaxConns, "max-conns", "", 0,
+		"Maximum concurrent connections (default unlimited)")
+	importAddCmd.Flags().DurationVarP(&importIdleTimeout, "idle-timeout", "", 0,
+		"Close connections idle this long (default never)")
+	importAddCmd.Flags().DurationVarP(&importMaxLifetime, "max-lifetime", "", 0,
+		"Close connections open this long (default never)")
+	importAddCmd.Flags().StringVarP(&importReadRate, "read-rate", "", "0",
+		"Limit data sent to the remote, in bytes per second (default unlimited)")
+	importAddCmd.Flags().StringVarP(&importWriteRate, "write-rate", "", "0",
+		"Limit data received from the remote, in bytes per second (default unlimited)")
 	importCmd.AddCommand(importAddCmd)
+	addDryRunFlag(importAddCmd)
 }
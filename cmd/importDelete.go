@@ -23,9 +23,11 @@ import (
 	"github.com/cmars/ormesh/config"
 )
 
+var importDeleteUDP bool
+
 // importDeleteCmd represents the importDelete command
 var importDeleteCmd = &cobra.Command{
-	Use:   "delete <remote name> <remote port>",
+	Use:   "delete <remote or group name> <remote port>",
 	Short: "Delete a service import",
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -38,28 +40,25 @@ var importDeleteCmd = &cobra.Command{
 			if err != nil {
 				return errors.Errorf("invalid remote port %q", remotePort)
 			}
-			remoteIndex := -1
-			for i := range cfg.Node.Remotes {
-				if cfg.Node.Remotes[i].Name == remoteName {
-					remoteIndex = i
-					break
-				}
-			}
-			if remoteIndex < 0 {
-				return errors.Errorf("no such remote: %q", remoteName)
+			imports, _, err := findImports(cfg, remoteName)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-			var imports []config.Import
-			for i := range cfg.Node.Remotes[remoteIndex].Imports {
-				if cfg.Node.Remotes[remoteIndex].Imports[i].RemotePort != remotePortNum {
-					imports = append(imports, cfg.Node.Remotes[remoteIndex].Imports[i])
+			var remaining []config.Import
+			for i := range *imports {
+				import_ := &(*imports)[i]
+				if import_.RemotePort != remotePortNum || import_.IsUDP() != importDeleteUDP {
+					remaining = append(remaining, *import_)
 				}
 			}
-			cfg.Node.Remotes[remoteIndex].Imports = imports
+			*imports = remaining
 			return nil
 		})
 	},
 }
 
 func init() {
+	importDeleteCmd.Flags().BoolVarP(&importDeleteUDP, "udp", "", false, "Delete a UDP import")
 	importCmd.AddCommand(importDeleteCmd)
+	addDryRunFlag(importDeleteCmd)
 }
@@ -34,16 +34,14 @@ var importListCmd = &cobra.Command{
 			if !IsValidRemoteName(remoteName) {
 				return errors.Errorf("invalid remote name %q", remoteName)
 			}
-			// TODO: use specified remote
-			for _, remote := range cfg.Node.Remotes {
-				if remote.Name == remoteName {
-					for _, import_ := range remote.Imports {
-						fmt.Printf("%#v\n", import_)
-					}
-					return nil
-				}
+			imports, _, err := findImports(cfg, remoteName)
+			if err != nil {
+				return errors.WithStack(err)
 			}
-			return errors.Errorf("no such remote %q", remoteName)
+			for _, import_ := range *imports {
+				fmt.Printf("%#v\n", import_)
+			}
+			return nil
 		})
 	},
 }
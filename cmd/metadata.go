@@ -0,0 +1,73 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/audit"
+	"github.com/cmars/ormesh/config"
+)
+
+// newMetadata returns metadata for a client or remote created now by the
+// current user, with notes and labels given as key=value.
+func newMetadata(notes string, labels []string) (config.Metadata, error) {
+	m, err := ParseLabels(labels)
+	if err != nil {
+		return config.Metadata{}, errors.WithStack(err)
+	}
+	now := time.Now().UTC().Round(time.Second)
+	return config.Metadata{
+		CreatedAt: &now,
+		CreatedBy: audit.Actor(),
+		Notes:     notes,
+		Labels:    m,
+	}, nil
+}
+
+// formatLabels formats labels as comma-separated key=value pairs, sorted by
+// key.
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// printMetadata prints metadata in the format of 'client show' and 'remote
+// show', omitting anything not set.
+func printMetadata(w io.Writer, m *config.Metadata) {
+	if m.CreatedAt != nil {
+		fmt.Fprintf(w, "created: %s", m.CreatedAt.Local().Format("2006-01-02 15:04"))
+		if m.CreatedBy != "" {
+			fmt.Fprintf(w, " by %s", m.CreatedBy)
+		}
+		fmt.Fprintln(w)
+	}
+	if m.Notes != "" {
+		fmt.Fprintf(w, "notes: %s\n", m.Notes)
+	}
+	if len(m.Labels) > 0 {
+		fmt.Fprintf(w, "labels: %s\n", formatLabels(m.Labels))
+	}
+}
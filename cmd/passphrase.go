@@ -0,0 +1,79 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Environment variables from which passphrases are read, rather than
+// prompting for them.
+const (
+	backupPassphraseEnv  = "ORMESH_PASSPHRASE"
+	secretsPassphraseEnv = "ORMESH_SECRETS_PASSPHRASE"
+)
+
+// readPassphrase returns the passphrase in the environment variable env, or
+// prompts for one on the terminal, twice if confirm is true.
+func readPassphrase(env, prompt string, confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	// Turn off echo where stty(1) is available.
+	if stty("-echo") == nil {
+		defer stty("echo")
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	read := func(prompt string) ([]byte, error) {
+		fmt.Fprintf(os.Stderr, "%s: ", prompt)
+		line, err := stdin.ReadString('\n')
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read passphrase")
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	passphrase, err := read(prompt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := read("Confirm " + strings.ToLower(prompt[:1]) + prompt[1:])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// stty sets terminal options on standard input.
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
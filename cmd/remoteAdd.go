@@ -23,12 +23,20 @@ import (
 	"github.com/cmars/ormesh/config"
 )
 
+var (
+	remoteNotes  string
+	remoteLabels []string
+)
+
 // remoteAddCmd represents the remoteAdd command
 var remoteAddCmd = &cobra.Command{
 	Use:   "add <remote name> <onion address> <client token>",
 	Short: "Add a service remote",
 	Long: `Add a service remote. The onion address and client token are the values that
-were displayed on the remote with the command 'ormesh client add'.`,
+were displayed on the remote with the command 'ormesh client add'.
+
+--note and --label record what the remote is, and are shown by
+'ormesh remote show'.`,
 	Args: cobra.ExactArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
 		withConfigForUpdate(func(cfg *config.Config) error {
@@ -44,10 +52,15 @@ were displayed on the remote with the command 'ormesh client add'.`,
 					return errors.Errorf("remote %q already exists", remoteName)
 				}
 			}
+			metadata, err := newMetadata(remoteNotes, remoteLabels)
+			if err != nil {
+				return errors.WithStack(err)
+			}
 			remote := config.Remote{
-				Name:    remoteName,
-				Address: remoteAddr,
-				Auth:    clientAuth,
+				Name:     remoteName,
+				Address:  remoteAddr,
+				Auth:     clientAuth,
+				Metadata: metadata,
 			}
 			cfg.Node.Remotes = append(cfg.Node.Remotes, remote)
 			return nil
@@ -56,5 +69,9 @@ were displayed on the remote with the command 'ormesh client add'.`,
 }
 
 func init() {
+	remoteAddCmd.Flags().StringVarP(&remoteNotes, "note", "", "", "Notes about the remote")
+	remoteAddCmd.Flags().StringSliceVarP(&remoteLabels, "label", "", nil,
+		"Label the remote with key=value; may be repeated")
 	remoteCmd.AddCommand(remoteAddCmd)
+	addDryRunFlag(remoteAddCmd)
 }
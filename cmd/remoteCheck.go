@@ -0,0 +1,122 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
+)
+
+var (
+	checkAll     bool
+	checkTimeout time.Duration
+)
+
+// remoteCheckCmd represents the remoteCheck command
+var remoteCheckCmd = &cobra.Command{
+	Use:   "check [<remote or group name>]",
+	Short: "Check that imported services are reachable",
+	Long: `Check that the services imported from a remote or group, or with --all every
+imported service, are reachable, by connecting to each once through the
+running agent. Every remote of a group is checked.
+
+Exits non-zero if any service could not be reached, for use in cron jobs and
+CI.`,
+	Args: cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			query := url.Values{"timeout": {checkTimeout.String()}}
+			if checkAll {
+				if len(args) > 0 {
+					return errors.New("a remote name and --all are mutually exclusive")
+				}
+			} else if len(args) == 1 {
+				if _, _, err := findImports(cfg, args[0]); err != nil {
+					return errors.WithStack(err)
+				}
+				query.Set("remote", args[0])
+			} else {
+				return errors.New("remote or group name, or --all required")
+			}
+			var results []agent.ImportCheck
+			err := agentAPIGetTimeout(cfg, "/check?"+query.Encode(), checkTimeout+10*time.Second, &results)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if len(results) == 0 {
+				if len(args) == 1 {
+					return errors.Errorf("the agent has no imports from %q to check", args[0])
+				}
+				if hasImports(cfg) {
+					return errors.New("the agent has no imports to check")
+				}
+				fmt.Println("no imports to check")
+				return nil
+			}
+			var failed int
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			for _, result := range results {
+				target := fmt.Sprintf("%s:%d/%s", result.Remote, result.RemotePort, result.Protocol)
+				if result.Import != result.Remote {
+					target = result.Import + " " + target
+				}
+				if result.Error != "" {
+					failed++
+					fmt.Fprintf(w, "%s\tFAIL\t%s\t%s\n", target, result.Reason, result.Error)
+				} else {
+					fmt.Fprintf(w, "%s\tOK\t%v\t\n", target, roundDuration(result.Latency))
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return errors.WithStack(err)
+			}
+			if failed > 0 {
+				return errors.Errorf("%d of %d checks failed", failed, len(results))
+			}
+			return nil
+		})
+	},
+}
+
+// hasImports returns whether any services are imported.
+func hasImports(cfg *config.Config) bool {
+	for _, remote := range cfg.Node.Remotes {
+		if len(remote.Imports) > 0 {
+			return true
+		}
+	}
+	for _, group := range cfg.Node.Groups {
+		if len(group.Imports) > 0 && len(group.Remotes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	remoteCheckCmd.Flags().BoolVarP(&checkAll, "all", "", false, "Check all imported services")
+	remoteCheckCmd.Flags().DurationVarP(&checkTimeout, "timeout", "", time.Minute,
+		"Time allowed to connect to each service")
+	remoteCmd.AddCommand(remoteCheckCmd)
+}
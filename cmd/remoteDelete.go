@@ -42,6 +42,16 @@ var remoteDeleteCmd = &cobra.Command{
 				return errors.Errorf("no such remote %q", remoteName)
 			}
 			cfg.Node.Remotes = append(cfg.Node.Remotes[:index], cfg.Node.Remotes[index+1:]...)
+			for i := range cfg.Node.Groups {
+				group := &cfg.Node.Groups[i]
+				var remotes []string
+				for _, name := range group.Remotes {
+					if name != remoteName {
+						remotes = append(remotes, name)
+					}
+				}
+				group.Remotes = remotes
+			}
 			return nil
 		})
 	},
@@ -49,4 +59,5 @@ var remoteDeleteCmd = &cobra.Command{
 
 func init() {
 	remoteCmd.AddCommand(remoteDeleteCmd)
+	addDryRunFlag(remoteDeleteCmd)
 }
@@ -16,7 +16,10 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"text/tabwriter"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
 	"github.com/cmars/ormesh/config"
@@ -29,10 +32,13 @@ var remoteListCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		withConfig(func(cfg *config.Config) error {
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tADDRESS\tIMPORTS\tLABELS")
 			for _, remote := range cfg.Node.Remotes {
-				fmt.Printf("%#v\n", remote)
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", remote.Name, remote.Address,
+					len(remote.Imports), formatLabels(remote.Labels))
 			}
-			return nil
+			return errors.WithStack(w.Flush())
 		})
 	},
 }
@@ -0,0 +1,168 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/socks"
+)
+
+var (
+	pingCount    int
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+)
+
+// remotePingCmd represents the remotePing command
+var remotePingCmd = &cobra.Command{
+	Use:   "ping <remote name> [<remote port>]",
+	Short: "Test connecting to a remote",
+	Long: `Fetch a remote's onion service descriptor through the running agent, then
+repeatedly connect to a port on the remote through the agent's tor SOCKS
+proxy, reporting connect latency and the reasons connections failed.
+
+The port defaults to that of the first service imported from the remote, or
+the remote's endpoint if it is tunneled.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			remote, err := findRemote(cfg, args[0])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			var port int
+			if len(args) > 1 {
+				port, err = strconv.Atoi(args[1])
+				if err != nil {
+					return errors.Errorf("invalid remote port %q", args[1])
+				}
+			} else if remote.Tunnel {
+				port = config.EndpointPort
+			} else if len(remote.Imports) > 0 {
+				port = remote.Imports[0].RemotePort
+			} else {
+				return errors.Errorf("remote %q has no imports; specify a port", remote.Name)
+			}
+
+			fmt.Printf("PING %s (%s) port %d\n", remote.Name, remote.Address, port)
+			var fetch agent.DescriptorFetch
+			err = agentAPIGetTimeout(cfg, "/descriptor?address="+url.QueryEscape(remote.Address),
+				2*time.Minute, &fetch)
+			if err != nil {
+				fmt.Printf("descriptor fetch time unavailable: %v\n", err)
+			} else if fetch.Error != "" {
+				fmt.Printf("descriptor fetch failed: %s\n", fetch.Error)
+			} else {
+				fmt.Printf("descriptor fetched in %v\n", roundDuration(fetch.FetchTime))
+			}
+
+			dialer := &socks.Dialer{ProxyAddr: cfg.Node.Agent.SocksAddr, Timeout: pingTimeout}
+			addr := net.JoinHostPort(remote.Address, strconv.Itoa(port))
+			var latencies []time.Duration
+			failures := map[string]uint64{}
+			for i := 0; i < pingCount; i++ {
+				if i > 0 {
+					time.Sleep(pingInterval)
+				}
+				start := time.Now()
+				conn, err := dialer.Dial("tcp", addr)
+				latency := time.Since(start)
+				if err != nil {
+					reason := socksErrorReason(err)
+					failures[reason]++
+					fmt.Printf("failed to connect to %s:%d: %v (%s)\n", remote.Name, port, err, reason)
+					continue
+				}
+				conn.Close()
+				latencies = append(latencies, latency)
+				fmt.Printf("connected to %s:%d in %v\n", remote.Name, port, roundDuration(latency))
+			}
+
+			fmt.Printf("\n--- %s ping statistics ---\n", remote.Name)
+			fmt.Printf("%d attempts, %d connected, %d failed\n",
+				pingCount, len(latencies), pingCount-len(latencies))
+			if len(latencies) > 0 {
+				min, avg, p95 := latencyStats(latencies)
+				fmt.Printf("connect latency min/avg/p95 = %v/%v/%v\n",
+					roundDuration(min), roundDuration(avg), roundDuration(p95))
+			}
+			if len(failures) > 0 {
+				fmt.Printf("failures: %s\n", formatCounts(failures))
+			}
+			if len(latencies) == 0 {
+				return errors.Errorf("failed to connect to %s", remote.Name)
+			}
+			return nil
+		})
+	},
+}
+
+// findRemote returns the remote with the given name or onion address.
+func findRemote(cfg *config.Config, name string) (*config.Remote, error) {
+	for i := range cfg.Node.Remotes {
+		if cfg.Node.Remotes[i].Name == name || cfg.Node.Remotes[i].Address == name {
+			return &cfg.Node.Remotes[i], nil
+		}
+	}
+	return nil, errors.Errorf("no such remote %q", name)
+}
+
+// socksErrorReason returns a short identifier for why a connection through
+// tor's SOCKS proxy failed.
+func socksErrorReason(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case *socks.ReplyError:
+		return cause.Reason()
+	case net.Error:
+		if cause.Timeout() {
+			return "timeout"
+		}
+	}
+	return "other"
+}
+
+// latencyStats returns the minimum, mean and 95th percentile of latencies.
+func latencyStats(latencies []time.Duration) (min, avg, p95 time.Duration) {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, l := range sorted {
+		total += l
+	}
+	i := (len(sorted)*95+99)/100 - 1
+	return sorted[0], total / time.Duration(len(sorted)), sorted[i]
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
+
+func init() {
+	remotePingCmd.Flags().IntVarP(&pingCount, "count", "c", 5, "Number of connections to make")
+	remotePingCmd.Flags().DurationVarP(&pingInterval, "interval", "i", time.Second, "Wait between connections")
+	remotePingCmd.Flags().DurationVarP(&pingTimeout, "timeout", "", time.Minute, "Timeout for each connection")
+	remoteCmd.AddCommand(remotePingCmd)
+}
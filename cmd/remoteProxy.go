@@ -0,0 +1,71 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/socks"
+)
+
+// remoteProxyCmd represents the remoteProxy command
+var remoteProxyCmd = &cobra.Command{
+	Use:   "proxy <remote name> <remote port>",
+	Short: "Connect stdin and stdout to a remote port",
+	Long: `Connect to a port on a remote through the agent's tor SOCKS proxy, copying
+standard input to the connection and the connection to standard output. Useful
+as an ssh-config(5) ProxyCommand.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			remoteName, remotePort := args[0], args[1]
+			remotePortNum, err := strconv.Atoi(remotePort)
+			if err != nil {
+				return errors.Errorf("invalid remote port %q", remotePort)
+			}
+			remote, err := findRemote(cfg, remoteName)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			remoteAddr := remote.Address
+			dialer := &socks.Dialer{ProxyAddr: cfg.Node.Agent.SocksAddr}
+			conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", remoteAddr, remotePortNum))
+			if err != nil {
+				return errors.Wrapf(err, "failed to connect to %s:%d", remoteName, remotePortNum)
+			}
+			defer conn.Close()
+			go func() {
+				io.Copy(conn, os.Stdin)
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					tcpConn.CloseWrite()
+				}
+			}()
+			_, err = io.Copy(os.Stdout, conn)
+			return errors.WithStack(err)
+		})
+	},
+}
+
+func init() {
+	remoteCmd.AddCommand(remoteProxyCmd)
+}
@@ -16,6 +16,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -34,9 +35,22 @@ var remoteShowCmd = &cobra.Command{
 			if !IsValidRemoteName(remoteName) {
 				return errors.Errorf("invalid remote %q", remoteName)
 			}
+			if err := resolveSecrets(cfg); err != nil {
+				return errors.WithStack(err)
+			}
 			for _, remote := range cfg.Node.Remotes {
 				if remote.Name == remoteName {
-					fmt.Printf("%#v\n", remote)
+					fmt.Printf("name: %s\naddress: %s\nauth: %s\n", remote.Name, remote.Address, remote.Auth)
+					if remote.Tunnel {
+						fmt.Println("tunnel: true")
+					}
+					if len(remote.AllowPorts) > 0 {
+						fmt.Printf("allow ports: %v\n", remote.AllowPorts)
+					}
+					printMetadata(os.Stdout, &remote.Metadata)
+					for _, import_ := range remote.Imports {
+						fmt.Printf("import: %#v\n", import_)
+					}
 					return nil
 				}
 			}
@@ -15,36 +15,49 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
-	"net"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
 	"github.com/cmars/ormesh/config"
 )
 
+var sshConfigAll bool
+
 // remoteSshConfigCmd represents the sshConfig command
 var remoteSshConfigCmd = &cobra.Command{
-	Use:   "ssh-config <remote name>",
+	Use:   "ssh-config [remote name]",
 	Short: "Print ssh-config(5) stanza for a remote",
-	Args:  cobra.ExactArgs(1),
+	Long: `Print an ssh-config(5) stanza for a remote, which connects with
+'ormesh remote proxy'.
+
+With --all, write stanzas for every remote to ~/.ssh/config.d/ormesh, which
+may be included from ~/.ssh/config. This file is managed by ormesh and
+overwritten each time.`,
+	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
 		withConfig(func(cfg *config.Config) error {
+			if sshConfigAll {
+				return writeSshConfigAll(cfg)
+			}
+			if len(args) != 1 {
+				return errors.New("remote name or --all required")
+			}
 			remoteName := args[0]
 			if !IsValidRemoteName(remoteName) {
 				return errors.Errorf("invalid remote %q", remoteName)
 			}
-			_, socksPort, err := net.SplitHostPort(cfg.Node.Agent.SocksAddr)
-			if err != nil {
-				return errors.Errorf("invalid SocksAddr %q", cfg.Node.Agent.SocksAddr)
-			}
 			for _, remote := range cfg.Node.Remotes {
 				if remote.Name == remoteName {
-					fmt.Printf(`Host %s
-  ProxyCommand nc -X 5 -x 127.0.0.1:%s %%h %%p
-  Hostname %s
-`, remoteName, socksPort, remote.Address)
+					writeSshConfig(os.Stdout, &remote)
 					return nil
 				}
 			}
@@ -53,6 +66,61 @@ var remoteSshConfigCmd = &cobra.Command{
 	},
 }
 
+func writeSshConfig(w io.Writer, remote *config.Remote) {
+	proxyCommand := "ormesh"
+	if RootCmd.PersistentFlags().Changed("config") {
+		// ssh runs the command from wherever it is invoked.
+		cfgPath, err := filepath.Abs(cfgFile)
+		if err != nil {
+			cfgPath = cfgFile
+		}
+		// ssh expands %-tokens in the command before passing it to the
+		// shell.
+		proxyCommand = "ormesh --config " + strings.Replace(shellQuote(cfgPath), "%", "%%", -1)
+	}
+	fmt.Fprintf(w, `Host %s
+  ProxyCommand %s remote proxy %%n %%p
+  Hostname %s
+`, remote.Name, proxyCommand, remote.Address)
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func writeSshConfigAll(cfg *config.Config) error {
+	home, err := homedir.Dir()
+	if err != nil {
+		return errors.Wrap(err, "failed to locate home directory")
+	}
+	configDir := filepath.Join(home, ".ssh", "config.d")
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# This file is managed by ormesh. Changes will be overwritten.")
+	for i := range cfg.Node.Remotes {
+		fmt.Fprintln(&buf)
+		writeSshConfig(&buf, &cfg.Node.Remotes[i])
+	}
+	configPath := filepath.Join(configDir, "ormesh")
+	if dryRun {
+		fmt.Printf("dry run; would write %s:\n", configPath)
+		_, err := os.Stdout.Write(buf.Bytes())
+		return errors.WithStack(err)
+	}
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create %q", configDir)
+	}
+	if err := ioutil.WriteFile(configPath, buf.Bytes(), 0600); err != nil {
+		return errors.Wrapf(err, "failed to write %q", configPath)
+	}
+	fmt.Printf("wrote %s\n", configPath)
+	fmt.Println("add 'Include config.d/ormesh' to the top of ~/.ssh/config to use it")
+	return nil
+}
+
 func init() {
+	remoteSshConfigCmd.Flags().BoolVarP(&sshConfigAll, "all", "", false,
+		"Write stanzas for all remotes to ~/.ssh/config.d/ormesh")
 	remoteCmd.AddCommand(remoteSshConfigCmd)
+	addDryRunFlag(remoteSshConfigCmd)
 }
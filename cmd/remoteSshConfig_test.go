@@ -0,0 +1,54 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestWriteSshConfig(t *testing.T) {
+	remote := &config.Remote{Name: "server", Address: "abcdefghijklmnop.onion"}
+	var buf bytes.Buffer
+	writeSshConfig(&buf, remote)
+	assert.Equal(t, `Host server
+  ProxyCommand ormesh remote proxy %n %p
+  Hostname abcdefghijklmnop.onion
+`, buf.String())
+
+	defer func(path string) { cfgFile = path }(cfgFile)
+	flag := RootCmd.PersistentFlags().Lookup("config")
+	defer func(value string, changed bool) { flag.Value.Set(value); flag.Changed = changed }(flag.Value.String(), flag.Changed)
+	assert.NoError(t, RootCmd.PersistentFlags().Set("config", "it's 100%/config"))
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A relative configuration path is made absolute, quoted for the shell,
+	// and its % escaped from ssh.
+	buf.Reset()
+	writeSshConfig(&buf, remote)
+	assert.Equal(t, `Host server
+  ProxyCommand ormesh --config '`+filepath.Join(wd, `it'\''s 100%%`, "config")+`' remote proxy %n %p
+  Hostname abcdefghijklmnop.onion
+`, buf.String())
+}
@@ -0,0 +1,57 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// remoteTunnelCmd represents the remoteTunnel command
+var remoteTunnelCmd = &cobra.Command{
+	Use:   "tunnel <remote name> <on|off>",
+	Short: "Tunnel imports from a remote over a single tor stream",
+	Long: `When tunneling is on, connections to all imports from the remote are
+multiplexed over a single long-lived tor stream to the remote's ormesh
+endpoint, rather than opening a new tor stream for each connection. The remote
+must be running ormesh with its endpoint enabled ('ormesh export endpoint on').`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			remoteName := args[0]
+			if !IsValidRemoteName(remoteName) {
+				return errors.Errorf("invalid remote name %q", remoteName)
+			}
+			enabled, err := parseOnOff(args[1])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for i := range cfg.Node.Remotes {
+				if cfg.Node.Remotes[i].Name == remoteName {
+					cfg.Node.Remotes[i].Tunnel = enabled
+					return nil
+				}
+			}
+			return errors.Errorf("no such remote %q", remoteName)
+		})
+	},
+}
+
+func init() {
+	remoteCmd.AddCommand(remoteTunnelCmd)
+	addDryRunFlag(remoteTunnelCmd)
+}
@@ -0,0 +1,106 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/backup"
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/seal"
+)
+
+var (
+	restoreIdentity string
+	restoreForce    bool
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <backup file>",
+	Short: "Restore a backup made with 'ormesh backup'",
+	Long: `Restore the configuration, audit log and onion service keys from a backup,
+to the configuration file given with --config or the default one. Paths
+which were under the backed-up configuration's directory are moved under the
+restored one's, so that a node may be moved to another host or user.
+
+A backup encrypted to a recipient key is decrypted with --identity; otherwise
+the passphrase is read from $ORMESH_PASSPHRASE or prompted for.
+
+An existing configuration or onion service key is only replaced with --force.
+Stop the agent before restoring over a running node.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := restore(args[0])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		changed = true
+		fmt.Printf("restored %s\n", cfg.Path)
+	},
+}
+
+func restore(backupPath string) (*config.Config, error) {
+	sealed, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %q", backupPath)
+	}
+	var contents []byte
+	if seal.IsPassphrase(sealed) {
+		passphrase, err := readPassphrase(backupPassphraseEnv, "Backup passphrase", false)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		contents, err = seal.OpenPassphrase(sealed, passphrase)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else {
+		if restoreIdentity == "" {
+			return nil, errors.New("the backup is encrypted to a recipient key; decrypt it with --identity")
+		}
+		idText, err := ioutil.ReadFile(restoreIdentity)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %q", restoreIdentity)
+		}
+		id, err := seal.ParseIdentity(string(idText))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %q", restoreIdentity)
+		}
+		contents, err = seal.OpenIdentity(sealed, id)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	archive, err := backup.Read(bytes.NewReader(contents))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return backup.Restore(archive, cfgFile, restoreForce)
+}
+
+func init() {
+	restoreCmd.Flags().StringVarP(&restoreIdentity, "identity", "i", "",
+		"Decrypt with the identity in this file, created by 'ormesh backup keygen'")
+	restoreCmd.Flags().BoolVarP(&restoreForce, "force", "", false,
+		"Replace an existing configuration and onion service key")
+	RootCmd.AddCommand(restoreCmd)
+}
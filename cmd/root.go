@@ -15,18 +15,35 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 
 	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/secrets"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
-var cfgFile string
+var (
+	cfgFile string
+	// dryRun is set by --dry-run, which is only accepted by commands which
+	// change something. They print the tor configuration they would apply,
+	// instead of changing anything.
+	dryRun bool
+	// showSecrets is set by --show-secrets, with which a dry run prints
+	// client authorization cookies in clear.
+	showSecrets bool
+	// changed is set once a command has made the change it is recorded in
+	// the audit log for. Commands which turn out to change nothing are not
+	// recorded.
+	changed bool
+)
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -52,6 +69,14 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ormesh.yaml)")
 }
 
+// addDryRunFlag adds --dry-run to a command which changes something.
+func addDryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"Print the tor configuration a change would apply, without making it")
+	cmd.Flags().BoolVar(&showSecrets, "show-secrets", false,
+		"With --dry-run, print client authorization cookies rather than redacting them")
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile == "" {
@@ -98,8 +123,38 @@ func withConfigForUpdate(f func(*config.Config) error) {
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
-	err = config.WriteFile(cfg, cfgFile)
+	if dryRun {
+		err = printDryRun(cfg)
+	} else {
+		err = writeConfig(cfg)
+	}
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 }
+
+// writeConfig writes a changed configuration, moving auth tokens into the
+// secrets store if one is configured, and deleting those the configuration
+// no longer refers to from it. It sets changed if the file written differs
+// from the one it replaced.
+func writeConfig(cfg *config.Config) error {
+	before, _ := ioutil.ReadFile(cfgFile)
+	var prev []string
+	if written, err := config.ReadFile(cfgFile); err == nil && reflect.DeepEqual(written.Node.Secrets, cfg.Node.Secrets) {
+		prev = secrets.Refs(&written.Node)
+	}
+	err := externalizeSecrets(cfg, prev)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = config.WriteFile(cfg, cfgFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	after, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	changed = !bytes.Equal(before, after)
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+)
+
+func TestWriteConfigChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ormesh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { cfgFile = path; changed = false }(cfgFile)
+	cfgFile = filepath.Join(dir, "ormesh.toml")
+	cfg, err := config.NewFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, writeConfig(cfg))
+	assert.False(t, changed)
+
+	cfg.Node.Remotes = append(cfg.Node.Remotes, config.Remote{Name: "server", Address: "abcdefghijklmnop.onion"})
+	assert.NoError(t, writeConfig(cfg))
+	assert.True(t, changed)
+}
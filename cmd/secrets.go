@@ -0,0 +1,90 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/secrets"
+)
+
+// secretsCmd represents the secrets command
+var secretsCmd = &cobra.Command{
+	Use:   "secrets <command> ...",
+	Short: "Secrets store commands",
+}
+
+var (
+	// secretStore is the store opened for secretStoreConfig, kept so that
+	// a passphrase is only asked for once.
+	secretStore       secrets.Store
+	secretStoreConfig *config.Secrets
+	// resolvedSecrets are the secrets read from the store, by ID, so that
+	// only those which have changed are stored again.
+	resolvedSecrets = map[string]string{}
+)
+
+// openSecrets returns the secrets store configured for cfg, which is nil if
+// secrets are kept in the configuration.
+func openSecrets(cfg *config.Config) (secrets.Store, error) {
+	if secretStoreConfig != nil && reflect.DeepEqual(*secretStoreConfig, cfg.Node.Secrets) {
+		return secretStore, nil
+	}
+	store, err := secrets.Open(cfg, func(confirm bool) ([]byte, error) {
+		return readPassphrase(secretsPassphraseEnv, "Secrets passphrase", confirm)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	storeConfig := cfg.Node.Secrets
+	secretStore, secretStoreConfig = store, &storeConfig
+	return store, nil
+}
+
+// resolveSecrets reads the auth tokens the configuration refers to from the
+// secrets store, for commands which use them.
+func resolveSecrets(cfg *config.Config) error {
+	store, err := openSecrets(cfg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = secrets.Resolve(&cfg.Node, store)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for id, value := range secrets.Resolved(&cfg.Node) {
+		resolvedSecrets[id] = value
+	}
+	return nil
+}
+
+// externalizeSecrets moves auth tokens added or changed in the configuration
+// to the secrets store, before it is written, and deletes those of prev, the
+// IDs the configuration referred to before, which it no longer refers to.
+func externalizeSecrets(cfg *config.Config, prev []string) error {
+	store, err := openSecrets(cfg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(secrets.Externalize(&cfg.Node, store, resolvedSecrets, prev))
+}
+
+func init() {
+	RootCmd.AddCommand(secretsCmd)
+}
@@ -0,0 +1,119 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/secrets"
+)
+
+// secretsInConfig is the backend name given to 'secrets migrate' to keep
+// secrets in the configuration.
+const secretsInConfig = "config"
+
+var secretsPath string
+
+// secretsMigrateCmd represents the secretsMigrate command
+var secretsMigrateCmd = &cobra.Command{
+	Use:   "migrate <backend> [--path <file>] [-- <command> [<arg> ...]]",
+	Short: "Move client and remote auth tokens to a secrets store",
+	Long: `Move the auth tokens of clients and remotes out of the configuration, into a
+secrets store, so that the configuration holds no secrets and may be shared or
+kept in version control. Backends are:
+
+  file             a file readable only by its owner
+  encrypted-file   a file encrypted with a passphrase, read from
+                   $ORMESH_SECRETS_PASSPHRASE or prompted for when needed,
+                   such as when the agent starts
+  command          a command, given after --, run with "get", "store" or
+                   "erase" and the secret's ID appended, like a git
+                   credential helper; "get" prints the secret, and "store"
+                   reads it from standard input
+  config           the configuration itself
+
+The file backends use "secrets" next to the configuration, unless --path is
+given. Secrets are copied from the current store, which is left as it was.`,
+	Example: `
+  $ ormesh secrets migrate encrypted-file
+  Secrets passphrase:
+  Confirm secrets passphrase:
+
+  $ ormesh secrets migrate command -- ormesh-pass-helper --prefix ormesh/`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			backend, command := args[0], args[1:]
+			next := config.Secrets{}
+			switch {
+			case backend == secretsInConfig:
+			case !config.IsValidSecretsBackend(backend):
+				return errors.Errorf("invalid backend %q", backend)
+			case backend == config.SecretsCommand && len(command) == 0:
+				return errors.New("a command is required")
+			default:
+				next = config.Secrets{Backend: backend, Path: secretsPath}
+				if backend == config.SecretsCommand {
+					next.Command = command
+				}
+			}
+			prev := cfg.Node.Secrets
+			if reflect.DeepEqual(prev, next) {
+				return nil
+			}
+			if isFileBackend(prev.Backend) && isFileBackend(next.Backend) {
+				nextCfg := *cfg
+				nextCfg.Node.Secrets = next
+				if secrets.FilePath(cfg) == secrets.FilePath(&nextCfg) {
+					return errors.Errorf("secrets are already in %s; choose another file with --path",
+						secrets.FilePath(cfg))
+				}
+			}
+			err := resolveSecrets(cfg)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			secrets.Inline(&cfg.Node)
+			// The secrets are stored in the new backend when the
+			// configuration is written.
+			cfg.Node.Secrets = next
+			if isFileBackend(prev.Backend) {
+				prevCfg := *cfg
+				prevCfg.Node.Secrets = prev
+				fmt.Fprintf(os.Stderr, "secrets remain in %s; delete it once the migration is verified\n",
+					secrets.FilePath(&prevCfg))
+			} else if prev.Backend == config.SecretsCommand {
+				fmt.Fprintln(os.Stderr, "secrets remain in the previous secrets command's store")
+			}
+			return nil
+		})
+	},
+}
+
+func isFileBackend(backend string) bool {
+	return backend == config.SecretsFile || backend == config.SecretsEncryptedFile
+}
+
+func init() {
+	secretsMigrateCmd.Flags().StringVarP(&secretsPath, "path", "", "", "File used by the file backends")
+	secretsCmd.AddCommand(secretsMigrateCmd)
+	addDryRunFlag(secretsMigrateCmd)
+}
@@ -0,0 +1,68 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/secrets"
+)
+
+// secretsPruneCmd represents the secretsPrune command
+var secretsPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete auth tokens the configuration no longer refers to",
+	Long: `Delete the client and remote auth tokens in the secrets store which the
+configuration does not refer to. Tokens the configuration stops referring to
+are deleted when it is changed, so this is only needed to clean up after
+editing the configuration by hand. Do not prune a store shared with another
+configuration, as its tokens would be deleted too.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			store, err := openSecrets(cfg)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if store == nil {
+				return errors.New("secrets are kept in the configuration")
+			}
+			ids, err := secrets.Unreferenced(&cfg.Node, store)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for _, id := range ids {
+				if dryRun {
+					fmt.Printf("dry run; would delete %s\n", id)
+					continue
+				}
+				if err := store.Delete(id); err != nil {
+					return errors.Wrapf(err, "failed to delete secret %q", id)
+				}
+				fmt.Printf("deleted %s\n", id)
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	secretsCmd.AddCommand(secretsPruneCmd)
+	addDryRunFlag(secretsPruneCmd)
+}
@@ -0,0 +1,200 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
+)
+
+var (
+	rotateOverlap time.Duration
+	rotateFinish  bool
+)
+
+// serviceRotateCmd represents the serviceRotate command
+var serviceRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the onion service key",
+	Long: `Generate a new onion service key, giving each client a new address and auth
+token, which are printed one client per line.
+
+The previous key is published alongside the new one for the --overlap period,
+so that clients keep working until they are given their new tokens. The agent
+then stops publishing the previous key and deletes it. With --finish, the
+previous key is retired immediately.`,
+	Example: `
+  $ ormesh service rotate --overlap 48h
+  my-MacBook 5xtbkjbk6ypjvm3k.onion Pq2XwZ1yb0mV9Ft3sUoHrC
+  contractor mqo3ldwxj4xh5yxa.onion 2hF0l+8wXkTzqT1Vn9b4aA`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfigForUpdate(func(cfg *config.Config) error {
+			if rotateFinish {
+				return finishRotation(cfg)
+			}
+			return rotateService(cfg, rotateOverlap)
+		})
+	},
+}
+
+// rotateService moves the onion service key aside, publishing it with a new
+// key until the overlap has passed, and updates the clients with their new
+// addresses and auth tokens.
+func rotateService(cfg *config.Config, overlap time.Duration) error {
+	if overlap <= 0 {
+		return errors.Errorf("invalid overlap %v", overlap)
+	}
+	svc := &cfg.Node.Service
+	now := time.Now()
+	if svc.Rotation != nil {
+		if !svc.Rotation.IsRetired(now) {
+			return errors.Errorf("the previous key is published until %s; retire it first with --finish",
+				svc.Rotation.Ends.Local().Format("2006-01-02 15:04"))
+		}
+		// The agent was not running to delete the retired key.
+		if !dryRun {
+			if err := agent.ShredDir(svc.Rotation.Dir); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		svc.Rotation = nil
+	}
+	serviceDir := cfg.Node.Agent.TorServicesDir
+	if _, err := os.Stat(filepath.Join(serviceDir, "hostname")); err != nil {
+		return errors.Errorf("no onion service key in %q to rotate", serviceDir)
+	}
+	prevDir := fmt.Sprintf("%s-%s", serviceDir, now.UTC().Format("20060102T150405"))
+	svc.Rotation = &config.Rotation{
+		Dir:     prevDir,
+		Started: now.UTC().Round(time.Second),
+		Ends:    now.Add(overlap).UTC().Round(time.Second),
+	}
+	if dryRun {
+		return nil
+	}
+	if err := os.Rename(serviceDir, prevDir); err != nil {
+		return errors.Wrap(err, "failed to move onion service key")
+	}
+	err := updateClientAccess(cfg)
+	if err != nil {
+		// Restore the previous key, so that the rotation may be retried.
+		os.RemoveAll(serviceDir)
+		if err := os.Rename(prevDir, serviceDir); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to restore onion service key from %q: %v\n", prevDir, err)
+		}
+		return errors.WithStack(err)
+	}
+	for _, client := range svc.Clients {
+		if client.IsExpired(now) {
+			continue
+		}
+		// A credential issued by 'client rotate' will replace the current one.
+		if client.Next != nil {
+			fmt.Printf("%s %s %s\n", client.Name, client.Next.Address, client.Next.Auth)
+		} else {
+			fmt.Printf("%s %s %s\n", client.Name, client.Address, client.Auth)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "the previous key is published until %s\n",
+		svc.Rotation.Ends.Local().Format("2006-01-02 15:04"))
+	return nil
+}
+
+// finishRotation retires the previous onion service key now.
+func finishRotation(cfg *config.Config) error {
+	svc := &cfg.Node.Service
+	if svc.Rotation == nil {
+		return errors.New("no onion service key rotation in progress")
+	}
+	svc.Rotation.Ends = time.Now().UTC().Round(time.Second)
+	if dryRun {
+		svc.Rotation = nil
+		return nil
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize agent")
+	}
+	err = a.Start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start agent")
+	}
+	defer a.Stop()
+	err = a.UpdateServices(svc)
+	if err != nil {
+		return errors.Wrap(err, "failed to update tor hidden services")
+	}
+	svc.Rotation = nil
+	return nil
+}
+
+// updateClientAccess applies the service configuration to tor, and records
+// the address and auth token of each active client, and of its next
+// credential if it has one. In a dry run, tor is not started and nothing is
+// issued.
+func updateClientAccess(cfg *config.Config) error {
+	if dryRun {
+		return nil
+	}
+	a, err := agent.New(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize agent")
+	}
+	err = a.Start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start agent")
+	}
+	defer a.Stop()
+	err = a.UpdateServices(&cfg.Node.Service)
+	if err != nil {
+		return errors.Wrap(err, "failed to update tor hidden services")
+	}
+	now := time.Now()
+	for i := range cfg.Node.Service.Clients {
+		client := &cfg.Node.Service.Clients[i]
+		if client.IsExpired(now) {
+			continue
+		}
+		client.Address, client.Auth, err = a.ClientAccess(client.CredentialName())
+		if err != nil {
+			return errors.Wrapf(err, "failed to read tor client auth for %q", client.Name)
+		}
+		if client.Next != nil {
+			client.Next.Address, client.Next.Auth, err = a.ClientAccess(client.Next.TorName)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read tor client auth for %q", client.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	serviceRotateCmd.Flags().DurationVarP(&rotateOverlap, "overlap", "", 72*time.Hour,
+		"Publish the previous key for this long")
+	serviceRotateCmd.Flags().BoolVarP(&rotateFinish, "finish", "", false,
+		"Retire the previous key now")
+	serviceCmd.AddCommand(serviceRotateCmd)
+	addDryRunFlag(serviceRotateCmd)
+}
@@ -0,0 +1,132 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/cmars/ormesh/agent"
+	"github.com/cmars/ormesh/config"
+)
+
+// torConfigCmd represents the torConfig command
+var torConfigCmd = &cobra.Command{
+	Use:   "tor-config",
+	Short: "Print a torrc for the node",
+	Long: `Print a complete torrc with the options the agent gives tor, for running tor
+under your own supervision.
+
+Set UseTorBrowser = true in the [Node.Agent] section of the configuration, so
+that the agent connects to that tor on its ControlAddr rather than starting
+its own. The agent still applies configuration changes through the control
+port, and saves them to the torrc tor was started with.`,
+	Example: `
+  $ ormesh tor-config > /etc/tor/ormesh.torrc`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		withConfig(func(cfg *config.Config) error {
+			err := resolveSecrets(cfg)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return errors.WithStack(agent.WriteTorrc(os.Stdout, cfg, time.Now()))
+		})
+	},
+}
+
+// printDryRun prints the tor configuration the agent would apply for a
+// changed configuration, compared with the one on disk.
+func printDryRun(cfg *config.Config) error {
+	prev, err := config.ReadFile(cfg.Path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = resolveSecrets(prev)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = resolveSecrets(cfg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	printTorConfig(os.Stdout, prev, cfg)
+	return nil
+}
+
+// printTorConfig prints the control commands with which the agent
+// configures tor for cfg, and the options in effect afterwards. If prev is
+// not nil, options added since prev are marked with + and those removed
+// with -. Client authorization cookies are redacted unless --show-secrets
+// was given.
+func printTorConfig(w io.Writer, prev, cfg *config.Config) {
+	now := time.Now()
+	fmt.Fprintln(w, "dry run; tor control commands:")
+	for _, tc := range []*agent.TorConfig{agent.ServiceTorConfig(cfg, now), agent.RemotesTorConfig(cfg)} {
+		if !showSecrets {
+			tc = tc.Redacted()
+		}
+		for _, cmd := range tc.Commands() {
+			fmt.Fprintf(w, "  %s\n", agent.FormatCmd(cmd))
+		}
+	}
+	fmt.Fprintln(w, "effective tor options:")
+	prevOpts := map[string]int{}
+	var prevLines []string
+	if prev != nil {
+		for _, opt := range torOptions(prev, now) {
+			prevOpts[opt.String()]++
+			prevLines = append(prevLines, opt.String())
+		}
+	}
+	for _, opt := range torOptions(cfg, now) {
+		line := opt.String()
+		if prev == nil {
+			fmt.Fprintf(w, "  %s\n", line)
+		} else if prevOpts[line] > 0 {
+			prevOpts[line]--
+			fmt.Fprintf(w, "  %s\n", line)
+		} else {
+			fmt.Fprintf(w, "+ %s\n", line)
+		}
+	}
+	for _, line := range prevLines {
+		if prevOpts[line] > 0 {
+			prevOpts[line]--
+			fmt.Fprintf(w, "- %s\n", line)
+		}
+	}
+}
+
+// torOptions returns the tor options for cfg, redacted for display unless
+// --show-secrets was given.
+func torOptions(cfg *config.Config, now time.Time) []agent.TorOption {
+	opts := agent.TorOptions(cfg, now)
+	if !showSecrets {
+		for i := range opts {
+			opts[i] = opts[i].Redacted()
+		}
+	}
+	return opts
+}
+
+func init() {
+	RootCmd.AddCommand(torConfigCmd)
+}
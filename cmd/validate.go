@@ -19,6 +19,8 @@ import (
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -26,6 +28,7 @@ import (
 var (
 	validateClientNameRE = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_-]+$")
 	validateRemoteNameRE = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_-]+$")
+	validateHookNameRE   = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_-]+$")
 )
 
 func IsValidClientName(name string) bool {
@@ -36,6 +39,10 @@ func IsValidRemoteName(name string) bool {
 	return validateRemoteNameRE.MatchString(name)
 }
 
+func IsValidHookName(name string) bool {
+	return validateHookNameRE.MatchString(name)
+}
+
 func NormalizeAddrPort(addr string) (string, error) {
 	if host, port, err := net.SplitHostPort(addr); err == nil {
 		if host == "" {
@@ -60,3 +67,62 @@ func NormalizeAddrPort(addr string) (string, error) {
 	}
 	return fmt.Sprintf("127.0.0.1:%d", port), nil
 }
+
+// ParseByteRate parses a rate in bytes per second, such as "512k" or "2M".
+// Suffixes k, M and G multiply by powers of 1024.
+func ParseByteRate(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid rate %q", s)
+	}
+	return n * mult, nil
+}
+
+// untilLayouts are the formats accepted by ParseUntil.
+var untilLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseUntil parses a time, such as "2026-12-01" or "2026-12-01T17:00", in
+// the local time zone unless one is given.
+func ParseUntil(s string) (time.Time, error) {
+	for _, layout := range untilLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid time %q; use a date such as 2006-01-02, or 2006-01-02T15:04", s)
+}
+
+var validateLabelKeyRE = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_./-]*$")
+
+// ParseLabels parses labels given as key=value.
+func ParseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || !validateLabelKeyRE.MatchString(parts[0]) {
+			return nil, errors.Errorf("invalid label %q; use key=value", label)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
@@ -15,8 +15,12 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
@@ -31,36 +35,481 @@ type Config struct {
 type Node struct {
 	Service Service
 	Remotes []Remote
+	Groups  []Group
+	Hooks   []Hook
 	Agent   Agent
+	Secrets Secrets
+}
+
+// Secrets configures where client and remote auth tokens are stored. They
+// are kept in the configuration itself if Backend is empty; otherwise the
+// configuration refers to them by ID, in AuthRef fields.
+type Secrets struct {
+	// Backend is one of SecretsFile, SecretsEncryptedFile or
+	// SecretsCommand.
+	Backend string
+	// Path is the file used by the file backends. Defaults to "secrets" in
+	// the configuration's directory.
+	Path string
+	// Command is run by the command backend with "get", "store" or "erase"
+	// and a secret ID appended to it, like a git credential helper. It
+	// prints the secret on "get", and reads it from standard input on
+	// "store".
+	Command []string
+}
+
+// Secrets backends.
+const (
+	// SecretsFile keeps secrets in a file readable only by its owner.
+	SecretsFile = "file"
+	// SecretsEncryptedFile keeps secrets in a file encrypted with a
+	// passphrase.
+	SecretsEncryptedFile = "encrypted-file"
+	// SecretsCommand stores and retrieves secrets with a command.
+	SecretsCommand = "command"
+)
+
+// IsValidSecretsBackend returns whether s is a known secrets backend.
+func IsValidSecretsBackend(s string) bool {
+	switch s {
+	case SecretsFile, SecretsEncryptedFile, SecretsCommand:
+		return true
+	}
+	return false
 }
 
 type Service struct {
-	Exports []Export
-	Clients []Client
+	Exports  []Export
+	Clients  []Client
+	Routes   []Route
+	Endpoint bool
+	Gateway  Gateway
+	// Rotation is set when the onion service key has been replaced, while
+	// the previous key is retired.
+	Rotation *Rotation
+}
+
+// Rotation is a previous onion service key, kept in Dir. The service is
+// published with both the previous and current keys until Ends, when the
+// previous key is deleted.
+type Rotation struct {
+	Dir     string
+	Started time.Time
+	Ends    time.Time
+}
+
+// IsRetired returns whether the previous key is no longer published at now.
+func (r *Rotation) IsRetired(now time.Time) bool {
+	return !now.Before(r.Ends)
+}
+
+// Gateway is a SOCKS5 proxy published on the onion service, through which
+// clients may connect to hosts on the allowed networks and ports. The
+// gateway is disabled if Port is zero.
+type Gateway struct {
+	Port       int
+	AllowNets  []string
+	AllowPorts []int
+}
+
+// Networks returns the parsed AllowNets.
+func (g *Gateway) Networks() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range g.AllowNets {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
 }
 
 type Export struct {
 	LocalAddr string
 	Port      int
+	// Protocol is "tcp" if empty. UDP exports are only reachable by remote
+	// ormesh agents, through the endpoint.
+	Protocol       string
+	SessionTimeout Duration
+	MaxFlows       int
+}
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// EndpointEnabled returns whether the ormesh endpoint should be published,
+// which is required to reach UDP exports.
+func (s *Service) EndpointEnabled() bool {
+	if s.Endpoint {
+		return true
+	}
+	for i := range s.Exports {
+		if s.Exports[i].IsUDP() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUDP returns whether the export is a UDP service.
+func (e *Export) IsUDP() bool {
+	return e.Protocol == ProtocolUDP
+}
+
+// HTTPRouterPort is the onion service port on which HTTP routes are
+// published.
+const HTTPRouterPort = 80
+
+// EndpointPort is the onion service port on which the ormesh endpoint is
+// published. Remote ormesh agents tunnel connections to exported services
+// through the endpoint.
+const EndpointPort = 9253
+
+// CheckPorts returns an error if two of the service's exports, HTTP routes,
+// endpoint and gateway are published on the same port. UDP exports are
+// relayed by the endpoint rather than published, and only conflict with each
+// other.
+func (s *Service) CheckPorts() error {
+	type portKey struct {
+		udp  bool
+		port int
+	}
+	users := map[portKey]string{}
+	use := func(udp bool, port int, user string) error {
+		key := portKey{udp, port}
+		if prev, ok := users[key]; ok {
+			return errors.Errorf("port %d is used by both %s and %s", port, prev, user)
+		}
+		users[key] = user
+		return nil
+	}
+	for _, export := range s.Exports {
+		name := fmt.Sprintf("export to %q", export.LocalAddr)
+		if err := use(export.IsUDP(), export.Port, name); err != nil {
+			return err
+		}
+	}
+	if len(s.Routes) > 0 {
+		if err := use(false, HTTPRouterPort, "HTTP routes"); err != nil {
+			return err
+		}
+	}
+	if s.EndpointEnabled() {
+		if err := use(false, EndpointPort, "the endpoint"); err != nil {
+			return err
+		}
+	}
+	if s.Gateway.Port != 0 {
+		if err := use(false, s.Gateway.Port, "the gateway"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Route maps HTTP requests to a local backend, by Host header and/or path
+// prefix. A Host matches requests for that host and its subdomains, so
+// "grafana" matches "grafana.my-server" as well as "grafana.<onion>".
+type Route struct {
+	Host        string
+	PathPrefix  string
+	Backend     string
+	StripPrefix bool
 }
 
 type Client struct {
 	Name    string
 	Address string
 	Auth    string
+	// AuthRef is the ID of Auth in the secrets store, if it is kept there.
+	AuthRef string
+	// TorName is the name under which tor knows the client's credential,
+	// if it is not Name.
+	TorName string
+	// Expires is when the client's authorization is revoked, if not nil.
+	Expires *time.Time
+	// Next is a credential issued to replace Address and Auth, if not nil.
+	Next *Credential
+	Metadata
+}
+
+// Credential is a client authorization issued alongside the client's current
+// one. It replaces the current one when the grace period ends.
+type Credential struct {
+	TorName   string
+	Address   string
+	Auth      string
+	AuthRef   string
+	Issued    time.Time
+	GraceEnds time.Time
+}
+
+// CredentialName returns the name under which tor knows the client's current
+// credential.
+func (c *Client) CredentialName() string {
+	if c.TorName != "" {
+		return c.TorName
+	}
+	return c.Name
+}
+
+// PromoteNext replaces the client's current credential with the next one.
+func (c *Client) PromoteNext() {
+	if c.Next == nil {
+		return
+	}
+	c.TorName, c.Address, c.Auth = c.Next.TorName, c.Next.Address, c.Next.Auth
+	c.AuthRef = c.Next.AuthRef
+	c.Next = nil
+}
+
+// Metadata records who added a client or remote and why.
+type Metadata struct {
+	// CreatedAt and CreatedBy record when, and by which user, it was
+	// added.
+	CreatedAt *time.Time
+	CreatedBy string
+	// Notes and Labels are free-form.
+	Notes  string
+	Labels map[string]string
+}
+
+// IsExpired returns whether the client's authorization has expired at now.
+func (c *Client) IsExpired(now time.Time) bool {
+	return c.Expires != nil && !now.Before(*c.Expires)
 }
 
 type Remote struct {
-	Name    string
-	Address string
-	Auth    string
-	Imports []Import
+	Name       string
+	Address    string
+	Auth       string
+	AuthRef    string
+	Imports    []Import
+	AllowPorts []int
+	Tunnel     bool
+	Metadata
+}
+
+// AllowsPort returns whether port may be reached on the remote through the
+// agent's mesh proxies. All ports are allowed if AllowPorts is empty.
+func (r *Remote) AllowsPort(port int) bool {
+	if len(r.AllowPorts) == 0 {
+		return true
+	}
+	for _, allowPort := range r.AllowPorts {
+		if allowPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Group is a set of remotes running the same services, from which services
+// may be imported with failover or load balancing.
+type Group struct {
+	Name     string
+	Remotes  []string
+	Strategy string
+	Imports  []Import
+}
+
+// Strategies for choosing which remote in a group to connect to.
+const (
+	// StrategyFailover tries remotes in the configured order.
+	StrategyFailover = "failover"
+	// StrategyRoundRobin rotates through the remotes.
+	StrategyRoundRobin = "round-robin"
+	// StrategyLatency tries the remote with the lowest recent connect
+	// latency first.
+	StrategyLatency = "latency"
+)
+
+// IsValidStrategy returns whether s is a known group strategy.
+func IsValidStrategy(s string) bool {
+	switch s {
+	case StrategyFailover, StrategyRoundRobin, StrategyLatency:
+		return true
+	}
+	return false
 }
 
 type Import struct {
 	LocalAddr  string
 	LocalPort  int
 	RemotePort int
+	// Protocol is "tcp" if empty. UDP imports are tunneled to the remote's
+	// ormesh endpoint, which relays datagrams to a UDP export.
+	Protocol       string
+	SessionTimeout Duration
+	MaxFlows       int
+	// DialTimeout bounds each attempt to connect to the remote.
+	DialTimeout Duration
+	// DialRetries is the number of times a failed connection to the remote
+	// is retried, waiting RetryBackoff before the first retry and twice as
+	// long before each following one. Zero means DefaultDialRetries, and a
+	// negative number disables retries.
+	DialRetries  int
+	RetryBackoff Duration
+	// MaxConns limits the number of concurrent connections, if not zero.
+	MaxConns int
+	// IdleTimeout closes connections with no traffic in either direction for
+	// this long, and MaxLifetime closes connections open this long, if not
+	// zero.
+	IdleTimeout Duration
+	MaxLifetime Duration
+	// ReadRate limits the rate at which data is read from local
+	// connections and sent to the remote, and WriteRate the rate at which
+	// data from the remote is written to local connections, in bytes per
+	// second across all connections, if not zero.
+	ReadRate  int
+	WriteRate int
+}
+
+// IsUDP returns whether the import is a UDP service.
+func (i *Import) IsUDP() bool {
+	return i.Protocol == ProtocolUDP
+}
+
+// Retries returns the number of times a failed connection to the remote is
+// retried.
+func (i *Import) Retries() int {
+	switch {
+	case i.DialRetries < 0:
+		return 0
+	case i.DialRetries == 0:
+		return DefaultDialRetries
+	}
+	return i.DialRetries
+}
+
+// DefaultSessionTimeout is how long a UDP flow may be idle before it is
+// discarded, if not configured.
+const DefaultSessionTimeout = 2 * time.Minute
+
+// MinSessionTimeout is the shortest UDP session timeout which may be
+// configured.
+const MinSessionTimeout = time.Second
+
+// CheckSessionTimeout returns an error if d is not a valid UDP session
+// timeout. Zero is valid, and means DefaultSessionTimeout.
+func CheckSessionTimeout(d time.Duration) error {
+	if d != 0 && d < MinSessionTimeout {
+		return errors.Errorf("invalid session timeout %v: must be at least %v", d, MinSessionTimeout)
+	}
+	return nil
+}
+
+// DefaultMaxFlows is the maximum number of concurrent UDP flows, if not
+// configured.
+const DefaultMaxFlows = 256
+
+// DefaultDialTimeout bounds connection attempts to a remote, if not
+// configured.
+const DefaultDialTimeout = 2 * time.Minute
+
+// DefaultDialRetries is the number of times a failed connection to a remote
+// is retried, if not configured.
+const DefaultDialRetries = 2
+
+// DefaultRetryBackoff is the wait before retrying a failed connection to a
+// remote, if not configured.
+const DefaultRetryBackoff = time.Second
+
+// Hook runs a command, or posts to a webhook, when the agent reports one of
+// its events.
+type Hook struct {
+	Name   string
+	Events []string
+	// Command is run with details of the event in ORMESH_* environment
+	// variables.
+	Command []string
+	// URL is sent an HTTP POST of the event as a JSON object.
+	URL string
+	// Timeout bounds how long the command or POST may take, and defaults to
+	// DefaultHookTimeout if zero.
+	Timeout Duration
+	// Debounce delays running the hook after an event by this long, so that
+	// events about the same subject in the meantime are combined into one
+	// run with the latest of them. It defaults to DefaultHookDebounce if
+	// zero.
+	Debounce Duration
+}
+
+// Events which may run hooks.
+const (
+	// HookAgentReady occurs when tor has connected to the tor network.
+	HookAgentReady = "agent-ready"
+	// HookRemoteUp and HookRemoteDown occur when connections to a remote
+	// succeed after failing, or fail after succeeding.
+	HookRemoteUp   = "remote-up"
+	HookRemoteDown = "remote-down"
+	// HookDescriptorPublished and HookDescriptorFailed occur when a
+	// descriptor of the node's onion service is accepted by an HSDir, or
+	// rejected by all of the HSDirs it was uploaded to.
+	HookDescriptorPublished = "descriptor-published"
+	HookDescriptorFailed    = "descriptor-failed"
+	// HookClientAdded and HookClientRevoked occur when clients are added
+	// to or removed from the node's service.
+	HookClientAdded   = "client-added"
+	HookClientRevoked = "client-revoked"
+	// HookConfigReloaded occurs when a changed configuration is applied.
+	HookConfigReloaded = "config-reloaded"
+)
+
+// HookEvents are all the events which may run hooks.
+var HookEvents = []string{
+	HookAgentReady,
+	HookRemoteUp,
+	HookRemoteDown,
+	HookDescriptorPublished,
+	HookDescriptorFailed,
+	HookClientAdded,
+	HookClientRevoked,
+	HookConfigReloaded,
+}
+
+// IsValidHookEvent returns whether s is a known hook event.
+func IsValidHookEvent(s string) bool {
+	for _, event := range HookEvents {
+		if s == event {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultHookTimeout bounds hook commands and webhooks, if not configured.
+const DefaultHookTimeout = 30 * time.Second
+
+// DefaultHookDebounce is the delay before running a hook, if not configured.
+const DefaultHookDebounce = 10 * time.Second
+
+// Duration is a time.Duration encoded as a string, such as "90s".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return errors.WithStack(err)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Or returns d, or def if d is zero.
+func (d Duration) Or(def time.Duration) time.Duration {
+	if d.Duration == 0 {
+		return def
+	}
+	return d.Duration
 }
 
 type Agent struct {
@@ -72,6 +521,50 @@ type Agent struct {
 	ControlAddr    string
 	ControlCookie  string
 	UseTorBrowser  bool
+	MeshSocksAddr  string
+	MeshHTTPAddr   string
+	HTTPRouterAddr string
+	EndpointAddr   string
+	GatewayAddr    string
+	APIAddr        string
+	// PrefetchDescriptors fetches each remote's onion service descriptor
+	// once tor has bootstrapped, so that the first connection is faster.
+	PrefetchDescriptors bool
+	// MetricsAddr is the address on which to serve Prometheus metrics at
+	// /metrics. Metrics are not served if it is empty.
+	MetricsAddr string
+	// LogLevel is the minimum severity logged by the agent: debug, info,
+	// warn or error. Defaults to info.
+	LogLevel string
+	// LogFormat is either "text" (the default) or "json".
+	LogFormat string
+}
+
+// CheckListenAddrs returns an error if two of the agent's local addresses are
+// the same, as the agent could not listen on both.
+func (a *Agent) CheckListenAddrs() error {
+	used := map[string]string{}
+	for _, addr := range []struct{ key, value string }{
+		{"SocksAddr", a.SocksAddr},
+		{"ControlAddr", a.ControlAddr},
+		{"MeshSocksAddr", a.MeshSocksAddr},
+		{"MeshHTTPAddr", a.MeshHTTPAddr},
+		{"HTTPRouterAddr", a.HTTPRouterAddr},
+		{"EndpointAddr", a.EndpointAddr},
+		{"GatewayAddr", a.GatewayAddr},
+		{"APIAddr", a.APIAddr},
+		{"MetricsAddr", a.MetricsAddr},
+	} {
+		if addr.value == "" || strings.HasSuffix(addr.value, ":0") {
+			// Port zero is chosen by the system when listening.
+			continue
+		}
+		if key, ok := used[addr.value]; ok {
+			return errors.Errorf("%s and %s are both %q", key, addr.key, addr.value)
+		}
+		used[addr.value] = addr.key
+	}
+	return nil
 }
 
 func (c *Config) defaults(md *toml.MetaData) {
@@ -90,6 +583,18 @@ func (c *Config) defaults(md *toml.MetaData) {
 	if c.Node.Agent.ControlAddr == "" && !md.IsDefined("Node", "Agent", "ControlAddr") {
 		c.Node.Agent.ControlAddr = "127.0.0.1:9251"
 	}
+	if c.Node.Agent.HTTPRouterAddr == "" && !md.IsDefined("Node", "Agent", "HTTPRouterAddr") {
+		c.Node.Agent.HTTPRouterAddr = "127.0.0.1:9252"
+	}
+	if c.Node.Agent.EndpointAddr == "" && !md.IsDefined("Node", "Agent", "EndpointAddr") {
+		c.Node.Agent.EndpointAddr = "127.0.0.1:9253"
+	}
+	if c.Node.Agent.GatewayAddr == "" && !md.IsDefined("Node", "Agent", "GatewayAddr") {
+		c.Node.Agent.GatewayAddr = "127.0.0.1:9254"
+	}
+	if c.Node.Agent.APIAddr == "" && !md.IsDefined("Node", "Agent", "APIAddr") {
+		c.Node.Agent.APIAddr = "127.0.0.1:9255"
+	}
 }
 
 func ReadFile(fpath string) (*Config, error) {
@@ -99,9 +604,54 @@ func ReadFile(fpath string) (*Config, error) {
 		return nil, errors.Wrapf(err, "failed to read config %q", fpath)
 	}
 	cfg.init(fpath, &md)
+	if err := cfg.check(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config %q", fpath)
+	}
+	return &cfg, nil
+}
+
+// Parse parses a configuration, as if it were read from fpath.
+func Parse(data []byte, fpath string) (*Config, error) {
+	var cfg Config
+	md, err := toml.Decode(string(data), &cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+	cfg.init(fpath, &md)
+	if err := cfg.check(); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
 	return &cfg, nil
 }
 
+// check returns an error if the configuration has values the agent cannot
+// run with.
+func (c *Config) check() error {
+	for _, export := range c.Node.Service.Exports {
+		if err := CheckSessionTimeout(export.SessionTimeout.Duration); err != nil {
+			return errors.Wrapf(err, "export %d", export.Port)
+		}
+	}
+	for _, remote := range c.Node.Remotes {
+		for _, import_ := range remote.Imports {
+			if err := CheckSessionTimeout(import_.SessionTimeout.Duration); err != nil {
+				return errors.Wrapf(err, "remote %q import %d", remote.Name, import_.RemotePort)
+			}
+		}
+	}
+	for _, group := range c.Node.Groups {
+		for _, import_ := range group.Imports {
+			if err := CheckSessionTimeout(import_.SessionTimeout.Duration); err != nil {
+				return errors.Wrapf(err, "group %q import %d", group.Name, import_.RemotePort)
+			}
+		}
+	}
+	if err := c.Node.Agent.CheckListenAddrs(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
 func NewFile(fpath string) (*Config, error) {
 	cfg := Config{}
 	cfg.init(fpath, &toml.MetaData{})
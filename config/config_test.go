@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -63,6 +64,10 @@ func TestRoundTrip(t *testing.T) {
 				TorDataDir:     "/path/to/tor/data",
 				TorServicesDir: "/path/to/tor/services",
 				ControlCookie:  "yum",
+				HTTPRouterAddr: "127.0.0.1:9252",
+				EndpointAddr:   "127.0.0.1:9253",
+				GatewayAddr:    "127.0.0.1:9254",
+				APIAddr:        "127.0.0.1:9255",
 			},
 			Service: Service{
 				Exports: []Export{{
@@ -86,3 +91,196 @@ func TestRoundTrip(t *testing.T) {
 	}
 	assert.Equal(t, &config, config2)
 }
+
+func TestDurationRoundTrip(t *testing.T) {
+	fpath := tempFile(t)
+	defer os.Remove(fpath)
+	cfg, err := ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	cfg.Node.Remotes = []Remote{{
+		Name:    "alice",
+		Address: "asdfghjkl.onion",
+		Imports: []Import{{
+			LocalAddr:      "127.0.0.1",
+			LocalPort:      5353,
+			RemotePort:     53,
+			Protocol:       ProtocolUDP,
+			SessionTimeout: Duration{90 * time.Second},
+		}},
+	}}
+	err = WriteFile(cfg, fpath)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg2, err := ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	import_ := cfg2.Node.Remotes[0].Imports[0]
+	assert.True(t, import_.IsUDP())
+	assert.Equal(t, 90*time.Second, import_.SessionTimeout.Duration)
+	assert.Equal(t, DefaultSessionTimeout, Duration{}.Or(DefaultSessionTimeout))
+}
+
+func TestInvalidSessionTimeout(t *testing.T) {
+	for _, timeout := range []string{"-1s", "10ms"} {
+		_, err := Parse([]byte(`
+[[Node.Service.Exports]]
+LocalAddr = "127.0.0.1:53"
+Port = 53
+Protocol = "udp"
+SessionTimeout = "`+timeout+`"
+`), "/tmp/config.toml")
+		assert.Error(t, err, timeout)
+	}
+	_, err := Parse([]byte(`
+[[Node.Remotes]]
+Name = "alice"
+Address = "asdfghjkl.onion"
+[[Node.Remotes.Imports]]
+LocalPort = 5353
+RemotePort = 53
+Protocol = "udp"
+SessionTimeout = "0s"
+`), "/tmp/config.toml")
+	assert.NoError(t, err)
+}
+
+func TestDuplicateListenAddrs(t *testing.T) {
+	_, err := Parse([]byte(`
+[Node.Agent]
+MeshSocksAddr = "127.0.0.1:9256"
+MeshHTTPAddr = "127.0.0.1:9257"
+MetricsAddr = "127.0.0.1:9258"
+`), "/tmp/config.toml")
+	assert.NoError(t, err)
+	_, err = Parse([]byte(`
+[Node.Agent]
+MeshSocksAddr = "127.0.0.1:9255"
+`), "/tmp/config.toml")
+	assert.Error(t, err)
+	_, err = Parse([]byte(`
+[Node.Agent]
+MeshHTTPAddr = "127.0.0.1:9256"
+MetricsAddr = "127.0.0.1:9256"
+`), "/tmp/config.toml")
+	assert.Error(t, err)
+}
+
+func TestClientExpiry(t *testing.T) {
+	fpath := tempFile(t)
+	defer os.Remove(fpath)
+	cfg, err := ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	expires := time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)
+	cfg.Node.Service.Clients = []Client{{
+		Name:    "contractor",
+		Address: "qwertyuiop.onion",
+		Expires: &expires,
+	}, {
+		Name:    "bob",
+		Address: "asdfghjkl.onion",
+	}}
+	err = WriteFile(cfg, fpath)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg2, err := ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	clients := cfg2.Node.Service.Clients
+	if assert.NotNil(t, clients[0].Expires) {
+		assert.True(t, expires.Equal(*clients[0].Expires))
+	}
+	assert.Nil(t, clients[1].Expires)
+	assert.False(t, clients[0].IsExpired(expires.Add(-time.Second)))
+	assert.True(t, clients[0].IsExpired(expires))
+	assert.False(t, clients[1].IsExpired(expires))
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	fpath := tempFile(t)
+	defer os.Remove(fpath)
+	cfg, err := ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	createdAt := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	md := Metadata{
+		CreatedAt: &createdAt,
+		CreatedBy: "alice@laptop",
+		Notes:     "on-call rotation",
+		Labels:    map[string]string{"team": "ops"},
+	}
+	cfg.Node.Service.Clients = []Client{{Name: "pager", Metadata: md}}
+	cfg.Node.Remotes = []Remote{{Name: "web", Address: "asdfghjkl.onion", Metadata: md}}
+	err = WriteFile(cfg, fpath)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg2, err := ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	for _, md2 := range []Metadata{cfg2.Node.Service.Clients[0].Metadata, cfg2.Node.Remotes[0].Metadata} {
+		if assert.NotNil(t, md2.CreatedAt) {
+			assert.True(t, createdAt.Equal(*md2.CreatedAt))
+		}
+		assert.Equal(t, md.CreatedBy, md2.CreatedBy)
+		assert.Equal(t, md.Notes, md2.Notes)
+		assert.Equal(t, md.Labels, md2.Labels)
+	}
+}
+
+func TestCheckPorts(t *testing.T) {
+	routes := []Route{{Host: "grafana", Backend: "127.0.0.1:3000"}}
+	tests := []struct {
+		service Service
+		ok      bool
+	}{{
+		Service{Exports: []Export{{LocalAddr: "127.0.0.1:22", Port: 22}}}, true,
+	}, {
+		Service{Exports: []Export{
+			{LocalAddr: "127.0.0.1:53", Port: 53},
+			{LocalAddr: "127.0.0.1:53", Port: 53, Protocol: ProtocolUDP},
+		}}, true,
+	}, {
+		Service{Exports: []Export{
+			{LocalAddr: "127.0.0.1:22", Port: 22},
+			{LocalAddr: "127.0.0.1:2222", Port: 22},
+		}}, false,
+	}, {
+		Service{Exports: []Export{{LocalAddr: "127.0.0.1:8080", Port: 80}}, Routes: routes}, false,
+	}, {
+		Service{Exports: []Export{{LocalAddr: "127.0.0.1:8080", Port: 80}}}, true,
+	}, {
+		Service{Routes: routes, Gateway: Gateway{Port: 80}}, false,
+	}, {
+		Service{Endpoint: true, Gateway: Gateway{Port: EndpointPort}}, false,
+	}, {
+		Service{Exports: []Export{{LocalAddr: "127.0.0.1:53", Port: 53, Protocol: ProtocolUDP}},
+			Gateway: Gateway{Port: EndpointPort}}, false,
+	}, {
+		Service{Exports: []Export{{LocalAddr: "127.0.0.1:1080", Port: 1080}},
+			Gateway: Gateway{Port: 1080}}, false,
+	}}
+	for i, test := range tests {
+		err := test.service.CheckPorts()
+		if test.ok {
+			assert.NoError(t, err, "test %d", i)
+		} else {
+			assert.Error(t, err, "test %d", i)
+		}
+	}
+}
+
+func TestImportRetries(t *testing.T) {
+	assert.Equal(t, DefaultDialRetries, (&Import{}).Retries())
+	assert.Equal(t, 5, (&Import{DialRetries: 5}).Retries())
+	assert.Equal(t, 0, (&Import{DialRetries: -1}).Retries())
+}
@@ -0,0 +1,242 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging provides leveled logging with key-value fields, written as
+// text or JSON lines.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, in increasing severity.
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name: debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return Warn, nil
+	}
+	return Info, errors.Errorf("invalid log level %q", s)
+}
+
+// output is shared by a Logger and those derived from it with With.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+	now   func() time.Time
+}
+
+// Logger writes leveled log messages with key-value fields.
+type Logger struct {
+	out    *output
+	fields []field
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// New returns a Logger writing text to w at Info level.
+func New(w io.Writer) *Logger {
+	return &Logger{out: &output{w: w, level: Info, now: time.Now}}
+}
+
+var std = New(os.Stderr)
+
+// Default returns the default Logger, which writes to standard error.
+func Default() *Logger {
+	return std
+}
+
+// Component returns a Logger derived from the default Logger, which adds a
+// component field to its messages.
+func Component(name string) *Logger {
+	return std.With("component", name)
+}
+
+// SetOutput sets where l, and all Loggers sharing its output, write.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w = w
+}
+
+// SetLevel sets the minimum level of messages written.
+func (l *Logger) SetLevel(level Level) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.level = level
+}
+
+// SetJSON sets whether messages are written as JSON objects, one per line,
+// rather than text.
+func (l *Logger) SetJSON(json bool) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.json = json
+}
+
+// Enabled returns whether messages at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	return level >= l.out.level
+}
+
+// With returns a Logger which adds a key-value field to each message.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{out: l.out, fields: append(fields, field{key, value})}
+}
+
+// Debugf logs a message at Debug level.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.Logf(Debug, format, args...)
+}
+
+// Infof logs a message at Info level.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Logf(Info, format, args...)
+}
+
+// Warnf logs a message at Warn level.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Logf(Warn, format, args...)
+}
+
+// Errorf logs a message at Error level.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Logf(Error, format, args...)
+}
+
+// Logf logs a message at level.
+func (l *Logger) Logf(level Level, format string, args ...interface{}) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	if level < l.out.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	var buf bytes.Buffer
+	if l.out.json {
+		l.formatJSON(&buf, level, msg)
+	} else {
+		l.formatText(&buf, level, msg)
+	}
+	l.out.w.Write(buf.Bytes())
+}
+
+func (l *Logger) formatText(buf *bytes.Buffer, level Level, msg string) {
+	buf.WriteString(l.out.now().Format("2006-01-02T15:04:05.000Z07:00"))
+	fmt.Fprintf(buf, " %-5s %s", strings.ToUpper(level.String()), strings.TrimRight(msg, "\n"))
+	for _, f := range l.fields {
+		value := fmt.Sprint(f.value)
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(buf, " %s=%s", f.key, value)
+	}
+	buf.WriteByte('\n')
+}
+
+func (l *Logger) formatJSON(buf *bytes.Buffer, level Level, msg string) {
+	doc := map[string]interface{}{}
+	for _, f := range l.fields {
+		if err, ok := f.value.(error); ok {
+			doc[f.key] = err.Error()
+		} else {
+			doc[f.key] = f.value
+		}
+	}
+	doc["time"] = l.out.now().Format(time.RFC3339Nano)
+	doc["level"] = level.String()
+	doc["msg"] = strings.TrimRight(msg, "\n")
+	out, err := json.Marshal(doc)
+	if err != nil {
+		fmt.Fprintf(buf, `{"level":"error","msg":%q}`, err.Error())
+	} else {
+		buf.Write(out)
+	}
+	buf.WriteByte('\n')
+}
+
+// Writer returns an io.Writer which logs each line written to it at level.
+// It may be used to redirect the standard library's log package.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &LineWriter{Log: func(line string) { l.Logf(level, "%s", line) }}
+}
+
+// LineWriter is an io.Writer which calls Log with each complete line written
+// to it, without its line ending.
+type LineWriter struct {
+	Log func(line string)
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			w.Log(line)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,76 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLogger() (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.out.now = func() time.Time {
+		return time.Date(2017, 11, 5, 12, 30, 0, 0, time.UTC)
+	}
+	return l, &buf
+}
+
+func TestText(t *testing.T) {
+	l, buf := testLogger()
+	l.With("component", "agent").With("conn", 7).Infof("dialing %s", "website:22")
+	l.Debugf("not logged")
+	assert.Equal(t, "2017-11-05T12:30:00.000Z INFO  dialing website:22 component=agent conn=7\n", buf.String())
+
+	buf.Reset()
+	l.SetLevel(Debug)
+	l.With("summary", "Loading relay descriptors").Debugf("bootstrap")
+	assert.Equal(t, "2017-11-05T12:30:00.000Z DEBUG bootstrap summary=\"Loading relay descriptors\"\n", buf.String())
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := testLogger()
+	l.SetJSON(true)
+	l.With("component", "tor").Warnf("descriptor upload failed")
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, map[string]interface{}{
+		"time":      "2017-11-05T12:30:00Z",
+		"level":     "warn",
+		"msg":       "descriptor upload failed",
+		"component": "tor",
+	}, doc)
+}
+
+func TestWriter(t *testing.T) {
+	l, buf := testLogger()
+	w := l.Writer(Warn)
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\r\n"))
+	assert.Equal(t, "2017-11-05T12:30:00.000Z WARN  first line\n"+
+		"2017-11-05T12:30:00.000Z WARN  second line\n", buf.String())
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, Warn, level)
+	_, err = ParseLevel("loud")
+	assert.Error(t, err)
+}
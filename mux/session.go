@@ -0,0 +1,744 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mux multiplexes many streams over a single connection, with
+// per-stream flow control and session keepalives. The framing is modeled on
+// yamux: each frame carries a 12 byte header of version, type, flags, stream
+// ID and length.
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	protoVersion = 0
+	headerSize   = 12
+
+	typeData         = 0
+	typeWindowUpdate = 1
+	typePing         = 2
+	typeGoAway       = 3
+
+	flagSYN = 1 << 0
+	flagACK = 1 << 1
+	flagFIN = 1 << 2
+	flagRST = 1 << 3
+
+	// initialWindow is the receive window each stream starts with.
+	initialWindow = 256 * 1024
+
+	// maxFrameSize bounds the payload of a single data frame.
+	maxFrameSize = 16 * 1024
+
+	acceptBacklog = 256
+)
+
+// streamCloseTimeout is how long a stream closed locally waits for the peer
+// to close its side, before it is reset and forgotten.
+var streamCloseTimeout = 2 * time.Minute
+
+var (
+	// ErrSessionClosed is returned when using a closed session.
+	ErrSessionClosed = errors.New("mux: session closed")
+
+	// ErrStreamReset is returned when using a stream reset by the peer.
+	ErrStreamReset = errors.New("mux: stream reset")
+
+	// ErrStreamClosed is returned when using a closed stream.
+	ErrStreamClosed = errors.New("mux: stream closed")
+
+	// ErrTimeout is returned when a deadline is exceeded.
+	ErrTimeout net.Error = timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Config tunes a Session.
+type Config struct {
+	// KeepAliveInterval is how often the session is pinged. The session is
+	// closed if a ping is not answered within this interval. Keepalives are
+	// disabled if zero.
+	KeepAliveInterval time.Duration
+}
+
+// DefaultConfig returns the default session configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		KeepAliveInterval: 30 * time.Second,
+	}
+}
+
+// Session multiplexes streams over a connection.
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	nextID uint32
+
+	writeMu sync.Mutex
+
+	// controlQueue holds frames without payload sent in response to frames
+	// received, which are written by controlLoop so that the receive loop
+	// never blocks on a write.
+	controlMu     sync.Mutex
+	controlQueue  []frameHeader
+	controlNotify chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	pings   map[uint32]chan struct{}
+	err     error
+
+	acceptCh chan *Stream
+	done     chan struct{}
+}
+
+// Client returns a session which opens streams over conn to a Server.
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server returns a session which accepts streams over conn from a Client.
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config *Config, firstID uint32) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	s := &Session{
+		conn:     conn,
+		config:   *config,
+		nextID:   firstID,
+		streams:  map[uint32]*Stream{},
+		pings:    map[uint32]chan struct{}{},
+		acceptCh: make(chan *Stream, acceptBacklog),
+		done:     make(chan struct{}),
+
+		controlNotify: make(chan struct{}, 1),
+	}
+	go s.recvLoop()
+	go s.controlLoop()
+	if s.config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// Open opens a new stream to the peer.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	err := s.writeFrame(typeWindowUpdate, flagSYN, id, 0, nil)
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+// Ping sends a ping to the peer and returns the round-trip time.
+func (s *Session) Ping() (time.Duration, error) {
+	ch := make(chan struct{})
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return 0, s.err
+	}
+	id := rand.Uint32()
+	s.pings[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(typePing, flagSYN, 0, id, nil); err != nil {
+		return 0, err
+	}
+	timeout := s.config.KeepAliveInterval
+	if timeout == 0 {
+		timeout = DefaultConfig().KeepAliveInterval
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, ErrTimeout
+	case <-s.done:
+		return 0, s.closeErr()
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Done returns a channel which is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// IsClosed returns whether the session is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the session and all of its streams.
+func (s *Session) Close() error {
+	s.writeFrame(typeGoAway, 0, 0, 0, nil)
+	s.shutdown(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = map[uint32]*Stream{}
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+	for _, st := range streams {
+		st.notify()
+	}
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(typ uint8, flags uint16, id, length uint32, payload []byte) error {
+	var hdr [headerSize]byte
+	hdr[0] = protoVersion
+	hdr[1] = typ
+	binary.BigEndian.PutUint16(hdr[2:4], flags)
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+	binary.BigEndian.PutUint32(hdr[8:12], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		s.shutdown(errors.Wrap(err, "mux: write failed"))
+		return s.closeErr()
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.shutdown(errors.Wrap(err, "mux: write failed"))
+			return s.closeErr()
+		}
+	}
+	return nil
+}
+
+// frameHeader is a frame without payload.
+type frameHeader struct {
+	typ    uint8
+	flags  uint16
+	id     uint32
+	length uint32
+}
+
+// queueControl queues a frame without payload to be written by controlLoop.
+func (s *Session) queueControl(typ uint8, flags uint16, id, length uint32) {
+	s.controlMu.Lock()
+	s.controlQueue = append(s.controlQueue, frameHeader{typ, flags, id, length})
+	s.controlMu.Unlock()
+	select {
+	case s.controlNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case <-s.controlNotify:
+		case <-s.done:
+			return
+		}
+		s.controlMu.Lock()
+		frames := s.controlQueue
+		s.controlQueue = nil
+		s.controlMu.Unlock()
+		for _, f := range frames {
+			if err := s.writeFrame(f.typ, f.flags, f.id, f.length, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	var hdr [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.shutdown(errors.Wrap(err, "mux: read failed"))
+			return
+		}
+		if hdr[0] != protoVersion {
+			s.shutdown(errors.Errorf("mux: unsupported protocol version %d", hdr[0]))
+			return
+		}
+		typ := hdr[1]
+		flags := binary.BigEndian.Uint16(hdr[2:4])
+		id := binary.BigEndian.Uint32(hdr[4:8])
+		length := binary.BigEndian.Uint32(hdr[8:12])
+
+		var err error
+		switch typ {
+		case typeData, typeWindowUpdate:
+			err = s.handleStreamFrame(typ, flags, id, length)
+		case typePing:
+			err = s.handlePing(flags, length)
+		case typeGoAway:
+			err = ErrSessionClosed
+		default:
+			err = errors.Errorf("mux: unknown frame type %d", typ)
+		}
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleStreamFrame(typ uint8, flags uint16, id, length uint32) error {
+	s.mu.Lock()
+	st, ok := s.streams[id]
+	if !ok && flags&flagSYN != 0 {
+		st = newStream(s, id)
+		s.streams[id] = st
+	}
+	s.mu.Unlock()
+
+	if flags&flagSYN != 0 && !ok {
+		select {
+		case s.acceptCh <- st:
+		default:
+			// Backlog full, refuse the stream.
+			s.removeStream(id)
+			st = nil
+			s.queueControl(typeWindowUpdate, flagRST, id, 0)
+		}
+		if st != nil {
+			s.queueControl(typeWindowUpdate, flagACK, id, 0)
+		}
+	}
+
+	if typ == typeWindowUpdate {
+		if st != nil {
+			st.addSendWindow(length)
+		}
+	} else if length > 0 {
+		if st == nil {
+			// Data for a stream we have closed; discard it.
+			_, err := io.CopyN(ioutil.Discard, s.conn, int64(length))
+			return errors.WithStack(err)
+		}
+		if err := st.readData(s.conn, length); err != nil {
+			return err
+		}
+	}
+	if st != nil {
+		if flags&flagFIN != 0 {
+			st.remoteClose()
+		}
+		if flags&flagRST != 0 {
+			st.reset()
+		}
+	}
+	return nil
+}
+
+func (s *Session) handlePing(flags uint16, opaque uint32) error {
+	if flags&flagSYN != 0 {
+		s.queueControl(typePing, flagACK, 0, opaque)
+		return nil
+	}
+	s.mu.Lock()
+	ch, ok := s.pings[opaque]
+	if ok {
+		delete(s.pings, opaque)
+	}
+	s.mu.Unlock()
+	if ok {
+		close(ch)
+	}
+	return nil
+}
+
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Ping(); err != nil {
+				s.shutdown(errors.Wrap(err, "mux: keepalive failed"))
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Stream is a bidirectional stream multiplexed over a Session.
+type Stream struct {
+	session *Session
+	id      uint32
+
+	mu           sync.Mutex
+	recvBuf      []byte
+	recvWindow   uint32
+	unacked      uint32
+	sendWindow   uint32
+	localClosed  bool
+	writeClosed  bool
+	remoteClosed bool
+	isReset      bool
+
+	readDeadline  atomic.Value
+	writeDeadline atomic.Value
+
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		session:    s,
+		id:         id,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+	st.readDeadline.Store(time.Time{})
+	st.writeDeadline.Store(time.Time{})
+	return st
+}
+
+// ID returns the stream identifier.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) notify() {
+	select {
+	case st.recvNotify <- struct{}{}:
+	default:
+	}
+	select {
+	case st.sendNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) readData(r io.Reader, length uint32) error {
+	st.mu.Lock()
+	if length > st.recvWindow {
+		st.mu.Unlock()
+		return errors.Errorf("mux: stream %d exceeded receive window", st.id)
+	}
+	st.recvWindow -= length
+	st.mu.Unlock()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return errors.Wrap(err, "mux: read failed")
+	}
+	st.mu.Lock()
+	discard := st.localClosed
+	if discard {
+		st.recvWindow += length
+	} else {
+		st.recvBuf = append(st.recvBuf, buf...)
+	}
+	st.mu.Unlock()
+	if discard {
+		// Nobody will read this; return the window to the peer.
+		st.session.queueControl(typeWindowUpdate, 0, st.id, length)
+		return nil
+	}
+	st.notify()
+	return nil
+}
+
+func (st *Stream) addSendWindow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mu.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	st.notify()
+}
+
+func (st *Stream) reset() {
+	st.mu.Lock()
+	st.isReset = true
+	st.mu.Unlock()
+	st.session.removeStream(st.id)
+	st.notify()
+}
+
+func waitTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
+}
+
+// Read implements net.Conn.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.recvBuf) > 0 {
+			n := copy(p, st.recvBuf)
+			st.recvBuf = st.recvBuf[n:]
+			st.unacked += uint32(n)
+			var delta uint32
+			if st.unacked >= initialWindow/2 {
+				delta, st.unacked = st.unacked, 0
+				st.recvWindow += delta
+			}
+			st.mu.Unlock()
+			if delta > 0 {
+				st.session.writeFrame(typeWindowUpdate, 0, st.id, delta, nil)
+			}
+			return n, nil
+		}
+		switch {
+		case st.isReset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.localClosed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		st.mu.Unlock()
+
+		timeout, stop := waitTimer(st.readDeadline.Load().(time.Time))
+		select {
+		case <-st.recvNotify:
+			stop()
+		case <-timeout:
+			return 0, ErrTimeout
+		case <-st.session.done:
+			stop()
+			st.mu.Lock()
+			empty := len(st.recvBuf) == 0
+			st.mu.Unlock()
+			if empty {
+				return 0, st.session.closeErr()
+			}
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (st *Stream) Write(p []byte) (int, error) {
+	var total int
+	for total < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.isReset:
+			st.mu.Unlock()
+			return total, ErrStreamReset
+		case st.writeClosed || st.localClosed:
+			st.mu.Unlock()
+			return total, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			st.mu.Unlock()
+			timeout, stop := waitTimer(st.writeDeadline.Load().(time.Time))
+			select {
+			case <-st.sendNotify:
+				stop()
+				continue
+			case <-timeout:
+				return total, ErrTimeout
+			case <-st.session.done:
+				stop()
+				return total, st.session.closeErr()
+			}
+		}
+		n := uint32(len(p) - total)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		chunk := p[total : total+int(n)]
+		if err := st.session.writeFrame(typeData, 0, st.id, n, chunk); err != nil {
+			return total, err
+		}
+		total += int(n)
+	}
+	return total, nil
+}
+
+// CloseWrite sends a FIN to the peer, after which the stream may still be
+// read until the peer closes its side.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.writeClosed || st.isReset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	st.mu.Unlock()
+	return st.session.writeFrame(typeWindowUpdate, flagFIN, st.id, 0, nil)
+}
+
+// Close closes both directions of the stream.
+func (st *Stream) Close() error {
+	err := st.CloseWrite()
+	st.mu.Lock()
+	st.localClosed = true
+	st.recvBuf = nil
+	done := st.remoteClosed || st.isReset
+	st.mu.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	} else {
+		time.AfterFunc(streamCloseTimeout, st.closeTimeout)
+	}
+	st.notify()
+	return err
+}
+
+// closeTimeout resets a stream closed locally which the peer has not closed.
+func (st *Stream) closeTimeout() {
+	st.mu.Lock()
+	if st.remoteClosed || st.isReset {
+		st.mu.Unlock()
+		return
+	}
+	st.isReset = true
+	st.mu.Unlock()
+	st.session.removeStream(st.id)
+	st.session.queueControl(typeWindowUpdate, flagRST, st.id, 0)
+}
+
+// LocalAddr implements net.Conn.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.Store(t)
+	st.notify()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.Store(t)
+	st.notify()
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sessionPair(t *testing.T) (*Session, *Session) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return Client(c, nil), Server(<-accepted, nil)
+}
+
+func TestStreamsEcho(t *testing.T) {
+	client, server := sessionPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	// Larger than the initial window, to exercise flow control.
+	payload := make([]byte, initialWindow*3)
+	rand.Read(payload)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer st.Close()
+			go func() {
+				st.Write(payload)
+				st.CloseWrite()
+			}()
+			received, err := ioutil.ReadAll(st)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(payload, received))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPingAndClose(t *testing.T) {
+	client, server := sessionPair(t)
+	defer server.Close()
+
+	_, err := client.Ping()
+	assert.NoError(t, err)
+
+	client.Close()
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server session did not close")
+	}
+	_, err = server.Accept()
+	assert.Error(t, err)
+	_, err = client.Open()
+	assert.Error(t, err)
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server := sessionPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	assert.Equal(t, ErrTimeout, err)
+}
+
+func TestSimultaneousOpen(t *testing.T) {
+	// net.Pipe is unbuffered, so a session which writes from its read loop
+	// deadlocks when its peer does the same.
+	c1, c2 := net.Pipe()
+	client, server := Client(c1, nil), Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+	// Unblock any deadlocked writes before closing the sessions.
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for _, s := range []*Session{client, server} {
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func(s *Session) {
+					defer wg.Done()
+					_, err := s.Open()
+					assert.NoError(t, err)
+				}(s)
+			}
+		}
+		wg.Wait()
+		_, err := client.Ping()
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sessions deadlocked")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	defer func(d time.Duration) { streamCloseTimeout = d }(streamCloseTimeout)
+	streamCloseTimeout = 50 * time.Millisecond
+
+	client, server := sessionPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	// The peer never closes its side.
+	st.Close()
+	assert.Equal(t, 1, client.NumStreams())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, client.NumStreams())
+	_, err = peer.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+	_, err = peer.Write([]byte("x"))
+	assert.Equal(t, ErrStreamReset, err)
+	assert.Equal(t, 0, server.NumStreams())
+}
@@ -0,0 +1,304 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package seal encrypts data with a passphrase, or to a recipient's public
+// key, with AES-256-GCM.
+//
+// A key is derived from a passphrase with PBKDF2-HMAC-SHA256. A recipient
+// key is an X25519 public key; data sealed to it is encrypted with a key
+// derived from an ephemeral key exchange, which only the matching identity
+// can repeat.
+//
+// This is ormesh's own format, not age's, and sealed data cannot be opened
+// with age. It is a header, a 12 byte nonce, and the data encrypted with
+// AES-256-GCM, authenticating the header as additional data. The header is
+// "ORMSL1", followed by either
+//
+//	'p', a 16 byte salt, and the PBKDF2 iteration count as a big-endian uint32
+//
+// for a passphrase, or
+//
+//	'r' and the 32 byte ephemeral X25519 public key
+//
+// for a recipient, whose key is the SHA-256 digest of "ormesh seal X25519",
+// the shared secret, the ephemeral public key and the recipient's public key.
+package seal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	magic = "ORMSL1"
+
+	modePassphrase = 'p'
+	modeRecipient  = 'r'
+
+	saltSize  = 16
+	keySize   = 32
+	nonceSize = 12
+
+	recipientPrefix = "ormesh-recipient-"
+	identityPrefix  = "ORMESH-IDENTITY-"
+)
+
+// Iterations is the number of PBKDF2 iterations used to derive a key from a
+// passphrase. It is recorded with the sealed data.
+var Iterations = 600000
+
+// maxIterationsFactor limits the iterations recorded with sealed data which
+// will be attempted, as a multiple of Iterations.
+const maxIterationsFactor = 10
+
+// ErrDecrypt is returned when sealed data cannot be decrypted, because the
+// passphrase or identity is wrong or the data has been modified.
+var ErrDecrypt = errors.New("decryption failed; wrong passphrase or key, or corrupted data")
+
+// IsPassphrase returns whether data was sealed with a passphrase, rather
+// than to a recipient.
+func IsPassphrase(sealed []byte) bool {
+	return len(sealed) > len(magic) && string(sealed[:len(magic)]) == magic &&
+		sealed[len(magic)] == modePassphrase
+}
+
+// WithPassphrase seals data with a passphrase.
+func WithPassphrase(data, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	var salt [saltSize]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var header bytes.Buffer
+	header.WriteString(magic)
+	header.WriteByte(modePassphrase)
+	header.Write(salt[:])
+	binary.Write(&header, binary.BigEndian, uint32(Iterations))
+	key := pbkdf2(passphrase, salt[:], Iterations, keySize)
+	return encrypt(header.Bytes(), key, data)
+}
+
+// OpenPassphrase opens data sealed with a passphrase.
+func OpenPassphrase(sealed, passphrase []byte) ([]byte, error) {
+	headerSize := len(magic) + 1 + saltSize + 4
+	if !IsPassphrase(sealed) || len(sealed) < headerSize {
+		return nil, errors.New("not sealed with a passphrase")
+	}
+	salt := sealed[len(magic)+1 : len(magic)+1+saltSize]
+	iterations := binary.BigEndian.Uint32(sealed[headerSize-4 : headerSize])
+	// Bound the work a crafted header can demand.
+	if iterations == 0 || iterations > uint32(maxIterationsFactor*Iterations) {
+		return nil, errors.Errorf("invalid iteration count %d", iterations)
+	}
+	key := pbkdf2(passphrase, salt, int(iterations), keySize)
+	return decrypt(sealed[:headerSize], key, sealed[headerSize:])
+}
+
+// Recipient is a public key to which data may be sealed.
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// String encodes the recipient.
+func (r *Recipient) String() string {
+	return recipientPrefix + base64.RawURLEncoding.EncodeToString(r.key.Bytes())
+}
+
+// ParseRecipient parses a recipient encoded by Recipient.String.
+func ParseRecipient(s string) (*Recipient, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, recipientPrefix) {
+		return nil, errors.Errorf("invalid recipient %q", s)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(recipientPrefix):])
+	if err != nil {
+		return nil, errors.Errorf("invalid recipient %q", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, errors.Errorf("invalid recipient %q", s)
+	}
+	return &Recipient{key: key}, nil
+}
+
+// Identity is a private key, which opens data sealed to its recipient.
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// NewIdentity generates an identity.
+func NewIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Identity{key: key}, nil
+}
+
+// Recipient returns the recipient whose sealed data the identity opens.
+func (id *Identity) Recipient() *Recipient {
+	return &Recipient{key: id.key.PublicKey()}
+}
+
+// String encodes the identity.
+func (id *Identity) String() string {
+	return identityPrefix + base64.RawURLEncoding.EncodeToString(id.key.Bytes())
+}
+
+// ParseIdentity parses an identity encoded by Identity.String. Lines
+// starting with # are ignored, so that an identity file may be commented.
+func ParseIdentity(s string) (*Identity, error) {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, identityPrefix) {
+			break
+		}
+		b, err := base64.RawURLEncoding.DecodeString(line[len(identityPrefix):])
+		if err != nil {
+			break
+		}
+		key, err := ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			break
+		}
+		return &Identity{key: key}, nil
+	}
+	return nil, errors.New("invalid identity")
+}
+
+// ToRecipient seals data to a recipient.
+func ToRecipient(data []byte, r *Recipient) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	shared, err := ephemeral.ECDH(r.key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var header bytes.Buffer
+	header.WriteString(magic)
+	header.WriteByte(modeRecipient)
+	header.Write(ephemeral.PublicKey().Bytes())
+	key := recipientKey(shared, ephemeral.PublicKey(), r.key)
+	return encrypt(header.Bytes(), key, data)
+}
+
+// OpenIdentity opens data sealed to the identity's recipient.
+func OpenIdentity(sealed []byte, id *Identity) ([]byte, error) {
+	headerSize := len(magic) + 1 + 32
+	if len(sealed) < headerSize || string(sealed[:len(magic)]) != magic ||
+		sealed[len(magic)] != modeRecipient {
+		return nil, errors.New("not sealed to a recipient")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[len(magic)+1 : headerSize])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	shared, err := id.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	key := recipientKey(shared, ephemeral, id.key.PublicKey())
+	return decrypt(sealed[:headerSize], key, sealed[headerSize:])
+}
+
+// recipientKey derives an encryption key from a shared secret, bound to the
+// public keys which agreed on it.
+func recipientKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) []byte {
+	h := sha256.New()
+	h.Write([]byte("ormesh seal X25519"))
+	h.Write(shared)
+	h.Write(ephemeral.Bytes())
+	h.Write(recipient.Bytes())
+	return h.Sum(nil)
+}
+
+// encrypt returns the header, a random nonce, and the data encrypted and
+// authenticated along with the header.
+func encrypt(header, key, data []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sealed := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(sealed, nonce, data, header), nil
+}
+
+func decrypt(header, key, rest []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(rest) < nonceSize {
+		return nil, ErrDecrypt
+	}
+	data, err := aead.Open(nil, rest[:nonceSize], rest[nonceSize:], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return data, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2 derives a key from a password, as defined by RFC 8018, with
+// HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,84 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seal
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11.
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	assert.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"+
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783", hex.EncodeToString(key))
+}
+
+func TestPassphrase(t *testing.T) {
+	defer func(n int) { Iterations = n }(Iterations)
+	Iterations = 1000
+
+	sealed, err := WithPassphrase([]byte("onion keys"), []byte("hunter2"))
+	assert.NoError(t, err)
+	assert.True(t, IsPassphrase(sealed))
+	data, err := OpenPassphrase(sealed, []byte("hunter2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "onion keys", string(data))
+
+	_, err = OpenPassphrase(sealed, []byte("hunter3"))
+	assert.Equal(t, ErrDecrypt, err)
+	sealed[len(sealed)-1] ^= 1
+	_, err = OpenPassphrase(sealed, []byte("hunter2"))
+	assert.Equal(t, ErrDecrypt, err)
+}
+
+func TestPassphraseIterations(t *testing.T) {
+	defer func(n int) { Iterations = n }(Iterations)
+	Iterations = 1000
+
+	sealed, err := WithPassphrase([]byte("onion keys"), []byte("hunter2"))
+	assert.NoError(t, err)
+	binary.BigEndian.PutUint32(sealed[len(magic)+1+saltSize:], 1<<31)
+	_, err = OpenPassphrase(sealed, []byte("hunter2"))
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrDecrypt, err)
+}
+
+func TestRecipient(t *testing.T) {
+	id, err := NewIdentity()
+	assert.NoError(t, err)
+	id2, err := ParseIdentity("# created by ormesh\n" + id.String() + "\n")
+	assert.NoError(t, err)
+	r, err := ParseRecipient(id2.Recipient().String())
+	assert.NoError(t, err)
+
+	sealed, err := ToRecipient([]byte("onion keys"), r)
+	assert.NoError(t, err)
+	assert.False(t, IsPassphrase(sealed))
+	data, err := OpenIdentity(sealed, id)
+	assert.NoError(t, err)
+	assert.Equal(t, "onion keys", string(data))
+
+	other, err := NewIdentity()
+	assert.NoError(t, err)
+	_, err = OpenIdentity(sealed, other)
+	assert.Equal(t, ErrDecrypt, err)
+
+	_, err = ParseRecipient("ormesh-recipient-nope")
+	assert.Error(t, err)
+}
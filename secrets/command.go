@@ -0,0 +1,65 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// commandStore stores secrets with an external command, in the manner of a
+// git credential helper.
+type commandStore struct {
+	command []string
+}
+
+func (s *commandStore) run(op, id string, stdin string) (string, error) {
+	args := append(append([]string{}, s.command[1:]...), op, id)
+	cmd := exec.Command(s.command[0], args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "secrets command %q %s failed", s.command[0], op)
+	}
+	return stdout.String(), nil
+}
+
+func (s *commandStore) Get(id string) (string, error) {
+	out, err := s.run("get", id, "")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	value := strings.TrimRight(out, "\r\n")
+	if value == "" {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *commandStore) Set(id, value string) error {
+	_, err := s.run("store", id, value+"\n")
+	return errors.WithStack(err)
+}
+
+func (s *commandStore) Delete(id string) error {
+	_, err := s.run("erase", id, "")
+	return errors.WithStack(err)
+}
@@ -0,0 +1,182 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/seal"
+)
+
+// fileStore keeps secrets in a JSON object in a file readable only by its
+// owner, encrypted if it has a passphrase. The file is read again when it
+// changes, so that a long-running agent sees secrets stored by the CLI.
+type fileStore struct {
+	path       string
+	passphrase PassphraseFunc
+
+	mu      sync.Mutex
+	key     []byte
+	secrets map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func (s *fileStore) encrypted() bool {
+	return s.passphrase != nil
+}
+
+// load returns the secrets in the file.
+func (s *fileStore) load() (map[string]string, error) {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if s.secrets != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.secrets, nil
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, errors.Errorf("secrets file %q is accessible by other users; chmod 600 it", s.path)
+	}
+	contents, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if s.encrypted() {
+		if s.key == nil {
+			s.key, err = s.passphrase(false)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		contents, err = seal.OpenPassphrase(contents, s.key)
+		if err != nil {
+			s.key = nil
+			return nil, errors.Wrapf(err, "failed to decrypt %q", s.path)
+		}
+	}
+	secrets := map[string]string{}
+	if err := json.Unmarshal(contents, &secrets); err != nil {
+		return nil, errors.Wrapf(err, "invalid secrets file %q", s.path)
+	}
+	s.secrets, s.modTime, s.size = secrets, info.ModTime(), info.Size()
+	return secrets, nil
+}
+
+// save replaces the file with the secrets.
+func (s *fileStore) save(secrets map[string]string) error {
+	contents, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if s.encrypted() {
+		if s.key == nil {
+			// The file does not exist yet.
+			s.key, err = s.passphrase(true)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		contents, err = seal.WithPassphrase(contents, s.key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write %q", tmpPath)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "failed to write %q", s.path)
+	}
+	s.secrets = nil
+	if info, err := os.Stat(s.path); err == nil {
+		s.secrets, s.modTime, s.size = secrets, info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+func (s *fileStore) Get(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	value, ok := secrets[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *fileStore) Set(id, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	updated := map[string]string{id: value}
+	for k, v := range secrets {
+		if k != id {
+			updated[k] = v
+		}
+	}
+	return s.save(updated)
+}
+
+func (s *fileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, ok := secrets[id]; !ok {
+		return nil
+	}
+	updated := map[string]string{}
+	for k, v := range secrets {
+		if k != id {
+			updated[k] = v
+		}
+	}
+	return s.save(updated)
+}
+
+func (s *fileStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sortedKeys(secrets), nil
+}
@@ -0,0 +1,221 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secrets keeps client and remote auth tokens out of the
+// configuration, in a store which the configuration refers to by ID.
+package secrets
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/cmars/ormesh/config"
+)
+
+// ErrNotFound is returned by Get when the store has no secret with the ID.
+var ErrNotFound = errors.New("secret not found")
+
+// Store stores secrets by ID.
+type Store interface {
+	Get(id string) (string, error)
+	Set(id, value string) error
+	Delete(id string) error
+}
+
+// Lister is a Store which can list the IDs of its secrets, so that those no
+// longer referred to may be pruned.
+type Lister interface {
+	List() ([]string, error)
+}
+
+// PassphraseFunc returns the passphrase for an encrypted store. confirm is
+// true if the store is being created, and the passphrase should be
+// confirmed.
+type PassphraseFunc func(confirm bool) ([]byte, error)
+
+// Open returns the store configured for cfg, or nil if secrets are kept in
+// the configuration.
+func Open(cfg *config.Config, passphrase PassphraseFunc) (Store, error) {
+	switch cfg.Node.Secrets.Backend {
+	case "":
+		return nil, nil
+	case config.SecretsFile:
+		return &fileStore{path: FilePath(cfg)}, nil
+	case config.SecretsEncryptedFile:
+		return &fileStore{path: FilePath(cfg), passphrase: passphrase}, nil
+	case config.SecretsCommand:
+		if len(cfg.Node.Secrets.Command) == 0 {
+			return nil, errors.New("no secrets command configured")
+		}
+		return &commandStore{command: cfg.Node.Secrets.Command}, nil
+	}
+	return nil, errors.Errorf("invalid secrets backend %q", cfg.Node.Secrets.Backend)
+}
+
+// FilePath returns the path of the file used by the file backends.
+func FilePath(cfg *config.Config) string {
+	if cfg.Node.Secrets.Path != "" {
+		return cfg.Node.Secrets.Path
+	}
+	return filepath.Join(cfg.Dir, "secrets")
+}
+
+// secretRef is an auth token and its reference in the store.
+type secretRef struct {
+	id         string
+	value, ref *string
+}
+
+// refs returns the secrets in the node's configuration, with the IDs given
+// to them when they are first stored.
+func refs(node *config.Node) []secretRef {
+	var refs []secretRef
+	for i := range node.Service.Clients {
+		client := &node.Service.Clients[i]
+		refs = append(refs, secretRef{"client/" + client.CredentialName(), &client.Auth, &client.AuthRef})
+		if client.Next != nil {
+			refs = append(refs, secretRef{"client/" + client.Next.TorName, &client.Next.Auth, &client.Next.AuthRef})
+		}
+	}
+	for i := range node.Remotes {
+		remote := &node.Remotes[i]
+		refs = append(refs, secretRef{"remote/" + remote.Name, &remote.Auth, &remote.AuthRef})
+	}
+	return refs
+}
+
+// Resolve reads the secrets the node's configuration refers to from the
+// store.
+func Resolve(node *config.Node, store Store) error {
+	for _, r := range refs(node) {
+		if *r.ref == "" || *r.value != "" {
+			continue
+		}
+		if store == nil {
+			return errors.Errorf("secret %q is in a store, but no secrets backend is configured", *r.ref)
+		}
+		value, err := store.Get(*r.ref)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read secret %q", *r.ref)
+		}
+		*r.value = value
+	}
+	return nil
+}
+
+// Resolved returns the secrets the node's configuration refers to which have
+// been resolved, by ID.
+func Resolved(node *config.Node) map[string]string {
+	resolved := map[string]string{}
+	for _, r := range refs(node) {
+		if *r.ref != "" && *r.value != "" {
+			resolved[*r.ref] = *r.value
+		}
+	}
+	return resolved
+}
+
+// Refs returns the IDs of the secrets the node's configuration refers to.
+func Refs(node *config.Node) []string {
+	var ids []string
+	for _, r := range refs(node) {
+		if *r.ref != "" {
+			ids = append(ids, *r.ref)
+		}
+	}
+	return ids
+}
+
+// Externalize moves the secrets in the node's configuration to the store,
+// leaving references to them. Secrets which are as they were resolved, given
+// by resolved, are not stored again, so the store is only used if a secret
+// has changed. The secrets of prev, the IDs the configuration referred to
+// before it was changed, which it no longer refers to are deleted.
+func Externalize(node *config.Node, store Store, resolved map[string]string, prev []string) error {
+	if store == nil {
+		return nil
+	}
+	used := map[string]bool{}
+	for _, r := range refs(node) {
+		if *r.ref == "" && *r.value == "" {
+			continue
+		}
+		if *r.ref == "" {
+			*r.ref = r.id
+		}
+		used[*r.ref] = true
+		if *r.value == "" {
+			continue
+		}
+		if value, ok := resolved[*r.ref]; !ok || value != *r.value {
+			if err := store.Set(*r.ref, *r.value); err != nil {
+				return errors.Wrapf(err, "failed to store secret %q", *r.ref)
+			}
+		}
+		*r.value = ""
+	}
+	for _, id := range prev {
+		if !used[id] {
+			if err := store.Delete(id); err != nil {
+				return errors.Wrapf(err, "failed to delete secret %q", id)
+			}
+		}
+	}
+	return nil
+}
+
+// Unreferenced returns the IDs of the client and remote secrets in the store
+// which the node's configuration does not refer to. They may belong to
+// another configuration sharing the store.
+func Unreferenced(node *config.Node, store Store) ([]string, error) {
+	lister, ok := store.(Lister)
+	if !ok {
+		return nil, errors.New("the secrets store cannot list its secrets")
+	}
+	ids, err := lister.List()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	used := map[string]bool{}
+	for _, id := range Refs(node) {
+		used[id] = true
+	}
+	var unreferenced []string
+	for _, id := range ids {
+		if !used[id] && (strings.HasPrefix(id, "client/") || strings.HasPrefix(id, "remote/")) {
+			unreferenced = append(unreferenced, id)
+		}
+	}
+	return unreferenced, nil
+}
+
+// Inline clears the references to secrets in the node's configuration,
+// which should have been resolved, so that they are kept in it.
+func Inline(node *config.Node) {
+	for _, r := range refs(node) {
+		*r.ref = ""
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
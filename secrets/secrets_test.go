@@ -0,0 +1,161 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cmars/ormesh/config"
+	"github.com/cmars/ormesh/seal"
+)
+
+func TestExternalizeResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ormesh-secrets")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := &fileStore{path: filepath.Join(dir, "secrets")}
+
+	node := &config.Node{
+		Service: config.Service{Clients: []config.Client{
+			{Name: "alice", Auth: "alice-auth"},
+			{Name: "bob", TorName: "bob-1a2b", Auth: "bob-auth", Next: &config.Credential{TorName: "bob-3c4d", Auth: "bob-next"}},
+		}},
+		Remotes: []config.Remote{{Name: "server", Auth: "server-auth"}},
+	}
+	err = Externalize(node, store, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", node.Service.Clients[0].Auth)
+	assert.Equal(t, "client/alice", node.Service.Clients[0].AuthRef)
+	assert.Equal(t, "client/bob-1a2b", node.Service.Clients[1].AuthRef)
+	assert.Equal(t, "client/bob-3c4d", node.Service.Clients[1].Next.AuthRef)
+	assert.Equal(t, "remote/server", node.Remotes[0].AuthRef)
+	info, err := os.Stat(store.path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// The previous credential is no longer referred to once the next one
+	// replaces it.
+	prev := Refs(node)
+	node.Service.Clients[1].PromoteNext()
+	node.Remotes = nil
+	err = Externalize(node, store, nil, prev)
+	assert.NoError(t, err)
+	ids, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"client/alice", "client/bob-3c4d"}, ids)
+
+	// Secrets which are not the configuration's are only deleted when it is
+	// pruned.
+	assert.NoError(t, store.Set("remote/other", "other-auth"))
+	err = Externalize(node, store, nil, Refs(node))
+	assert.NoError(t, err)
+	ids, err = Unreferenced(node, store)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"remote/other"}, ids)
+
+	err = Resolve(node, &fileStore{path: store.path})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice-auth", node.Service.Clients[0].Auth)
+	assert.Equal(t, "bob-next", node.Service.Clients[1].Auth)
+
+	err = Resolve(&config.Node{Remotes: []config.Remote{{Name: "x", AuthRef: "remote/x"}}}, store)
+	assert.Error(t, err)
+}
+
+// countingStore counts the uses of a store.
+type countingStore struct {
+	Store
+	uses int
+}
+
+func (s *countingStore) Get(id string) (string, error) { s.uses++; return s.Store.Get(id) }
+func (s *countingStore) Set(id, value string) error    { s.uses++; return s.Store.Set(id, value) }
+func (s *countingStore) Delete(id string) error        { s.uses++; return s.Store.Delete(id) }
+
+func TestExternalizeUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ormesh-secrets")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := &countingStore{Store: &fileStore{path: filepath.Join(dir, "secrets")}}
+	node := &config.Node{Remotes: []config.Remote{
+		{Name: "server", Auth: "server-auth"},
+		{Name: "other", Auth: "other-auth"},
+	}}
+	assert.NoError(t, Externalize(node, store, nil, nil))
+	store.uses = 0
+
+	// Writing the configuration without changing its secrets does not use
+	// the store.
+	assert.NoError(t, Resolve(node, store))
+	resolved := Resolved(node)
+	store.uses = 0
+	assert.NoError(t, Externalize(node, store, resolved, Refs(node)))
+	assert.Equal(t, 0, store.uses)
+	assert.Equal(t, "", node.Remotes[0].Auth)
+
+	node.Remotes[0].Auth = "changed"
+	assert.NoError(t, Externalize(node, store, resolved, Refs(node)))
+	assert.Equal(t, 1, store.uses)
+	value, err := store.Get("remote/server")
+	assert.NoError(t, err)
+	assert.Equal(t, "changed", value)
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	defer func(n int) { seal.Iterations = n }(seal.Iterations)
+	seal.Iterations = 1000
+	dir, err := ioutil.TempDir("", "ormesh-secrets")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets")
+
+	var prompts []bool
+	passphrase := func(confirm bool) ([]byte, error) {
+		prompts = append(prompts, confirm)
+		return []byte("hunter2"), nil
+	}
+	store := &fileStore{path: path, passphrase: passphrase}
+	assert.NoError(t, store.Set("remote/server", "server-auth"))
+	assert.NoError(t, store.Set("client/alice", "alice-auth"))
+	assert.Equal(t, []bool{true}, prompts)
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, seal.IsPassphrase(contents))
+
+	store = &fileStore{path: path, passphrase: passphrase}
+	value, err := store.Get("client/alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice-auth", value)
+	_, err = store.Get("client/bob")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, []bool{true, false}, prompts)
+
+	store = &fileStore{path: path, passphrase: func(bool) ([]byte, error) { return []byte("wrong"), nil }}
+	_, err = store.Get("client/alice")
+	assert.Error(t, err)
+}
@@ -0,0 +1,199 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Extended reply codes sent by tor for onion service connection failures,
+// when the SocksPort is configured with the ExtendedErrors flag.
+const (
+	ReplyOnionDescNotFound      = 0xf0
+	ReplyOnionDescInvalid       = 0xf1
+	ReplyOnionIntroFailed       = 0xf2
+	ReplyOnionRendFailed        = 0xf3
+	ReplyOnionMissingClientAuth = 0xf4
+	ReplyOnionBadClientAuth     = 0xf5
+	ReplyOnionBadAddress        = 0xf6
+	ReplyOnionIntroTimedOut     = 0xf7
+)
+
+var replyReasons = map[byte]struct {
+	reason, text string
+	temporary    bool
+}{
+	ReplyGeneralFailure:         {"general-failure", "general SOCKS server failure", true},
+	ReplyNotAllowed:             {"not-allowed", "connection not allowed by ruleset", false},
+	ReplyNetworkUnreachable:     {"network-unreachable", "network unreachable", true},
+	ReplyHostUnreachable:        {"host-unreachable", "host unreachable", true},
+	ReplyConnectionRefused:      {"connection-refused", "connection refused", false},
+	ReplyTTLExpired:             {"ttl-expired", "TTL expired", true},
+	ReplyCommandNotSupported:    {"command-not-supported", "command not supported", false},
+	ReplyAddressNotSupported:    {"address-not-supported", "address type not supported", false},
+	ReplyOnionDescNotFound:      {"descriptor-not-found", "onion service descriptor not found", true},
+	ReplyOnionDescInvalid:       {"descriptor-invalid", "onion service descriptor is invalid", false},
+	ReplyOnionIntroFailed:       {"intro-failed", "onion service introduction failed", true},
+	ReplyOnionRendFailed:        {"rendezvous-failed", "onion service rendezvous failed", true},
+	ReplyOnionMissingClientAuth: {"missing-client-auth", "onion service client authorization missing", false},
+	ReplyOnionBadClientAuth:     {"bad-client-auth", "onion service client authorization rejected", false},
+	ReplyOnionBadAddress:        {"bad-address", "onion service address is invalid", false},
+	ReplyOnionIntroTimedOut:     {"intro-timed-out", "onion service introduction timed out", true},
+}
+
+// ReplyError is returned by Dialer when the SOCKS server refuses a
+// connection.
+type ReplyError struct {
+	Code byte
+}
+
+func (e *ReplyError) Error() string {
+	if r, ok := replyReasons[e.Code]; ok {
+		return fmt.Sprintf("SOCKS5 reply %#02x: %s", e.Code, r.text)
+	}
+	return fmt.Sprintf("SOCKS5 reply %#02x: unknown error", e.Code)
+}
+
+// Reason returns a short identifier for the reply code, suitable for use in
+// counters.
+func (e *ReplyError) Reason() string {
+	if r, ok := replyReasons[e.Code]; ok {
+		return r.reason
+	}
+	return "unknown-" + strconv.Itoa(int(e.Code))
+}
+
+// Temporary returns whether retrying the connection might succeed.
+func (e *ReplyError) Temporary() bool {
+	return replyReasons[e.Code].temporary
+}
+
+// Dialer connects to destinations through a SOCKS5 proxy. Unlike the dialers
+// in golang.org/x/net/proxy, it reports refused connections with a
+// ReplyError.
+type Dialer struct {
+	// ProxyAddr is the address of the SOCKS5 proxy.
+	ProxyAddr string
+	// Timeout bounds the time taken by Dial, if not zero.
+	Timeout time.Duration
+}
+
+// Dial implements proxy.Dialer.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialTimeout(network, addr, d.Timeout)
+}
+
+// DialTimeout connects to addr through the proxy, giving up after timeout if
+// it is not zero.
+func (d *Dialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.Errorf("unsupported network %q", network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, errors.Errorf("invalid port %q", portStr)
+	}
+	if len(host) > 255 {
+		return nil, errors.Errorf("host name %q too long", host)
+	}
+	c, err := net.DialTimeout("tcp", d.ProxyAddr, timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to SOCKS proxy %q", d.ProxyAddr)
+	}
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := connect(c, host, port); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func connect(c net.Conn, host string, port int) error {
+	if _, err := c.Write([]byte{socks5Version, 1, authNone}); err != nil {
+		return errors.WithStack(err)
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(c, resp[:]); err != nil {
+		return errors.Wrap(err, "failed to read SOCKS method")
+	}
+	if resp[0] != socks5Version {
+		return errors.Errorf("unsupported SOCKS version %d", resp[0])
+	}
+	if resp[1] != authNone {
+		return errors.New("no acceptable SOCKS auth method")
+	}
+
+	req := []byte{socks5Version, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, addrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, addrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, addrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := c.Write(req); err != nil {
+		return errors.WithStack(err)
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return errors.Wrap(err, "failed to read SOCKS reply")
+	}
+	if reply[0] != socks5Version {
+		return errors.Errorf("unsupported SOCKS version %d", reply[0])
+	}
+	if reply[1] != ReplySucceeded {
+		return errors.WithStack(&ReplyError{Code: reply[1]})
+	}
+	var addrLen int
+	switch reply[3] {
+	case addrIPv4:
+		addrLen = net.IPv4len
+	case addrIPv6:
+		addrLen = net.IPv6len
+	case addrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return errors.Wrap(err, "failed to read SOCKS reply")
+		}
+		addrLen = int(n[0])
+	default:
+		return errors.Errorf("unsupported address type %d in SOCKS reply", reply[3])
+	}
+	// Discard the bound address and port.
+	if _, err := io.ReadFull(c, make([]byte, addrLen+2)); err != nil {
+		return errors.Wrap(err, "failed to read SOCKS reply")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/proxy"
+)
+
+// refusingDialer fails every connection with a SOCKS reply code.
+type refusingDialer byte
+
+func (d refusingDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, &ReplyError{Code: byte(d)}
+}
+
+func TestDialer(t *testing.T) {
+	backend := listen(t)
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("hello"))
+			c.Close()
+		}
+	}()
+
+	l := listen(t)
+	defer l.Close()
+	go (&Server{
+		Name:   "test",
+		Policy: staticPolicy{"allowed.onion": backend.Addr().String()},
+		Dialer: proxy.Direct,
+	}).Serve(l)
+
+	d := &Dialer{ProxyAddr: l.Addr().String()}
+	c, err := d.Dial("tcp", "allowed.onion:80")
+	if err != nil {
+		t.Fatalf("dial allowed: %v", err)
+	}
+	buf, err := ioutil.ReadAll(c)
+	c.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = d.Dial("tcp", "denied.onion:80")
+	replyErr, ok := errors.Cause(err).(*ReplyError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, byte(ReplyNotAllowed), replyErr.Code)
+		assert.False(t, replyErr.Temporary())
+	}
+}
+
+func TestDialerExtendedErrors(t *testing.T) {
+	l := listen(t)
+	defer l.Close()
+	go (&Server{
+		Name:   "test",
+		Policy: staticPolicy{"remote.onion": "remote.onion:22"},
+		Dialer: refusingDialer(ReplyOnionMissingClientAuth),
+	}).Serve(l)
+
+	d := &Dialer{ProxyAddr: l.Addr().String()}
+	_, err := d.Dial("tcp", "remote.onion:22")
+	replyErr, ok := errors.Cause(err).(*ReplyError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, "missing-client-auth", replyErr.Reason())
+		assert.Contains(t, err.Error(), "client authorization missing")
+	}
+}
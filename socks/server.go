@@ -0,0 +1,244 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package socks implements a minimal SOCKS5 (RFC 1928) server, supporting
+// unauthenticated CONNECT requests subject to a Policy.
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socks5Version = 5
+
+	authNone          = 0
+	authNotAcceptable = 0xff
+
+	cmdConnect = 1
+
+	addrIPv4   = 1
+	addrDomain = 3
+	addrIPv6   = 4
+)
+
+// Reply codes defined by RFC 1928.
+const (
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddressNotSupported = 0x08
+)
+
+// ErrNotAllowed is returned by a Policy to reject a request.
+var ErrNotAllowed = errors.New("not allowed by policy")
+
+// Policy decides which destinations a Server will connect to.
+type Policy interface {
+	// Resolve returns the address that should be dialed in place of the
+	// requested host and port, or an error if the request is not allowed.
+	Resolve(host string, port int) (string, error)
+}
+
+// Logger receives a Server's log messages.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Infof(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Warnf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// Server is a SOCKS5 server that connects clients to destinations permitted
+// by its Policy, using Dialer.
+type Server struct {
+	// Name identifies the server in log messages.
+	Name   string
+	Policy Policy
+	Dialer proxy.Dialer
+	// Log receives connection and policy decisions. If nil, messages go
+	// to the standard library logger.
+	Log Logger
+}
+
+func (s *Server) logger() Logger {
+	if s.Log == nil {
+		return stdLogger{}
+	}
+	return s.Log
+}
+
+// Serve accepts connections from l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn handles a single SOCKS5 client connection.
+func (s *Server) ServeConn(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	logger := s.logger()
+	host, port, err := s.handshake(c)
+	if err != nil {
+		logger.Warnf("%s: %s: %v", s.Name, c.RemoteAddr(), err)
+		return
+	}
+	logger.Infof("%s: %s requested %s", s.Name, c.RemoteAddr(), net.JoinHostPort(host, strconv.Itoa(port)))
+	addr, err := s.Policy.Resolve(host, port)
+	if err != nil {
+		logger.Warnf("%s: %s rejected %s: %v", s.Name, c.RemoteAddr(),
+			net.JoinHostPort(host, strconv.Itoa(port)), err)
+		writeReply(c, ReplyNotAllowed)
+		return
+	}
+	dest, err := s.Dialer.Dial("tcp", addr)
+	if err != nil {
+		logger.Warnf("%s: %s failed to connect to %s: %v", s.Name, c.RemoteAddr(), addr, err)
+		code := byte(ReplyHostUnreachable)
+		if replyErr, ok := errors.Cause(err).(*ReplyError); ok {
+			// Pass on the upstream proxy's reason, such as tor's
+			// extended onion service errors.
+			code = replyErr.Code
+		}
+		writeReply(c, code)
+		return
+	}
+	defer dest.Close()
+	if err := writeReply(c, ReplySucceeded); err != nil {
+		logger.Warnf("%s: %s: %v", s.Name, c.RemoteAddr(), err)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	Pipe(c, dest)
+}
+
+func (s *Server) handshake(c net.Conn) (string, int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", 0, errors.Wrap(err, "failed to read greeting")
+	}
+	if hdr[0] != socks5Version {
+		return "", 0, errors.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", 0, errors.Wrap(err, "failed to read auth methods")
+	}
+	method := byte(authNotAcceptable)
+	for _, m := range methods {
+		if m == authNone {
+			method = authNone
+			break
+		}
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	if method == authNotAcceptable {
+		return "", 0, errors.New("no acceptable auth method")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return "", 0, errors.Wrap(err, "failed to read request")
+	}
+	if req[0] != socks5Version {
+		return "", 0, errors.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	var host string
+	switch req[3] {
+	case addrIPv4, addrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == addrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", 0, errors.Wrap(err, "failed to read address")
+		}
+		host = ip.String()
+	case addrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return "", 0, errors.Wrap(err, "failed to read address")
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", 0, errors.Wrap(err, "failed to read address")
+		}
+		host = string(name)
+	default:
+		writeReply(c, ReplyAddressNotSupported)
+		return "", 0, errors.Errorf("unsupported address type %d", req[3])
+	}
+	var portBuf [2]byte
+	if _, err := io.ReadFull(c, portBuf[:]); err != nil {
+		return "", 0, errors.Wrap(err, "failed to read port")
+	}
+	if req[1] != cmdConnect {
+		writeReply(c, ReplyCommandNotSupported)
+		return "", 0, errors.Errorf("unsupported command %d", req[1])
+	}
+	return host, int(binary.BigEndian.Uint16(portBuf[:])), nil
+}
+
+func writeReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0, addrIPv4, 0, 0, 0, 0, 0, 0})
+	return errors.WithStack(err)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data in both directions between a and b until both directions
+// are done, half-closing each side as its source reaches EOF.
+func Pipe(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		copyHalf(a, b)
+		close(done)
+	}()
+	copyHalf(b, a)
+	<-done
+}
+
+func copyHalf(dest, source net.Conn) {
+	io.Copy(dest, source)
+	if cw, ok := dest.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dest.Close()
+	}
+}
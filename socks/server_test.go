@@ -0,0 +1,103 @@
+// Copyright © 2017 Casey Marshall
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/proxy"
+)
+
+type staticPolicy map[string]string
+
+func (p staticPolicy) Resolve(host string, port int) (string, error) {
+	if addr, ok := p[host]; ok {
+		return addr, nil
+	}
+	return "", ErrNotAllowed
+}
+
+type recordLogger struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (l *recordLogger) Infof(format string, args ...interface{}) {}
+
+func (l *recordLogger) Warnf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	return l
+}
+
+func TestServerPolicy(t *testing.T) {
+	backend := listen(t)
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("hello"))
+			c.Close()
+		}
+	}()
+
+	l := listen(t)
+	defer l.Close()
+	log := &recordLogger{}
+	srv := &Server{
+		Name:   "test",
+		Policy: staticPolicy{"allowed": backend.Addr().String()},
+		Dialer: proxy.Direct,
+		Log:    log,
+	}
+	go srv.Serve(l)
+
+	client, err := proxy.SOCKS5("tcp", l.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5: %v", err)
+	}
+	c, err := client.Dial("tcp", "allowed:80")
+	if err != nil {
+		t.Fatalf("dial allowed: %v", err)
+	}
+	buf, err := ioutil.ReadAll(c)
+	c.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = client.Dial("tcp", "denied:80")
+	assert.Error(t, err)
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if assert.Len(t, log.warnings, 1) {
+		assert.Contains(t, log.warnings[0], "rejected denied:80")
+	}
+}